@@ -0,0 +1,463 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Books and users are archived rather than deleted: an archived record drops
+// out of the default listings and takes no part in new loans or holds, but
+// loans, fines and the audit log can still resolve it. Archiving is undone
+// by restore. Purging deletes the record for good, and only once the
+// retention period has passed both since it was archived and since its last
+// loan ended.
+
+// archiveRetentionDays is how long an archived record is kept before it may
+// be purged (ARCHIVE_RETENTION_DAYS).
+var archiveRetentionDays = 365
+
+func loadArchiveConfig() {
+	if n, err := strconv.Atoi(os.Getenv("ARCHIVE_RETENTION_DAYS")); err == nil && n >= 0 {
+		archiveRetentionDays = n
+	}
+}
+
+func (b *Book) archived() bool { return b.ArchivedAt != "" }
+func (u *User) archived() bool { return u.ArchivedAt != "" }
+
+// archivedFilter reads ?archived=: archived records are left out by default,
+// "include" lists them too and "only" lists nothing else.
+func archivedFilter(qs url.Values) (keep func(archived bool) bool, msg string) {
+	switch qs.Get("archived") {
+	case "":
+		return func(archived bool) bool { return !archived }, ""
+	case "include":
+		return func(bool) bool { return true }, ""
+	case "only":
+		return func(archived bool) bool { return archived }, ""
+	}
+	return nil, "archived must be include or only"
+}
+
+// purgeBlock says why a record archived at archivedAt, with the given loans,
+// must still be kept, or returns "" when it may be purged.
+func purgeBlock(archivedAt string, loans []Loan) string {
+	cutoff := clock.Now().UTC().AddDate(0, 0, -archiveRetentionDays)
+	if at := parseTime(archivedAt); at.After(cutoff) {
+		return fmt.Sprintf("Archived records are kept for %d days; this one can be purged from %s",
+			archiveRetentionDays, at.AddDate(0, 0, archiveRetentionDays).Format(dateLayout))
+	}
+	for _, l := range loans {
+		if l.active() {
+			return "Loan " + l.ID + " is still open"
+		}
+		if end, err := parseDate(l.ReturnDate); err == nil && end.After(cutoff) {
+			return fmt.Sprintf("Loan %s ended on %s; records are kept for %d days after their last loan",
+				l.ID, l.ReturnDate, archiveRetentionDays)
+		}
+	}
+	return ""
+}
+
+// archiveReason reads the optional {"reason": ...} body of an archive call.
+func archiveReason(r *http.Request) (string, error) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength == 0 {
+		return "", nil
+	}
+	if err := jsonRead(r, &req); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(req.Reason), nil
+}
+
+// apiArchiveBook serves DELETE /api/books/{id}. The book's copies stay as
+// they are, so a restore puts it back on the shelf unchanged.
+func apiArchiveBook(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/books/")
+	if id == "" {
+		jsonWrite(w, 400, map[string]any{"error": "Missing id"})
+		return
+	}
+	reason, err := archiveReason(r)
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	book, err := store.Books().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if book == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+		return
+	}
+	if book.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Book is already archived"})
+		return
+	}
+
+	loans, err := store.Loans().ByBook(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	for _, l := range loans {
+		if l.active() {
+			jsonWrite(w, 400, map[string]any{"error": "Cannot archive: book is borrowed now"})
+			return
+		}
+	}
+
+	holds, err := store.Holds().ByBook(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	for _, h := range holds {
+		if h.active() {
+			jsonWrite(w, 400, map[string]any{"error": "Cannot archive: readers have holds on this book"})
+			return
+		}
+	}
+
+	before := *book
+	book.ArchivedAt = clock.Now().UTC().Format(time.RFC3339)
+	book.ArchiveReason = reason
+	err = store.Atomic(func() error {
+		if err := store.Books().Update(*book); err != nil {
+			return err
+		}
+		return recordAudit(r, "book.archive", "book", id, before, book)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true, "book": book})
+}
+
+// apiRestoreBook serves POST /api/books/{id}/restore.
+func apiRestoreBook(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/books/"), "/restore")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	book, err := store.Books().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if book == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+		return
+	}
+	if !book.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Book is not archived"})
+		return
+	}
+
+	before := *book
+	book.ArchivedAt, book.ArchiveReason = "", ""
+	err = store.Atomic(func() error {
+		if err := store.Books().Update(*book); err != nil {
+			return err
+		}
+		return recordAudit(r, "book.restore", "book", id, before, book)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, book)
+}
+
+// purgeSummary is what the audit log keeps of a purged record: its ID and
+// when it was archived. Copying the record itself into the log would keep
+// the personal data that purging is there to remove; the log redacts it
+// everywhere else too (auditRedacted), so deleting the record deletes it.
+func purgeSummary(id, archivedAt string) map[string]any {
+	return map[string]any{"id": id, "archivedAt": archivedAt}
+}
+
+// apiPurgeBook serves POST /api/books/{id}/purge: it deletes an archived
+// book and its copies once retention allows. Loans keep the book's ID.
+func apiPurgeBook(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/books/"), "/purge")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	book, err := store.Books().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if book == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+		return
+	}
+	if !book.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Only archived books can be purged"})
+		return
+	}
+	loans, err := store.Loans().ByBook(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if msg := purgeBlock(book.ArchivedAt, loans); msg != "" {
+		jsonWrite(w, 409, map[string]any{"error": msg})
+		return
+	}
+
+	copies, err := store.Copies().ByBook(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	err = store.Atomic(func() error {
+		for _, c := range copies {
+			if err := store.Copies().Delete(c.ID); err != nil {
+				return err
+			}
+		}
+		if err := store.Books().Delete(id); err != nil {
+			return err
+		}
+		return recordAudit(r, "book.purge", "book", id, purgeSummary(id, book.ArchivedAt), nil)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	catalog.remove(id)
+	jsonWrite(w, 200, map[string]any{"ok": true})
+}
+
+// apiArchiveUser serves DELETE /api/users/{id}. The account is logged out
+// everywhere and can no longer sign in; its holds are cancelled.
+func apiArchiveUser(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	reason, err := archiveReason(r)
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	me, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	if me.ID == id {
+		jsonWrite(w, 400, map[string]any{"error": "You cannot archive your own account"})
+		return
+	}
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	if u.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "User is already archived"})
+		return
+	}
+	last, err := lastActiveAdmin(u)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if last {
+		jsonWrite(w, 400, map[string]any{"error": "Cannot archive the last admin"})
+		return
+	}
+
+	loans, err := store.Loans().ByReader(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	for _, l := range loans {
+		if l.active() {
+			jsonWrite(w, 400, map[string]any{"error": "Cannot archive: reader has books on loan"})
+			return
+		}
+	}
+	holds, err := store.Holds().ByReader(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	before := *u
+	var ready []Hold
+	err = store.Atomic(func() error {
+		for _, h := range holds {
+			if !h.active() {
+				continue
+			}
+			old := h
+			h.Status = holdCancelled
+			h.ClosedAt = nowDate()
+			if err := store.Holds().Update(h); err != nil {
+				return err
+			}
+			next, err := releaseHeldCopy(h)
+			if err != nil {
+				return err
+			}
+			if next != nil {
+				ready = append(ready, *next)
+			}
+			if err := recordAudit(r, "hold.cancel", "hold", h.ID, old, h); err != nil {
+				return err
+			}
+		}
+		if _, err := revokeUserSessions(id); err != nil {
+			return err
+		}
+		after, err := store.Users().ByID(id)
+		if err != nil {
+			return err
+		}
+		after.ArchivedAt = clock.Now().UTC().Format(time.RFC3339)
+		after.ArchiveReason = reason
+		if err := store.Users().Update(*after); err != nil {
+			return err
+		}
+		u = after
+		return recordAudit(r, "user.archive", "user", id, before, after)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	notifyHoldsReady(ready...)
+	jsonWrite(w, 200, map[string]any{"ok": true, "user": userView(u)})
+}
+
+// apiRestoreUser serves POST /api/users/{id}/restore. The user signs in
+// with their old password again.
+func apiRestoreUser(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/restore")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	if !u.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "User is not archived"})
+		return
+	}
+
+	before := *u
+	u.ArchivedAt, u.ArchiveReason = "", ""
+	err = store.Atomic(func() error {
+		if err := store.Users().Update(*u); err != nil {
+			return err
+		}
+		return recordAudit(r, "user.restore", "user", id, before, u)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, userView(u))
+}
+
+// apiPurgeUser serves POST /api/users/{id}/purge. Besides retention, the
+// reader must have settled their fines; the ledger lines themselves are kept,
+// as the ledger is never rewritten.
+func apiPurgeUser(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/purge")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	if !u.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Only archived users can be purged"})
+		return
+	}
+	loans, err := store.Loans().ByReader(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if msg := purgeBlock(u.ArchivedAt, loans); msg != "" {
+		jsonWrite(w, 409, map[string]any{"error": msg})
+		return
+	}
+	acct, err := fineAccountFor(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if acct.Balance != 0 {
+		jsonWrite(w, 409, map[string]any{"error": "User still has a fine balance of " + acct.Balance.String()})
+		return
+	}
+
+	key := accountKey(u.Email)
+	attempts, err := store.LoginAttempts().ByID(key)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	err = store.Atomic(func() error {
+		if _, err := revokeSessions(id, func(Session) bool { return true }); err != nil {
+			return err
+		}
+		if attempts != nil {
+			if err := store.LoginAttempts().Delete(key); err != nil {
+				return err
+			}
+		}
+		if err := store.Users().Delete(id); err != nil {
+			return err
+		}
+		return recordAudit(r, "user.purge", "user", id, purgeSummary(id, u.ArchivedAt), nil)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLastActiveAdmin(t *testing.T) {
+	openTestStore(t)
+	admins := []User{
+		{ID: "U1", Email: "a@x.kz", Role: "admin"},
+		{ID: "U2", Email: "b@x.kz", Role: "admin"},
+		{ID: "U3", Email: "l@x.kz", Role: "librarian"},
+	}
+	for _, u := range admins {
+		if err := store.Users().Create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, l := &admins[0], &admins[2]
+
+	if w := call(apiArchiveUser, authRequest(t, a, "DELETE", "/api/users/U2", "")); w.Code != 200 {
+		t.Fatalf("archive the other admin: status %d: %s", w.Code, w.Body)
+	}
+	if w := call(apiSetUserRole, authRequest(t, a, "PATCH", "/api/users/U1/role", `{"role":"reader"}`)); w.Code != 400 {
+		t.Errorf("demote the last active admin: status %d, want 400", w.Code)
+	}
+	if w := call(apiArchiveUser, authRequest(t, l, "DELETE", "/api/users/U1", "")); w.Code != 400 {
+		t.Errorf("archive the last active admin: status %d, want 400", w.Code)
+	}
+	if w := call(apiSetUserRole, authRequest(t, a, "PATCH", "/api/users/U2/role", `{"role":"reader"}`)); w.Code != 200 {
+		t.Errorf("demote an archived admin: status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+// seedArchive stores a reader U1 and a book B1 with one copy, and the given
+// loans of it.
+func seedArchive(t *testing.T, loans ...Loan) {
+	t.Helper()
+	if err := store.Users().Create(User{ID: "U1", Email: "r@x.kz", Role: "reader", Category: readerStudent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Books().Create(Book{ID: "B1", BookCode: "C1", Category: bookStandard, TotalQty: 1, AvailableQty: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Copies().Create(Copy{ID: "C1", BookID: "B1", Barcode: "C1-001", Status: copyAvailable}); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range loans {
+		l.ReaderID, l.BookID, l.CopyID = "U1", "B1", "C1"
+		if err := store.Loans().Create(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestArchiveBlockedByOpenLoans(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   int
+	}{
+		{"on loan", loanBorrowed, 400},
+		{"overdue", loanOverdue, 400},
+		{"returned", loanReturned, 200},
+		{"lost", loanLost, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestStore(t)
+			setClock(t, "2026-03-02")
+			seedArchive(t, Loan{ID: "L1", LoanDate: "2026-02-20", DueDate: "2026-03-06", Status: tt.status})
+			staff := &User{ID: "U9", Role: "admin"}
+
+			if w := call(apiArchiveBook, authRequest(t, staff, "DELETE", "/api/books/B1", "")); w.Code != tt.want {
+				t.Errorf("archive book: status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w := call(apiArchiveUser, authRequest(t, staff, "DELETE", "/api/users/U1", "")); w.Code != tt.want {
+				t.Errorf("archive reader: status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestPurgeRetention(t *testing.T) {
+	tests := []struct {
+		name     string
+		returned string // when the only loan ended; "" for none
+		purgeOn  string
+		want     int
+	}{
+		{"inside retention", "", "2027-03-01", 409},
+		{"retention passed", "", "2027-03-03", 200},
+		{"loan ended after archiving", "2026-06-01", "2027-03-03", 409},
+		{"retention passed since the loan", "2026-06-01", "2027-06-02", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestStore(t)
+			var loans []Loan
+			if tt.returned != "" {
+				// A loan closed by a late import, after the book was archived.
+				loans = append(loans, Loan{ID: "L1", LoanDate: "2026-01-10", ReturnDate: tt.returned, Status: loanReturned})
+			}
+			seedArchive(t, loans...)
+			staff := &User{ID: "U9", Role: "admin"}
+
+			setClock(t, "2026-03-02")
+			if w := call(apiArchiveBook, authRequest(t, staff, "DELETE", "/api/books/B1", "")); w.Code != 200 {
+				t.Fatalf("archive: status %d: %s", w.Code, w.Body)
+			}
+			setClock(t, tt.purgeOn)
+			w := call(apiPurgeBook, authRequest(t, staff, "POST", "/api/books/B1/purge", ""))
+			if w.Code != tt.want {
+				t.Fatalf("purge on %s: status %d, want %d: %s", tt.purgeOn, w.Code, tt.want, w.Body)
+			}
+			b, _ := store.Books().ByID("B1")
+			c, _ := store.Copies().ByID("C1")
+			if gone := b == nil && c == nil; gone != (tt.want == 200) {
+				t.Errorf("book and copy gone = %v after status %d", gone, w.Code)
+			}
+		})
+	}
+}
+
+func TestPurgeUserBlockedByFineBalance(t *testing.T) {
+	openTestStore(t)
+	seedArchive(t, Loan{ID: "L1", LoanDate: "2025-01-10", ReturnDate: "2025-02-01", Status: loanReturned})
+	staff := &User{ID: "U9", Role: "admin"}
+	if err := store.Fines().Create(FineTx{ID: "F1", UserID: "U1", LoanID: "L1", Kind: fineAssessed, Amount: 1500, CreatedAt: "2025-02-01"}); err != nil {
+		t.Fatal(err)
+	}
+
+	setClock(t, "2025-03-02")
+	if w := call(apiArchiveUser, authRequest(t, staff, "DELETE", "/api/users/U1", "")); w.Code != 200 {
+		t.Fatalf("archive: status %d: %s", w.Code, w.Body)
+	}
+	setClock(t, "2026-03-03")
+	if w := call(apiPurgeUser, authRequest(t, staff, "POST", "/api/users/U1/purge", "")); w.Code != 409 {
+		t.Errorf("purge owing 15.00: status %d, want 409: %s", w.Code, w.Body)
+	}
+	if err := store.Fines().Create(FineTx{ID: "F2", UserID: "U1", LoanID: "L1", Kind: finePayment, Amount: 1500, CreatedAt: "2026-03-03"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := call(apiPurgeUser, authRequest(t, staff, "POST", "/api/users/U1/purge", "")); w.Code != 200 {
+		t.Errorf("purge after paying: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if u, _ := store.Users().ByID("U1"); u != nil {
+		t.Errorf("user still stored after purge: %+v", u)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	openTestStore(t)
+	setClock(t, "2026-03-02")
+	seedArchive(t)
+	staff := &User{ID: "U9", Role: "admin"}
+
+	for _, c := range []struct {
+		handler     http.HandlerFunc
+		method, url string
+		want        int
+	}{
+		{apiRestoreBook, "POST", "/api/books/B1/restore", 400},
+		{apiArchiveBook, "DELETE", "/api/books/B1", 200},
+		{apiArchiveBook, "DELETE", "/api/books/B1", 400},
+		{apiRestoreBook, "POST", "/api/books/B1/restore", 200},
+		{apiRestoreUser, "POST", "/api/users/U1/restore", 400},
+		{apiArchiveUser, "DELETE", "/api/users/U1", 200},
+		{apiRestoreUser, "POST", "/api/users/U1/restore", 200},
+	} {
+		if w := call(c.handler, authRequest(t, staff, c.method, c.url, "")); w.Code != c.want {
+			t.Errorf("%s %s: status %d, want %d: %s", c.method, c.url, w.Code, c.want, w.Body)
+		}
+	}
+	b, _ := store.Books().ByID("B1")
+	u, _ := store.Users().ByID("U1")
+	if b.archived() || b.ArchiveReason != "" || u.archived() {
+		t.Errorf("after restore: book archived %v, user archived %v", b.archived(), u.archived())
+	}
+}
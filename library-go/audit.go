@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one change made through the API: who made it, from
+// where, and what it changed. Entries are only ever appended. Each one's Hash
+// covers the entry and the Hash before it, so editing, removing or
+// reordering any entry breaks the chain from that point on (see verifyAudit).
+// ActorID is empty for requests made without a login (self-registration).
+//
+// Entries hold no personal data, since the chain can never give it up: user
+// names, emails and phones are redacted like secrets (auditRedacted), and
+// the actor is kept by ID only. ActorEmail is filled in from the user record
+// when entries are listed and is gone once that user is purged; entries
+// written before this rule may still carry it in the chain.
+type AuditEntry struct {
+	ID         string                 `json:"id"`
+	Seq        int                    `json:"seq"`
+	At         string                 `json:"at"`
+	ActorID    string                 `json:"actorId,omitempty"`
+	ActorEmail string                 `json:"actorEmail,omitempty"`
+	ActorRole  string                 `json:"actorRole,omitempty"`
+	IP         string                 `json:"ip"`
+	Action     string                 `json:"action"`
+	Entity     string                 `json:"entity"`
+	EntityID   string                 `json:"entityId"`
+	Changes    map[string]auditChange `json:"changes,omitempty"`
+	PrevHash   string                 `json:"prevHash"`
+	Hash       string                 `json:"hash"`
+}
+
+// auditChange is one field's value before and after; a missing side means
+// the record was created or deleted. Values are kept as canonical JSON (keys
+// sorted) so the hash survives any rewrite of the stored document.
+type auditChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// auditRedacted fields are logged as changed without their values: secrets,
+// and the personal data a purge has to be able to remove.
+var auditRedacted = map[string]bool{
+	"passwordHash":   true,
+	"resetTokenHash": true,
+	"fullName":       true,
+	"email":          true,
+	"phone":          true,
+}
+
+var redactedValue = json.RawMessage(`"[redacted]"`)
+
+// canonicalJSON re-encodes raw with object keys sorted.
+func canonicalJSON(raw []byte) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// auditFields splits a record into its top-level JSON fields. nil (or a nil
+// pointer) has none; a value that is not an object is a single "value".
+func auditFields(v any) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if string(raw) == "null" {
+		return fields, nil
+	}
+	if raw[0] != '{' {
+		fields["value"] = raw
+		return fields, nil
+	}
+	return fields, json.Unmarshal(raw, &fields)
+}
+
+// auditDiff lists the fields that differ between before and after.
+func auditDiff(before, after any) (map[string]auditChange, error) {
+	b, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]auditChange{}
+	for _, fields := range []map[string]json.RawMessage{b, a} {
+		for k := range fields {
+			if _, done := out[k]; done {
+				continue
+			}
+			var c auditChange
+			if v, ok := b[k]; ok {
+				if c.Before, err = canonicalJSON(v); err != nil {
+					return nil, err
+				}
+			}
+			if v, ok := a[k]; ok {
+				if c.After, err = canonicalJSON(v); err != nil {
+					return nil, err
+				}
+			}
+			if bytes.Equal(c.Before, c.After) {
+				continue
+			}
+			if auditRedacted[k] {
+				c.Before, c.After = nil, nil
+				if b[k] != nil {
+					c.Before = redactedValue
+				}
+				if a[k] != nil {
+					c.After = redactedValue
+				}
+			}
+			out[k] = c
+		}
+	}
+	return out, nil
+}
+
+// auditHash is the hex SHA-256 of the entry with its own Hash left out.
+func auditHash(e AuditEntry) string {
+	e.Hash = ""
+	raw, _ := json.Marshal(e)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordAudit appends an entry for a change the request r made to entity id,
+// given the record before and after it (nil when there was none). Call it
+// inside the store.Atomic that makes the change, so the change and its entry
+// are stored together. Callers must hold mu.
+func recordAudit(r *http.Request, action, entity, id string, before, after any) error {
+	changes, err := auditDiff(before, after)
+	if err != nil {
+		return err
+	}
+	last, err := store.Audit().Last()
+	if err != nil {
+		return err
+	}
+	e := AuditEntry{
+		Seq:      1,
+		At:       time.Now().UTC().Format(time.RFC3339),
+		IP:       clientIP(r),
+		Action:   action,
+		Entity:   entity,
+		EntityID: id,
+		Changes:  changes,
+	}
+	if last != nil {
+		e.Seq, e.PrevHash = last.Seq+1, last.Hash
+	}
+	e.ID = genID("E", e.Seq)
+	// The actor is whoever the request is authenticated as; handlers have
+	// already checked that, so a failure here just means an anonymous call.
+	if u, err := authUser(r); err == nil {
+		e.ActorID, e.ActorRole = u.ID, u.Role
+	}
+	e.Hash = auditHash(e)
+	return store.Audit().Append(e)
+}
+
+// verifyAudit walks the chain and returns the sequence number of the first
+// entry that does not fit it, with why, or 0 when the log is intact.
+func verifyAudit(entries []AuditEntry) (int, string) {
+	prev := ""
+	for i, e := range entries {
+		switch {
+		case e.Seq != i+1:
+			return i + 1, fmt.Sprintf("expected entry %d, found %d", i+1, e.Seq)
+		case e.PrevHash != prev:
+			return e.Seq, "prevHash does not match the entry before"
+		case auditHash(e) != e.Hash:
+			return e.Seq, "hash does not match the entry's contents"
+		}
+		prev = e.Hash
+	}
+	return 0, ""
+}
+
+// auditTime reads a ?from/?to bound: a date (from its start, or through its
+// end for to) or an RFC 3339 time.
+func auditTime(s string, end bool) (time.Time, error) {
+	if t, err := parseDate(s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// apiListAudit returns audit entries, newest first:
+//
+//	GET /api/audit?actor=&entity=&entityId=&action=&from=&to=&page=1&pageSize=20
+//
+// actor matches the actor's id or email; from and to bound the time.
+func apiListAudit(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	page, pageSize, msg := pageParams(qs)
+	if msg != "" {
+		jsonWrite(w, 400, map[string]any{"error": msg})
+		return
+	}
+	var from, to time.Time
+	for _, b := range []struct {
+		key string
+		end bool
+		t   *time.Time
+	}{{"from", false, &from}, {"to", true, &to}} {
+		if v := qs.Get(b.key); v != "" {
+			t, err := auditTime(v, b.end)
+			if err != nil {
+				jsonWrite(w, 400, map[string]any{"error": b.key + " must be YYYY-MM-DD or an RFC 3339 time"})
+				return
+			}
+			*b.t = t
+		}
+	}
+	actor := strings.ToLower(strings.TrimSpace(qs.Get("actor")))
+	entity, entityID, action := qs.Get("entity"), qs.Get("entityId"), qs.Get("action")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	entries, err := store.Audit().All()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	emails := map[string]string{}
+	actorEmail := func(id string) (string, error) {
+		if email, ok := emails[id]; ok || id == "" {
+			return email, nil
+		}
+		u, err := store.Users().ByID(id)
+		if err != nil {
+			return "", err
+		}
+		emails[id] = ""
+		if u != nil {
+			emails[id] = u.Email
+		}
+		return emails[id], nil
+	}
+	items := []AuditEntry{}
+	for _, e := range entries {
+		if e.ActorEmail == "" {
+			if e.ActorEmail, err = actorEmail(e.ActorID); err != nil {
+				storeError(w, err)
+				return
+			}
+		}
+		if actor != "" && strings.ToLower(e.ActorID) != actor && strings.ToLower(e.ActorEmail) != actor {
+			continue
+		}
+		if (entity != "" && e.Entity != entity) || (entityID != "" && e.EntityID != entityID) || (action != "" && e.Action != action) {
+			continue
+		}
+		at, _ := time.Parse(time.RFC3339, e.At)
+		if (!from.IsZero() && at.Before(from)) || (!to.IsZero() && at.After(to)) {
+			continue
+		}
+		items = append(items, e)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Seq > items[j].Seq })
+
+	total := len(items)
+	start, end := pageBounds(page, pageSize, total)
+	jsonWrite(w, 200, map[string]any{
+		"items":    items[start:end],
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+		"pages":    (total + pageSize - 1) / pageSize,
+	})
+}
+
+// apiVerifyAudit checks the whole hash chain.
+func apiVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	entries, err := store.Audit().All()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	seq, why := verifyAudit(entries)
+	if seq != 0 {
+		jsonWrite(w, 200, map[string]any{"ok": false, "entries": len(entries), "brokenAt": seq, "reason": why})
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true, "entries": len(entries)})
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !method(w, r, "GET") {
+		return
+	}
+	switch r.URL.Path {
+	case "/api/audit":
+		requirePermission(permAuditRead, apiListAudit)(w, r)
+	case "/api/audit/verify":
+		requirePermission(permAuditRead, apiVerifyAudit)(w, r)
+	default:
+		jsonWrite(w, 404, map[string]any{"error": "Not found"})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAuditDiffKeepsNoPersonalData(t *testing.T) {
+	before := User{ID: "U1", FullName: "Aigerim Sadykova", Email: "aigerim@example.kz", Phone: "+77010000000", Role: "reader"}
+	after := before
+	after.Email, after.Role = "a.sadykova@example.kz", "librarian"
+
+	for _, tt := range []struct {
+		name          string
+		before, after any
+	}{
+		{"created", nil, before},
+		{"changed", before, after},
+		{"deleted", after, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := auditDiff(tt.before, tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, _ := json.Marshal(changes)
+			for _, pii := range []string{"Aigerim", "aigerim@", "sadykova@", "+7701"} {
+				if strings.Contains(string(raw), pii) {
+					t.Errorf("changes keep %q: %s", pii, raw)
+				}
+			}
+			if tt.before != nil && tt.after != nil {
+				if _, ok := changes["email"]; !ok {
+					t.Errorf("email change not logged: %s", raw)
+				}
+				if c := changes["role"]; string(c.After) != `"librarian"` {
+					t.Errorf("role after = %s, want \"librarian\"", c.After)
+				}
+			}
+		})
+	}
+}
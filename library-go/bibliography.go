@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Author is a person credited on books. Each one is stored once, however
+// many books name them, so the catalog can be browsed by author.
+type Author struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Contributor credits an author on one book. Name repeats the author's name
+// so book lists need no second lookup; renaming the author rewrites it.
+type Contributor struct {
+	AuthorID string `json:"authorId"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+}
+
+const (
+	roleAuthor     = "author"
+	roleTranslator = "translator"
+	roleEditor     = "editor"
+)
+
+var contributorRoles = []string{roleAuthor, roleTranslator, roleEditor}
+
+// cleanName trims a person's name and collapses inner runs of spaces.
+func cleanName(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// authorKey is what two spellings of a name must share to be the same
+// author: the cleaned name, lower-cased.
+func authorKey(name string) string {
+	return strings.ToLower(cleanName(name))
+}
+
+// byline is the Author text shown for a book: its authors, or everyone
+// credited when it has no author (an anthology with only an editor).
+func byline(cs []Contributor) string {
+	var names []string
+	for _, c := range cs {
+		if c.Role == roleAuthor {
+			names = append(names, c.Name)
+		}
+	}
+	if len(names) == 0 {
+		for _, c := range cs {
+			names = append(names, c.Name)
+		}
+	}
+	return strings.Join(names, "; ")
+}
+
+// checkContributors cleans the contributors sent for a book. A missing role
+// means author. Entries naming an existing authorId take its name; the rest
+// are matched to authors by linkAuthors. It returns a message for the client
+// when the list is unusable. Callers must hold mu.
+func checkContributors(in []Contributor) ([]Contributor, string, error) {
+	out := []Contributor{}
+	seen := map[string]bool{}
+	for _, c := range in {
+		if c.Role == "" {
+			c.Role = roleAuthor
+		}
+		if !validCategory(contributorRoles, c.Role) {
+			return nil, "Unknown contributor role " + c.Role, nil
+		}
+		if c.AuthorID != "" {
+			a, err := store.Authors().ByID(c.AuthorID)
+			if err != nil {
+				return nil, "", err
+			}
+			if a == nil {
+				return nil, "Unknown author " + c.AuthorID, nil
+			}
+			c.Name = a.Name
+		}
+		c.Name = cleanName(c.Name)
+		if c.Name == "" {
+			return nil, "Contributor name is required", nil
+		}
+		k := authorKey(c.Name) + "\x00" + c.Role
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, c)
+	}
+	if len(out) == 0 {
+		return nil, "At least one author or contributor is required", nil
+	}
+	return out, "", nil
+}
+
+// linkAuthors points every contributor without an authorId at the author of
+// that name, creating the author when there is none yet. Run it inside
+// store.Atomic together with the book write.
+func linkAuthors(cs []Contributor) error {
+	for i, c := range cs {
+		if c.AuthorID != "" {
+			continue
+		}
+		a, err := store.Authors().ByName(c.Name)
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			id, err := newID("author")
+			if err != nil {
+				return err
+			}
+			a = &Author{ID: id, Name: c.Name, CreatedAt: nowDate()}
+			if err := store.Authors().Create(*a); err != nil {
+				return err
+			}
+		}
+		cs[i].AuthorID, cs[i].Name = a.ID, a.Name
+	}
+	return nil
+}
+
+var errISBNDigits = errors.New("ISBN must be 10 or 13 digits (ISBN-10 may end in X)")
+
+// normalizeISBN accepts an ISBN-10 or ISBN-13, with or without hyphens and
+// spaces, checks its check digit and returns it as a bare ISBN-13.
+func normalizeISBN(s string) (string, error) {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(s)))
+	switch len(s) {
+	case 10:
+		sum := 0
+		for i, ch := range s {
+			d := int(ch - '0')
+			switch {
+			case ch == 'X' && i == 9:
+				d = 10
+			case ch < '0' || ch > '9':
+				return "", errISBNDigits
+			}
+			sum += d * (10 - i)
+		}
+		if sum%11 != 0 {
+			return "", errors.New("ISBN-10 check digit does not match")
+		}
+		return isbn13("978" + s[:9]), nil
+	case 13:
+		for _, ch := range s {
+			if ch < '0' || ch > '9' {
+				return "", errISBNDigits
+			}
+		}
+		if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+			return "", errors.New("ISBN-13 must start with 978 or 979")
+		}
+		if isbn13(s[:12]) != s {
+			return "", errors.New("ISBN-13 check digit does not match")
+		}
+		return s, nil
+	}
+	return "", errISBNDigits
+}
+
+// isbn13 appends the ISBN-13 check digit to twelve digits.
+func isbn13(digits string) string {
+	sum := 0
+	for i, ch := range digits {
+		w := 1
+		if i%2 == 1 {
+			w = 3
+		}
+		sum += int(ch-'0') * w
+	}
+	return digits + strconv.Itoa((10-sum%10)%10)
+}
+
+// checkYear allows unknown (0) and anything from the first printed books to
+// next year, for titles announced ahead of publication.
+func checkYear(y int) bool {
+	return y == 0 || (y >= 1450 && y <= time.Now().Year()+1)
+}
+
+// cleanSubjects trims subject headings and drops empty and repeated ones.
+func cleanSubjects(in []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, s := range in {
+		s = strings.Join(strings.Fields(s), " ")
+		if s == "" || seen[strings.ToLower(s)] {
+			continue
+		}
+		seen[strings.ToLower(s)] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// isbnTaken reports whether another book already has isbn.
+func isbnTaken(isbn, bookID string) (bool, error) {
+	if isbn == "" {
+		return false, nil
+	}
+	b, err := store.Books().ByISBN(isbn)
+	if err != nil {
+		return false, err
+	}
+	return b != nil && b.ID != bookID, nil
+}
+
+// authorBooks groups books by the authors they credit.
+func authorBooks() (map[string][]Book, error) {
+	books, err := store.Books().All()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]Book{}
+	for _, b := range books {
+		seen := map[string]bool{}
+		for _, c := range b.Contributors {
+			if !seen[c.AuthorID] {
+				seen[c.AuthorID] = true
+				out[c.AuthorID] = append(out[c.AuthorID], b)
+			}
+		}
+	}
+	return out, nil
+}
+
+// apiGetAuthors lists authors by name with how many books credit them;
+// ?q= keeps those whose name contains it.
+func apiGetAuthors(w http.ResponseWriter, r *http.Request) {
+	q := foldText(strings.TrimSpace(r.URL.Query().Get("q")))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	authors, err := store.Authors().All()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	byAuthor, err := authorBooks()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	sort.SliceStable(authors, func(i, j int) bool { return foldText(authors[i].Name) < foldText(authors[j].Name) })
+	out := []any{}
+	for _, a := range authors {
+		if q != "" && !strings.Contains(foldText(a.Name), q) {
+			continue
+		}
+		out = append(out, map[string]any{"id": a.ID, "name": a.Name, "createdAt": a.CreatedAt, "bookCount": len(byAuthor[a.ID])})
+	}
+	jsonWrite(w, 200, out)
+}
+
+// apiGetAuthor returns an author with the books they are credited on and
+// their role in each.
+func apiGetAuthor(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/authors/")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	a, err := store.Authors().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if a == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Author not found"})
+		return
+	}
+	byAuthor, err := authorBooks()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	books := []any{}
+	for _, b := range byAuthor[id] {
+		var roles []string
+		for _, c := range b.Contributors {
+			if c.AuthorID == id {
+				roles = append(roles, c.Role)
+			}
+		}
+		books = append(books, map[string]any{"book": b, "roles": roles})
+	}
+	jsonWrite(w, 200, map[string]any{"author": a, "books": books})
+}
+
+// apiRenameAuthor corrects an author's name on the record and on every book
+// crediting them.
+func apiRenameAuthor(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/authors/")
+	type Req struct {
+		Name string `json:"name"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	name := cleanName(req.Name)
+	if name == "" {
+		jsonWrite(w, 400, map[string]any{"error": "name is required"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	a, err := store.Authors().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if a == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Author not found"})
+		return
+	}
+	other, err := store.Authors().ByName(name)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if other != nil && other.ID != id {
+		jsonWrite(w, 409, map[string]any{"error": "Another author already has that name", "authorId": other.ID})
+		return
+	}
+	byAuthor, err := authorBooks()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	before := *a
+	a.Name = name
+	books := byAuthor[id]
+	err = store.Atomic(func() error {
+		if err := store.Authors().Update(*a); err != nil {
+			return err
+		}
+		if err := recordAudit(r, "author.rename", "author", a.ID, before, a); err != nil {
+			return err
+		}
+		for i := range books {
+			b := &books[i]
+			for j := range b.Contributors {
+				if b.Contributors[j].AuthorID == id {
+					b.Contributors[j].Name = name
+				}
+			}
+			b.Author = byline(b.Contributors)
+			if err := store.Books().Update(*b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	for _, b := range books {
+		catalog.put(b)
+	}
+	jsonWrite(w, 200, a)
+}
+
+func authorsHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/authors":
+		if !method(w, r, "GET") {
+			return
+		}
+		requireAuth(apiGetAuthors)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/authors/"):
+		switch r.Method {
+		case "GET":
+			requireAuth(apiGetAuthor)(w, r)
+		case "PATCH":
+			requirePermission(permBooksWrite, apiRenameAuthor)(w, r)
+		default:
+			jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
+		}
+	default:
+		jsonWrite(w, 404, map[string]any{"error": "Not found"})
+	}
+}
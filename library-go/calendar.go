@@ -0,0 +1,360 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpeningHours is the regular schedule for one day of the week. ID is the
+// weekday's lower-case English name.
+type OpeningHours struct {
+	ID     string `json:"id"`
+	Open   string `json:"open,omitempty"`
+	Close  string `json:"close,omitempty"`
+	Closed bool   `json:"closed"`
+}
+
+// ClosedDay is a date the library is shut regardless of the weekly schedule.
+// ID is the date itself ("2006-01-02").
+type ClosedDay struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+	// Source is "ics" for days loaded from a calendar file.
+	Source string `json:"source,omitempty"`
+}
+
+var weekdays = []time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday,
+}
+
+func weekdayID(d time.Weekday) string {
+	return strings.ToLower(d.String())
+}
+
+// defaultHours is the schedule for weekdays nobody has set: 09:00-18:00,
+// closed on Sundays.
+func defaultHours(d time.Weekday) OpeningHours {
+	if d == time.Sunday {
+		return OpeningHours{ID: weekdayID(d), Closed: true}
+	}
+	return OpeningHours{ID: weekdayID(d), Open: "09:00", Close: "18:00"}
+}
+
+// libCalendar answers "is the library open on this date" for the due-date
+// and fine logic. It is a snapshot; load a fresh one per request.
+type libCalendar struct {
+	hours  map[time.Weekday]OpeningHours
+	closed map[string]ClosedDay
+}
+
+// maxCalendarScan bounds how far nextOpen looks, so a calendar with every day
+// closed cannot loop forever.
+const maxCalendarScan = 366
+
+// loadCalendar reads the schedule and closed days. Callers must hold mu.
+func loadCalendar() (*libCalendar, error) {
+	c := &libCalendar{hours: map[time.Weekday]OpeningHours{}, closed: map[string]ClosedDay{}}
+	for _, d := range weekdays {
+		c.hours[d] = defaultHours(d)
+	}
+	hours, err := store.OpeningHours().All()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hours {
+		for _, d := range weekdays {
+			if weekdayID(d) == h.ID {
+				c.hours[d] = h
+			}
+		}
+	}
+	days, err := store.ClosedDays().All()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range days {
+		c.closed[d.ID] = d
+	}
+	return c, nil
+}
+
+func (c *libCalendar) isOpen(day time.Time) bool {
+	if c.hours[day.Weekday()].Closed {
+		return false
+	}
+	_, shut := c.closed[day.Format(dateLayout)]
+	return !shut
+}
+
+// nextOpen is day itself if the library opens then, else the first open day
+// after it.
+func (c *libCalendar) nextOpen(day time.Time) time.Time {
+	for i := 0; i < maxCalendarScan; i++ {
+		if c.isOpen(day) {
+			return day
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+// dueDate is days after from, moved on to the next open day.
+func (c *libCalendar) dueDate(from time.Time, days int) string {
+	return c.nextOpen(from.AddDate(0, 0, days)).Format(dateLayout)
+}
+
+// daysLate counts the open days after a loan's due date up to and including
+// day. Closed days cost the reader nothing. Loans whose due date cannot be
+// read are never late.
+func (c *libCalendar) daysLate(l Loan, day time.Time) int {
+	due, err := parseDate(l.DueDate)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for d := due.AddDate(0, 0, 1); !d.After(day); d = d.AddDate(0, 0, 1) {
+		if c.isOpen(d) {
+			n++
+		}
+	}
+	return n
+}
+
+var clockTime = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// apiGetCalendar returns the weekly schedule and the closed days, optionally
+// limited to ?from=&to=.
+func apiGetCalendar(w http.ResponseWriter, r *http.Request) {
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	c, err := loadCalendar()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	hours := []OpeningHours{}
+	for _, d := range weekdays {
+		hours = append(hours, c.hours[d])
+	}
+	days := []ClosedDay{}
+	for _, d := range c.closed {
+		if (from == "" || d.ID >= from) && (to == "" || d.ID <= to) {
+			days = append(days, d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].ID < days[j].ID })
+	jsonWrite(w, 200, map[string]any{"hours": hours, "closedDays": days})
+}
+
+func apiSetHours(w http.ResponseWriter, r *http.Request) {
+	id := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/calendar/hours/"))
+	var h OpeningHours
+	if err := jsonRead(r, &h); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	known := false
+	for _, d := range weekdays {
+		known = known || weekdayID(d) == id
+	}
+	if !known {
+		jsonWrite(w, 404, map[string]any{"error": "Unknown weekday"})
+		return
+	}
+	h.ID = id
+	if h.Closed {
+		h.Open, h.Close = "", ""
+	} else if !clockTime.MatchString(h.Open) || !clockTime.MatchString(h.Close) || h.Open >= h.Close {
+		jsonWrite(w, 400, map[string]any{"error": "open and close must be HH:MM with open before close"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	all, err := store.OpeningHours().All()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	var before *OpeningHours
+	for i := range all {
+		if all[i].ID == id {
+			before = &all[i]
+		}
+	}
+	err = store.Atomic(func() error {
+		if err := store.OpeningHours().Put(h); err != nil {
+			return err
+		}
+		return recordAudit(r, "hours.set", "openingHours", id, before, h)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, h)
+}
+
+func apiAddClosedDay(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Date   string `json:"date"`
+		Reason string `json:"reason"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	if _, err := parseDate(req.Date); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "date must be YYYY-MM-DD"})
+		return
+	}
+	d := ClosedDay{ID: req.Date, Reason: strings.TrimSpace(req.Reason)}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	before, err := store.ClosedDays().ByID(d.ID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	err = store.Atomic(func() error {
+		if err := store.ClosedDays().Put(d); err != nil {
+			return err
+		}
+		return recordAudit(r, "closedDay.put", "closedDay", d.ID, before, d)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, d)
+}
+
+// apiDeleteClosedDay reopens a date. Loans already due then keep their date.
+func apiDeleteClosedDay(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/calendar/closed/")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	d, err := store.ClosedDays().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if d == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Not a closed day"})
+		return
+	}
+	err = store.Atomic(func() error {
+		if err := store.ClosedDays().Delete(id); err != nil {
+			return err
+		}
+		return recordAudit(r, "closedDay.delete", "closedDay", id, d, nil)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true})
+}
+
+// maxICSBytes bounds an uploaded calendar file.
+const maxICSBytes = 1 << 20
+
+// apiImportICS marks every day covered by an event in an iCalendar file as
+// closed, using the event summary as the reason. Days already closed keep
+// their reason. Recurring events are reported, not expanded.
+func apiImportICS(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxICSBytes+1))
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Could not read body"})
+		return
+	}
+	if len(body) > maxICSBytes {
+		jsonWrite(w, 413, map[string]any{"error": "Calendar file too large"})
+		return
+	}
+	events, skipped, err := parseICS(string(body))
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	added, kept := 0, 0
+	err = store.Atomic(func() error {
+		for _, ev := range events {
+			for d := ev.Start; d.Before(ev.End); d = d.AddDate(0, 0, 1) {
+				id := d.Format(dateLayout)
+				old, err := store.ClosedDays().ByID(id)
+				if err != nil {
+					return err
+				}
+				if old != nil {
+					kept++
+					continue
+				}
+				day := ClosedDay{ID: id, Reason: ev.Summary, Source: "ics"}
+				if err := store.ClosedDays().Put(day); err != nil {
+					return err
+				}
+				if err := recordAudit(r, "closedDay.put", "closedDay", id, nil, day); err != nil {
+					return err
+				}
+				added++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"events": len(events), "added": added, "alreadyClosed": kept, "skipped": skipped})
+}
+
+// calendarHandler serves /api/calendar and its admin sub-paths.
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/calendar":
+		if !method(w, r, "GET") {
+			return
+		}
+		requireAuth(apiGetCalendar)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/calendar/hours/"):
+		if !method(w, r, "PUT") {
+			return
+		}
+		requirePermission(permCalendarWrite, apiSetHours)(w, r)
+	case r.URL.Path == "/api/calendar/closed":
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permCalendarWrite, apiAddClosedDay)(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/calendar/closed/"):
+		if !method(w, r, "DELETE") {
+			return
+		}
+		requirePermission(permCalendarWrite, apiDeleteClosedDay)(w, r)
+	case r.URL.Path == "/api/calendar/import":
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permCalendarWrite, apiImportICS)(w, r)
+	default:
+		jsonWrite(w, 404, map[string]any{"error": "Not found"})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// importRow is one catalog record read from an import file: the book as the
+// file describes it, its contributors (not yet linked to authors), or why it
+// cannot be imported.
+type importRow struct {
+	Book         Book
+	Contributors []Contributor
+	Skip         string
+}
+
+// importResult reports what happened, or would happen on a dry run, to one
+// record of the file.
+type importResult struct {
+	Record   int    `json:"record"`
+	Status   string `json:"status"` // created, updated or skipped
+	BookID   string `json:"bookId,omitempty"`
+	BookCode string `json:"bookCode,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// maxImportBytes bounds an uploaded catalog file.
+const maxImportBytes = 10 << 20
+
+// readImportBody reads an uploaded file, answering the client itself when it
+// cannot.
+func readImportBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxImportBytes+1))
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Could not read body"})
+		return nil, false
+	}
+	if len(body) > maxImportBytes {
+		jsonWrite(w, 413, map[string]any{"error": "Import file too large"})
+		return nil, false
+	}
+	return body, true
+}
+
+// importOptions reads ?dryRun=true and ?onDuplicate=skip|update.
+func importOptions(w http.ResponseWriter, r *http.Request) (dryRun, update, ok bool) {
+	qs := r.URL.Query()
+	switch qs.Get("onDuplicate") {
+	case "", "skip":
+	case "update":
+		update = true
+	default:
+		jsonWrite(w, 400, map[string]any{"error": "onDuplicate must be skip or update"})
+		return false, false, false
+	}
+	return qs.Get("dryRun") == "true", update, true
+}
+
+// importBooks adds the rows to the catalog, or only reports what it would do
+// when dryRun is set. A row is a duplicate when its ISBN or book code is
+// already in the catalog; duplicates are skipped, or with update have their
+// bibliographic fields replaced (book code, price, category and copies stay
+// as they are). New books start without copies. All writes are made
+// together, so a storage failure leaves the catalog untouched.
+func importBooks(w http.ResponseWriter, r *http.Request, rows []importRow, format string, dryRun, update bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	type pending struct {
+		book   Book
+		old    *Book
+		cs     []Contributor
+		create bool
+		result int
+	}
+	var todo []pending
+	results := []importResult{}
+	seenCode, seenISBN, seenBook := map[string]int{}, map[string]int{}, map[string]int{}
+
+	for i, row := range rows {
+		b := row.Book
+		res := importResult{Record: i + 1, BookCode: b.BookCode, Title: b.Title}
+		skip := func(why string) {
+			res.Status, res.Reason = "skipped", why
+			results = append(results, res)
+		}
+		if row.Skip != "" {
+			skip(row.Skip)
+			continue
+		}
+		if n, ok := seenCode[strings.ToLower(b.BookCode)]; ok {
+			skip(fmt.Sprintf("same book code as record %d", n))
+			continue
+		}
+		if n, ok := seenISBN[b.ISBN]; ok && b.ISBN != "" {
+			skip(fmt.Sprintf("same ISBN as record %d", n))
+			continue
+		}
+
+		existing, err := store.Books().ByCode(b.BookCode)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		via := "book code"
+		if b.ISBN != "" {
+			byISBN, err := store.Books().ByISBN(b.ISBN)
+			if err != nil {
+				storeError(w, err)
+				return
+			}
+			if byISBN != nil && existing != nil && byISBN.ID != existing.ID {
+				skip(fmt.Sprintf("ISBN matches %s but book code matches %s", byISBN.ID, existing.ID))
+				continue
+			}
+			if byISBN != nil {
+				existing, via = byISBN, "ISBN"
+			}
+		}
+		cs, msg, err := checkContributors(row.Contributors)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if msg != "" {
+			skip(msg)
+			continue
+		}
+
+		if existing != nil {
+			res.BookID, res.BookCode = existing.ID, existing.BookCode
+			if n, ok := seenBook[existing.ID]; ok {
+				skip(fmt.Sprintf("matches the same book as record %d", n))
+				continue
+			}
+			if !update {
+				skip(fmt.Sprintf("duplicate of %s by %s", existing.ID, via))
+				continue
+			}
+			u := *existing
+			u.Title, u.ISBN, u.Publisher, u.Year = b.Title, b.ISBN, b.Publisher, b.Year
+			u.Language, u.Edition, u.Subjects = b.Language, b.Edition, b.Subjects
+			todo = append(todo, pending{book: u, old: existing, cs: cs, result: len(results)})
+			res.Status = "updated"
+			seenBook[existing.ID] = i + 1
+		} else {
+			if b.Category == "" {
+				b.Category = bookStandard
+			}
+			b.CreatedAt = nowDate()
+			todo = append(todo, pending{book: b, cs: cs, create: true, result: len(results)})
+			res.Status = "created"
+		}
+		seenCode[strings.ToLower(b.BookCode)] = i + 1
+		if b.ISBN != "" {
+			seenISBN[b.ISBN] = i + 1
+		}
+		results = append(results, res)
+	}
+
+	if !dryRun && len(todo) > 0 {
+		err := store.Atomic(func() error {
+			for i := range todo {
+				p := &todo[i]
+				if err := linkAuthors(p.cs); err != nil {
+					return err
+				}
+				p.book.Contributors = p.cs
+				p.book.Author = byline(p.cs)
+				if !p.create {
+					if err := store.Books().Update(p.book); err != nil {
+						return err
+					}
+					if err := recordAudit(r, "book.import", "book", p.book.ID, p.old, p.book); err != nil {
+						return err
+					}
+					continue
+				}
+				id, err := newID("book")
+				if err != nil {
+					return err
+				}
+				p.book.ID = id
+				if err := store.Books().Create(p.book); err != nil {
+					return err
+				}
+				if err := recordAudit(r, "book.import", "book", p.book.ID, nil, p.book); err != nil {
+					return err
+				}
+				results[p.result].BookID = p.book.ID
+			}
+			return nil
+		})
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		for _, p := range todo {
+			catalog.put(p.book)
+		}
+	}
+
+	counts := map[string]int{}
+	for _, res := range results {
+		counts[res.Status]++
+	}
+	jsonWrite(w, 200, map[string]any{
+		"format":  format,
+		"dryRun":  dryRun,
+		"created": counts["created"],
+		"updated": counts["updated"],
+		"skipped": counts["skipped"],
+		"records": results,
+	})
+}
+
+// apiImportMARC loads catalog records from an ISO 2709 or MARCXML file sent
+// as the request body. See importBooks for ?dryRun and ?onDuplicate.
+func apiImportMARC(w http.ResponseWriter, r *http.Request) {
+	dryRun, update, ok := importOptions(w, r)
+	if !ok {
+		return
+	}
+	body, ok := readImportBody(w, r)
+	if !ok {
+		return
+	}
+	entries, format, err := readMARC(body)
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+	rows := make([]importRow, 0, len(entries))
+	for _, e := range entries {
+		if e.Err != nil {
+			rows = append(rows, importRow{Skip: e.Err.Error()})
+			continue
+		}
+		b, cs, why := bookFromMARC(e.Record)
+		rows = append(rows, importRow{Book: b, Contributors: cs, Skip: why})
+	}
+	importBooks(w, r, rows, format, dryRun, update)
+}
+
+// apiExportMARC writes the whole catalog as MARCXML (the default) or, with
+// ?format=iso2709, as binary MARC 21.
+func apiExportMARC(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "marcxml"
+	}
+	if format != "marcxml" && format != "iso2709" {
+		jsonWrite(w, 400, map[string]any{"error": "format must be marcxml or iso2709"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	books, err := store.Books().All()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	recs := make([]marcRecord, 0, len(books))
+	for _, b := range books {
+		recs = append(recs, marcFromBook(b))
+	}
+	if format == "iso2709" {
+		w.Header().Set("Content-Type", "application/marc")
+		w.Header().Set("Content-Disposition", `attachment; filename="catalog.mrc"`)
+		err = writeISO2709(w, recs)
+	} else {
+		w.Header().Set("Content-Type", "application/marcxml+xml")
+		w.Header().Set("Content-Disposition", `attachment; filename="catalog.xml"`)
+		err = writeMARCXML(w, recs)
+	}
+	if err != nil {
+		// The status line is gone by now; all we can do is log it.
+		log.Printf("marc export: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// Clock is where loan, hold and fine logic read the current time, so the
+// overdue engine can be driven by a fake clock instead of waiting for days to
+// pass. Auth (tokens, sessions, lockouts) keeps using the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+var clock Clock = systemClock{}
+
+const dateLayout = "2006-01-02"
+
+// parseDate reads a "2006-01-02" date as midnight UTC, so subtracting two of
+// them always gives whole days.
+func parseDate(s string) (time.Time, error) {
+	return time.Parse(dateLayout, s)
+}
+
+// today is the clock's current date, in the same form parseDate returns.
+func today() time.Time {
+	t, _ := parseDate(nowDate())
+	return t
+}
+
+func daysBetween(from, to time.Time) int {
+	return int(to.Sub(from).Hours() / 24)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Copy is one physical item of a Book. Loans point at the copy that went out,
+// and a book's TotalQty/AvailableQty are only ever derived from its copies
+// (see syncBookCounts).
+type Copy struct {
+	ID         string `json:"id"`
+	BookID     string `json:"bookId"`
+	Barcode    string `json:"barcode"`
+	Condition  string `json:"condition"`
+	Location   string `json:"location"`
+	AcquiredAt string `json:"acquiredAt"`
+	Status     string `json:"status"`
+
+	WithdrawnAt    string `json:"withdrawnAt,omitempty"`
+	WithdrawReason string `json:"withdrawReason,omitempty"`
+}
+
+const (
+	copyAvailable = "available"
+	copyOnLoan    = "on_loan"
+	copyOnHold    = "on_hold" // set aside for a reader's hold (holds.go)
+	copyLost      = "lost"
+	copyWithdrawn = "withdrawn"
+)
+
+var copyConditions = []string{"new", "good", "fair", "poor", "damaged"}
+
+func validCondition(c string) bool {
+	for _, x := range copyConditions {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// syncBookCounts recomputes TotalQty (copies still in the collection) and
+// AvailableQty (copies on the shelf) for a book and stores them. Callers must
+// hold mu and should run it in the same Atomic block as the copy change.
+func syncBookCounts(bookID string) (*Book, error) {
+	book, err := store.Books().ByID(bookID)
+	if err != nil || book == nil {
+		return book, err
+	}
+	copies, err := store.Copies().ByBook(bookID)
+	if err != nil {
+		return nil, err
+	}
+	book.TotalQty, book.AvailableQty = 0, 0
+	for _, c := range copies {
+		switch c.Status {
+		case copyAvailable:
+			book.AvailableQty++
+			book.TotalQty++
+		case copyOnLoan, copyOnHold:
+			book.TotalQty++
+		}
+	}
+	return book, store.Books().Update(*book)
+}
+
+// nextBarcode makes a "<bookCode>-NNN" barcode that is not taken yet.
+func nextBarcode(book *Book) (string, error) {
+	copies, err := store.Copies().ByBook(book.ID)
+	if err != nil {
+		return "", err
+	}
+	for i := len(copies) + 1; ; i++ {
+		code := fmt.Sprintf("%s-%03d", book.BookCode, i)
+		c, err := store.Copies().ByBarcode(code)
+		if err != nil {
+			return "", err
+		}
+		if c == nil {
+			return code, nil
+		}
+	}
+}
+
+// addCopy shelves a new copy of book; an empty barcode gets a generated one.
+// Callers must hold mu and sync the book's counts afterwards.
+func addCopy(book *Book, c Copy) (Copy, error) {
+	if c.Barcode == "" {
+		code, err := nextBarcode(book)
+		if err != nil {
+			return c, err
+		}
+		c.Barcode = code
+	}
+	id, err := newID("copy")
+	if err != nil {
+		return c, err
+	}
+	c.ID = id
+	c.BookID = book.ID
+	c.Status = copyAvailable
+	if c.Condition == "" {
+		c.Condition = "good"
+	}
+	if c.AcquiredAt == "" {
+		c.AcquiredAt = nowDate()
+	}
+	return c, store.Copies().Create(c)
+}
+
+// copyForLoan resolves the copy a borrow request names: a barcode picks that
+// exact copy, a bare bookId takes the copy held for this reader or else any
+// copy on the shelf. A held copy only goes to the reader it is held for; the
+// hold returned alongside it is the one the loan fulfils.
+func copyForLoan(readerID, barcode, bookID string) (*Copy, *Hold, string, error) {
+	var c *Copy
+	if barcode != "" {
+		var err error
+		c, err = store.Copies().ByBarcode(barcode)
+		if err != nil || c == nil {
+			return nil, nil, "Copy not found", err
+		}
+		if bookID != "" && c.BookID != bookID {
+			return nil, nil, "Copy belongs to another book", nil
+		}
+	} else {
+		holds, err := store.Holds().ByReader(readerID)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		for _, h := range holds {
+			if h.Status == holdReady && h.BookID == bookID {
+				c, err = store.Copies().ByID(h.CopyID)
+				if err != nil || c != nil {
+					return c, &h, "", err
+				}
+			}
+		}
+		copies, err := store.Copies().ByBook(bookID)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		for _, x := range copies {
+			if x.Status == copyAvailable {
+				return &x, nil, "", nil
+			}
+		}
+		return nil, nil, "Book out of stock; place a hold to join the queue", nil
+	}
+
+	switch c.Status {
+	case copyAvailable:
+		return c, nil, "", nil
+	case copyOnHold:
+		h, err := holdForCopy(c)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if h != nil && h.ReaderID == readerID {
+			return c, h, "", nil
+		}
+		return nil, nil, "Copy is held for another reader", nil
+	}
+	return nil, nil, "Copy is not available (" + c.Status + ")", nil
+}
+
+// activeLoanForCopy finds the borrowed loan a copy is out on, if any.
+func activeLoanForCopy(copyID string) (*Loan, error) {
+	loans, err := store.Loans().ByCopy(copyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range loans {
+		if l.active() {
+			return &l, nil
+		}
+	}
+	return nil, nil
+}
+
+// findActiveLoan resolves a return or lost report either by loan id or by the
+// barcode of the copy that is out.
+func findActiveLoan(loanID, barcode string) (*Loan, error) {
+	if loanID != "" {
+		return store.Loans().ByID(loanID)
+	}
+	c, err := store.Copies().ByBarcode(barcode)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return activeLoanForCopy(c.ID)
+}
+
+// markCopyLost records that the copy of a loan is gone. Callers must hold mu.
+func markCopyLost(copyID string) error {
+	c, err := store.Copies().ByID(copyID)
+	if err != nil || c == nil {
+		return err
+	}
+	c.Status = copyLost
+	return store.Copies().Update(*c)
+}
+
+func apiListCopies(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/books/"), "/copies")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	book, err := store.Books().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if book == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+		return
+	}
+	copies, err := store.Copies().ByBook(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, copies)
+}
+
+func apiAddCopy(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/books/"), "/copies")
+	type Req struct {
+		Barcode    string `json:"barcode"`
+		Condition  string `json:"condition"`
+		Location   string `json:"location"`
+		AcquiredAt string `json:"acquiredAt"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	req.Barcode = strings.TrimSpace(req.Barcode)
+	if req.Condition != "" && !validCondition(req.Condition) {
+		jsonWrite(w, 400, map[string]any{"error": "Unknown condition"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	book, err := store.Books().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if book == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+		return
+	}
+	if req.Barcode != "" {
+		existing, err := store.Copies().ByBarcode(req.Barcode)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if existing != nil {
+			jsonWrite(w, 409, map[string]any{"error": "barcode already exists"})
+			return
+		}
+	}
+
+	var c Copy
+	var ready *Hold
+	err = store.Atomic(func() error {
+		var err error
+		c, err = addCopy(book, Copy{
+			Barcode:    req.Barcode,
+			Condition:  req.Condition,
+			Location:   req.Location,
+			AcquiredAt: req.AcquiredAt,
+		})
+		if err != nil {
+			return err
+		}
+		// A new copy serves the hold queue before it reaches the shelf.
+		if ready, err = promoteHold(&c); err != nil {
+			return err
+		}
+		if _, err = syncBookCounts(book.ID); err != nil {
+			return err
+		}
+		return recordAudit(r, "copy.create", "copy", c.ID, nil, c)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if ready != nil {
+		notifyHoldsReady(*ready)
+	}
+	jsonWrite(w, 200, c)
+}
+
+func apiCopyByBarcode(w http.ResponseWriter, r *http.Request) {
+	barcode := strings.TrimSpace(r.URL.Query().Get("barcode"))
+	if barcode == "" {
+		jsonWrite(w, 400, map[string]any{"error": "Missing barcode"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	c, err := store.Copies().ByBarcode(barcode)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if c == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Copy not found"})
+		return
+	}
+	book, err := store.Books().ByID(c.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"copy": c, "book": book})
+}
+
+func apiUpdateCopy(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/copies/")
+	type Req struct {
+		Condition *string `json:"condition"`
+		Location  *string `json:"location"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	if req.Condition != nil && !validCondition(*req.Condition) {
+		jsonWrite(w, 400, map[string]any{"error": "Unknown condition"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	c, err := store.Copies().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if c == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Copy not found"})
+		return
+	}
+	before := *c
+	if req.Condition != nil {
+		c.Condition = *req.Condition
+	}
+	if req.Location != nil {
+		c.Location = *req.Location
+	}
+	err = store.Atomic(func() error {
+		if err := store.Copies().Update(*c); err != nil {
+			return err
+		}
+		return recordAudit(r, "copy.update", "copy", c.ID, before, c)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, c)
+}
+
+// apiWithdrawCopy takes a copy out of the collection (worn out, discarded,
+// donated). It stays on record for loan history but no longer counts.
+func apiWithdrawCopy(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/copies/"), "/withdraw")
+	type Req struct {
+		Reason string `json:"reason"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	c, err := store.Copies().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if c == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Copy not found"})
+		return
+	}
+	if c.Status != copyAvailable {
+		jsonWrite(w, 400, map[string]any{"error": "Only copies on the shelf can be withdrawn (this one is " + c.Status + ")"})
+		return
+	}
+
+	before := *c
+	c.Status = copyWithdrawn
+	c.WithdrawnAt = nowDate()
+	c.WithdrawReason = strings.TrimSpace(req.Reason)
+	err = store.Atomic(func() error {
+		if err := store.Copies().Update(*c); err != nil {
+			return err
+		}
+		if _, err := syncBookCounts(c.BookID); err != nil {
+			return err
+		}
+		return recordAudit(r, "copy.withdraw", "copy", c.ID, before, c)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, c)
+}
+
+// copiesHandler serves /api/copies?barcode= and the per-copy actions under
+// /api/copies/{id}.
+func copiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/copies" {
+		if !method(w, r, "GET") {
+			return
+		}
+		requireAuth(apiCopyByBarcode)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/withdraw") {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permBooksWrite, apiWithdrawCopy)(w, r)
+		return
+	}
+	if !method(w, r, "PATCH") {
+		return
+	}
+	requirePermission(permBooksWrite, apiUpdateCopy)(w, r)
+}
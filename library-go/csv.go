@@ -0,0 +1,703 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxCSVBytes bounds an uploaded CSV file and maxCSVRows the rows taken from
+// it. Rows are read and checked one at a time straight off the request body,
+// so only the parsed rows are held in memory, never the raw upload.
+const (
+	maxCSVBytes = 50 << 20
+	maxCSVRows  = 100000
+)
+
+// csvKind describes one kind of record the CSV endpoints exchange. columns
+// is the export header; an import may use any of them, plus importOnly, in
+// any order. parse checks a row without mu held; prepare, when set, then
+// does the slow work for it (password hashing), also without mu, but only
+// once every row has been checked and only for rows that can still be
+// imported. apply writes a row with mu held, inside store.Atomic, and
+// records it in the audit log. All three return a message for rows that
+// cannot be imported. records reads an export with mu held; the rows it
+// returns are written once mu is released, so a slow download does not
+// hold up other requests.
+type csvKind[T any] struct {
+	columns    []string
+	importOnly []string
+	required   []string
+	parse      func(row csvRow) (T, string)
+	prepare    func(v T) (T, string)
+	apply      func(r *http.Request, v T) (string, error)
+	records    func() (csvRows, error)
+	// imported, when set, runs once after rows were committed.
+	imported func()
+}
+
+// csvRows writes records out one row at a time through emit, stopping at the
+// first error emit returns.
+type csvRows func(emit func(rec []string) error) error
+
+// csvRow is one data row keyed by column name; missing columns read as "".
+type csvRow map[string]string
+
+type csvRowError struct {
+	Row   int    `json:"row"`
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+var errCSVRejected = errors.New("csv rows rejected")
+
+// csvFormulaStart are the first characters that make a spreadsheet read a
+// cell as a formula (tab and carriage return are skipped by some before
+// they look).
+const csvFormulaStart = "=+-@\t\r"
+
+// csvSafe prefixes a cell that a spreadsheet would read as a formula with
+// ', which shows the text as typed. csvUnsafe undoes it on import, so an
+// export can be imported again unchanged.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaStart, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func csvUnsafe(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(csvFormulaStart, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// splitList reads a "; "-separated cell.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// importCSV reads a CSV upload whose first row names its columns.
+// ?mode=all (the default) imports every row or, if any row is bad, none of
+// them; ?mode=best-effort imports the good rows and reports the rest.
+func importCSV[T any](w http.ResponseWriter, r *http.Request, k csvKind[T]) {
+	all := true
+	switch r.URL.Query().Get("mode") {
+	case "", "all":
+	case "best-effort":
+		all = false
+	default:
+		jsonWrite(w, 400, map[string]any{"error": "mode must be all or best-effort"})
+		return
+	}
+
+	cr := csv.NewReader(http.MaxBytesReader(w, r.Body, maxCSVBytes))
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Could not read the CSV header: " + err.Error()})
+		return
+	}
+	known := append(append([]string{}, k.columns...), k.importOnly...)
+	cols := make([]string, len(header))
+	for i, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		for _, c := range known {
+			if strings.EqualFold(h, c) {
+				cols[i] = c
+			}
+		}
+		if cols[i] == "" {
+			jsonWrite(w, 400, map[string]any{"error": "Unknown column " + h, "columns": known})
+			return
+		}
+	}
+	for _, req := range k.required {
+		if !slices.Contains(cols, req) {
+			jsonWrite(w, 400, map[string]any{"error": "Missing column " + req})
+			return
+		}
+	}
+
+	type parsed struct {
+		row, line int
+		v         T
+		msg       string
+	}
+	var rows []parsed
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			jsonWrite(w, 413, map[string]any{"error": "CSV file too large"})
+			return
+		case err != nil && !errors.Is(err, csv.ErrFieldCount):
+			jsonWrite(w, 400, map[string]any{"error": err.Error()})
+			return
+		}
+		line, _ := cr.FieldPos(0)
+		p := parsed{row: len(rows) + 1, line: line}
+		if err != nil {
+			p.msg = fmt.Sprintf("expected %d fields, got %d", len(cols), len(rec))
+		} else {
+			row := csvRow{}
+			for i, v := range rec {
+				row[cols[i]] = csvUnsafe(strings.TrimSpace(v))
+			}
+			p.v, p.msg = k.parse(row)
+		}
+		rows = append(rows, p)
+		if len(rows) > maxCSVRows {
+			jsonWrite(w, 413, map[string]any{"error": fmt.Sprintf("CSV files are limited to %d rows", maxCSVRows)})
+			return
+		}
+	}
+	if len(rows) == 0 {
+		jsonWrite(w, 400, map[string]any{"error": "CSV file has no rows"})
+		return
+	}
+	// In mode=all one bad row means nothing is imported, so the slow work
+	// would be thrown away.
+	bad := slices.ContainsFunc(rows, func(p parsed) bool { return p.msg != "" })
+	if k.prepare != nil && !(all && bad) {
+		for i, p := range rows {
+			if p.msg == "" {
+				rows[i].v, rows[i].msg = k.prepare(p.v)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	errs := []csvRowError{}
+	fail := func(p parsed, msg string) {
+		errs = append(errs, csvRowError{Row: p.row, Line: p.line, Error: msg})
+	}
+	imported := 0
+	if all {
+		for _, p := range rows {
+			if p.msg != "" {
+				fail(p, p.msg)
+			}
+		}
+		if len(errs) == 0 {
+			// Later rows may depend on earlier ones (a reader imported
+			// above their loans), so every row is applied in the one
+			// transaction and it is rolled back if any was refused.
+			err := store.Atomic(func() error {
+				for _, p := range rows {
+					msg, err := k.apply(r, p.v)
+					if err != nil {
+						return err
+					}
+					if msg != "" {
+						fail(p, msg)
+					}
+				}
+				if len(errs) > 0 {
+					return errCSVRejected
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errCSVRejected) {
+				storeError(w, err)
+				return
+			}
+			if err == nil {
+				imported = len(rows)
+			}
+		}
+	} else {
+		for _, p := range rows {
+			if p.msg != "" {
+				fail(p, p.msg)
+				continue
+			}
+			var msg string
+			err := store.Atomic(func() error {
+				var err error
+				if msg, err = k.apply(r, p.v); err == nil && msg != "" {
+					err = errCSVRejected
+				}
+				return err
+			})
+			switch {
+			case errors.Is(err, errCSVRejected):
+				fail(p, msg)
+			case err != nil:
+				storeError(w, err)
+				return
+			default:
+				imported++
+			}
+		}
+	}
+	if imported > 0 && k.imported != nil {
+		k.imported()
+	}
+
+	mode := "all"
+	if !all {
+		mode = "best-effort"
+	}
+	if all && len(errs) > 0 {
+		jsonWrite(w, 400, map[string]any{
+			"error":    fmt.Sprintf("%d of %d rows have errors; nothing was imported", len(errs), len(rows)),
+			"mode":     mode,
+			"rows":     len(rows),
+			"imported": 0,
+			"errors":   errs,
+		})
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"mode": mode, "rows": len(rows), "imported": imported, "failed": len(errs), "errors": errs})
+}
+
+func exportCSV[T any](w http.ResponseWriter, name string, k csvKind[T]) {
+	mu.Lock()
+	rows, err := k.records()
+	mu.Unlock()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	cw := csv.NewWriter(w)
+	_ = cw.Write(k.columns)
+	err = rows(func(rec []string) error {
+		for i, cell := range rec {
+			rec[i] = csvSafe(cell)
+		}
+		return cw.Write(rec)
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		log.Printf("csv export %s: %v", name, err)
+	}
+}
+
+type bookCSVRow struct {
+	book     Book
+	cs       []Contributor
+	copies   int
+	location string
+}
+
+// bookCSV adds books with their copies. Contributors come in three columns
+// of "; "-separated names, one per role.
+var bookCSV = csvKind[bookCSVRow]{
+	columns: []string{"id", "bookCode", "title", "authors", "translators", "editors", "isbn", "publisher", "year",
+		"language", "edition", "subjects", "category", "price", "copies"},
+	importOnly: []string{"location"},
+	required:   []string{"bookCode", "title"},
+	parse: func(row csvRow) (bookCSVRow, string) {
+		b := Book{
+			BookCode:  row["bookCode"],
+			Title:     row["title"],
+			Publisher: row["publisher"],
+			Language:  row["language"],
+			Edition:   row["edition"],
+			Subjects:  cleanSubjects(splitList(row["subjects"])),
+			Category:  row["category"],
+		}
+		if b.BookCode == "" || b.Title == "" {
+			return bookCSVRow{}, "bookCode and title are required"
+		}
+		var cs []Contributor
+		for role, col := range map[string]string{roleAuthor: "authors", roleTranslator: "translators", roleEditor: "editors"} {
+			for _, name := range splitList(row[col]) {
+				cs = append(cs, Contributor{Name: name, Role: role})
+			}
+		}
+		if row["isbn"] != "" {
+			isbn, err := normalizeISBN(row["isbn"])
+			if err != nil {
+				return bookCSVRow{}, err.Error()
+			}
+			b.ISBN = isbn
+		}
+		if row["year"] != "" {
+			y, err := strconv.Atoi(row["year"])
+			if err != nil || !checkYear(y) {
+				return bookCSVRow{}, "year must be between 1450 and next year"
+			}
+			b.Year = y
+		}
+		if b.Category == "" {
+			b.Category = bookStandard
+		}
+		if !validCategory(bookCategories, b.Category) {
+			return bookCSVRow{}, "Unknown category " + b.Category
+		}
+		if row["price"] != "" {
+			p, err := parseMoney(row["price"])
+			if err != nil || p < 0 {
+				return bookCSVRow{}, "price must be a non-negative amount"
+			}
+			b.Price = p
+		}
+		copies := 0
+		if row["copies"] != "" {
+			n, err := strconv.Atoi(row["copies"])
+			if err != nil || n < 0 {
+				return bookCSVRow{}, "copies must be a non-negative number"
+			}
+			copies = n
+		}
+		return bookCSVRow{book: b, cs: cs, copies: copies, location: row["location"]}, ""
+	},
+	apply: func(r *http.Request, v bookCSVRow) (string, error) {
+		existing, err := store.Books().ByCode(v.book.BookCode)
+		if err != nil {
+			return "", err
+		}
+		if existing != nil {
+			return "bookCode already exists", nil
+		}
+		taken, err := isbnTaken(v.book.ISBN, "")
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			return "isbn already exists", nil
+		}
+		cs, msg, err := checkContributors(v.cs)
+		if err != nil || msg != "" {
+			return msg, err
+		}
+		if err := linkAuthors(cs); err != nil {
+			return "", err
+		}
+		id, err := newID("book")
+		if err != nil {
+			return "", err
+		}
+		book := v.book
+		book.ID = id
+		book.Contributors, book.Author = cs, byline(cs)
+		book.CreatedAt = nowDate()
+		if err := store.Books().Create(book); err != nil {
+			return "", err
+		}
+		for i := 0; i < v.copies; i++ {
+			if _, err := addCopy(&book, Copy{Location: v.location}); err != nil {
+				return "", err
+			}
+		}
+		b, err := syncBookCounts(book.ID)
+		if err != nil {
+			return "", err
+		}
+		return "", recordAudit(r, "book.import", "book", b.ID, nil, b)
+	},
+	records: func() (csvRows, error) {
+		books, err := store.Books().All()
+		if err != nil {
+			return nil, err
+		}
+		return func(emit func([]string) error) error {
+			for _, b := range books {
+				names := map[string][]string{}
+				for _, c := range b.Contributors {
+					names[c.Role] = append(names[c.Role], c.Name)
+				}
+				year := ""
+				if b.Year != 0 {
+					year = strconv.Itoa(b.Year)
+				}
+				err := emit([]string{b.ID, b.BookCode, b.Title,
+					strings.Join(names[roleAuthor], "; "), strings.Join(names[roleTranslator], "; "), strings.Join(names[roleEditor], "; "),
+					b.ISBN, b.Publisher, year, b.Language, b.Edition, strings.Join(b.Subjects, "; "),
+					bookCategoryOf(&b), b.Price.String(), strconv.Itoa(b.TotalQty)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	},
+	imported: func() {
+		if err := rebuildCatalog(); err != nil {
+			log.Printf("index catalog: %v", err)
+		}
+	},
+}
+
+type userCSVRow struct {
+	user     User
+	password string // until prepare hashes it
+}
+
+// userCSV adds accounts. password is optional: an account imported without
+// one cannot log in until staff send it a reset (POST
+// /api/users/{id}/reset-password). Exports never carry password hashes or
+// reset tokens.
+var userCSV = csvKind[userCSVRow]{
+	columns:    []string{"id", "fullName", "email", "phone", "role", "category", "createdAt"},
+	importOnly: []string{"password"},
+	required:   []string{"fullName", "email", "phone"},
+	parse: func(row csvRow) (userCSVRow, string) {
+		u := User{
+			FullName: row["fullName"],
+			Email:    strings.ToLower(row["email"]),
+			Phone:    row["phone"],
+			Role:     strings.ToLower(row["role"]),
+			Category: row["category"],
+		}
+		if u.FullName == "" || u.Email == "" || u.Phone == "" {
+			return userCSVRow{}, "fullName, email and phone are required"
+		}
+		if u.Role == "" {
+			u.Role = "reader"
+		}
+		if !validRole(u.Role) {
+			return userCSVRow{}, "Unknown role " + u.Role
+		}
+		if u.Category == "" {
+			u.Category = readerStudent
+		}
+		if !validCategory(readerCategories, u.Category) {
+			return userCSVRow{}, "Unknown category " + u.Category
+		}
+		pw := row["password"]
+		if pw != "" {
+			if errs := checkPassword(pw, u.Email); len(errs) > 0 {
+				return userCSVRow{}, "Password does not meet the policy: " + errs[0].Message
+			}
+		}
+		return userCSVRow{user: u, password: pw}, ""
+	},
+	prepare: func(v userCSVRow) (userCSVRow, string) {
+		if v.password == "" {
+			return v, ""
+		}
+		hash, err := hashPassword(v.password)
+		if err != nil {
+			return v, "Could not hash the password"
+		}
+		v.user.PasswordHash, v.password = hash, ""
+		return v, ""
+	},
+	apply: func(r *http.Request, v userCSVRow) (string, error) {
+		u := v.user
+		existing, err := store.Users().ByEmail(u.Email)
+		if err != nil {
+			return "", err
+		}
+		if existing != nil {
+			return "Email already exists", nil
+		}
+		id, err := newID("user")
+		if err != nil {
+			return "", err
+		}
+		u.ID = id
+		u.CreatedAt = nowDate()
+		if err := store.Users().Create(u); err != nil {
+			return "", err
+		}
+		return "", recordAudit(r, "user.import", "user", u.ID, nil, u)
+	},
+	records: func() (csvRows, error) {
+		users, err := store.Users().All()
+		if err != nil {
+			return nil, err
+		}
+		return func(emit func([]string) error) error {
+			for _, u := range users {
+				if err := emit([]string{u.ID, u.FullName, u.Email, u.Phone, u.Role, readerCategoryOf(&u), u.CreatedAt}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	},
+}
+
+type loanCSVRow struct {
+	readerID, readerEmail, barcode string
+	loanDate, dueDate, returnDate  string
+}
+
+// loanCSV records loans carried over from another system: open ones take
+// their copy off the shelf, ones with a returnDate are history only. The
+// reader is found by readerId or readerEmail and the copy by barcode; the
+// other exported columns are ignored. Lending limits, holds and fines are
+// not checked, and no fines are charged; an open loan without a dueDate
+// gets the one its lending terms give.
+var loanCSV = csvKind[loanCSVRow]{
+	columns: []string{"id", "readerId", "readerName", "readerEmail", "readerPhone", "bookId", "bookCode", "bookTitle",
+		"bookAuthor", "barcode", "loanDate", "dueDate", "returnDate", "status", "fineAmount", "renewals"},
+	required: []string{"barcode"},
+	parse: func(row csvRow) (loanCSVRow, string) {
+		l := loanCSVRow{
+			readerID: row["readerId"], readerEmail: strings.ToLower(row["readerEmail"]), barcode: row["barcode"],
+			loanDate: row["loanDate"], dueDate: row["dueDate"], returnDate: row["returnDate"],
+		}
+		if l.readerID == "" && l.readerEmail == "" {
+			return l, "readerId or readerEmail is required"
+		}
+		if l.barcode == "" {
+			return l, "barcode is required"
+		}
+		if l.loanDate == "" {
+			l.loanDate = nowDate()
+		}
+		for _, d := range []string{l.loanDate, l.dueDate, l.returnDate} {
+			if _, err := parseDate(d); d != "" && err != nil {
+				return l, "dates must be YYYY-MM-DD"
+			}
+		}
+		if l.returnDate != "" && l.returnDate < l.loanDate {
+			return l, "returnDate is before loanDate"
+		}
+		return l, ""
+	},
+	apply: func(r *http.Request, v loanCSVRow) (string, error) {
+		var reader *User
+		var err error
+		if v.readerID != "" {
+			reader, err = store.Users().ByID(v.readerID)
+		} else {
+			reader, err = store.Users().ByEmail(v.readerEmail)
+		}
+		if err != nil {
+			return "", err
+		}
+		if reader == nil || reader.Role != "reader" {
+			return "Reader not found", nil
+		}
+		open := v.returnDate == ""
+		if open && reader.archived() {
+			return "Reader account is archived", nil
+		}
+		c, err := store.Copies().ByBarcode(v.barcode)
+		if err != nil {
+			return "", err
+		}
+		if c == nil {
+			return "Copy not found", nil
+		}
+		if open && c.Status != copyAvailable {
+			return "Copy " + c.Barcode + " is " + c.Status, nil
+		}
+		book, err := store.Books().ByID(c.BookID)
+		if err != nil {
+			return "", err
+		}
+		if open && book != nil && book.archived() {
+			return "Book is archived", nil
+		}
+		due := v.dueDate
+		if due == "" {
+			terms, err := resolveTerms(readerCategoryOf(reader), bookCategoryOf(book))
+			if err != nil {
+				return "", err
+			}
+			if terms.LoanDays == 0 {
+				return "dueDate is required: the book is not loanable", nil
+			}
+			cal, err := loadCalendar()
+			if err != nil {
+				return "", err
+			}
+			from, _ := parseDate(v.loanDate)
+			due = cal.dueDate(from, terms.LoanDays)
+		}
+
+		id, err := newID("loan")
+		if err != nil {
+			return "", err
+		}
+		loan := Loan{
+			ID:         id,
+			ReaderID:   reader.ID,
+			BookID:     c.BookID,
+			CopyID:     c.ID,
+			LoanDate:   v.loanDate,
+			DueDate:    due,
+			ReturnDate: v.returnDate,
+			Status:     loanBorrowed,
+		}
+		if !open {
+			loan.Status = loanReturned
+		} else {
+			c.Status = copyOnLoan
+			if err := store.Copies().Update(*c); err != nil {
+				return "", err
+			}
+			if _, err := syncBookCounts(c.BookID); err != nil {
+				return "", err
+			}
+		}
+		if err := store.Loans().Create(loan); err != nil {
+			return "", err
+		}
+		return "", recordAudit(r, "loan.import", "loan", loan.ID, nil, loan)
+	},
+	records: func() (csvRows, error) {
+		views, err := loanViews()
+		if err != nil {
+			return nil, err
+		}
+		return func(emit func([]string) error) error {
+			for _, v := range views {
+				err := emit([]string{v.ID, v.ReaderID, v.ReaderName, v.ReaderEmail, v.ReaderPhone, v.BookID, v.BookCode,
+					v.BookTitle, v.BookAuthor, v.Barcode, v.LoanDate, v.DueDate, v.ReturnDate, v.Status,
+					v.FineAmount.String(), strconv.Itoa(v.Renewals)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	},
+}
+
+// csvRoute serves GET (export) and POST (import) for one kind of record.
+func csvRoute[T any](w http.ResponseWriter, r *http.Request, name, readPerm, writePerm string, k csvKind[T]) {
+	switch r.Method {
+	case "GET":
+		requirePermission(readPerm, func(w http.ResponseWriter, r *http.Request) { exportCSV(w, name, k) })(w, r)
+	case "POST":
+		requirePermission(writePerm, func(w http.ResponseWriter, r *http.Request) { importCSV(w, r, k) })(w, r)
+	default:
+		jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
+	}
+}
+
+// csvHandler serves /api/csv/books, /api/csv/users and /api/csv/loans.
+func csvHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/csv/books":
+		csvRoute(w, r, "books", permBooksWrite, permBooksWrite, bookCSV)
+	case "/api/csv/users":
+		csvRoute(w, r, "users", permUsersRead, permUsersManage, userCSV)
+	case "/api/csv/loans":
+		csvRoute(w, r, "loans", permLoansRead, permLoansIssue, loanCSV)
+	default:
+		jsonWrite(w, 404, map[string]any{"error": "Not found"})
+	}
+}
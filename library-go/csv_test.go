@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSVSafe(t *testing.T) {
+	tests := []struct{ cell, want string }{
+		{"Abai Joly", "Abai Joly"},
+		{"", ""},
+		{"=HYPERLINK(\"http://x\")", "'=HYPERLINK(\"http://x\")"},
+		{"+7 701 000 0000", "'+7 701 000 0000"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"'quoted'", "'quoted'"},
+	}
+	for _, tt := range tests {
+		got := csvSafe(tt.cell)
+		if got != tt.want {
+			t.Errorf("csvSafe(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+		if back := csvUnsafe(got); back != tt.cell {
+			t.Errorf("csvUnsafe(%q) = %q, want %q", got, back, tt.cell)
+		}
+	}
+}
+
+// testCSV imports single-column rows; "bad" fails parse and every prepared
+// row is counted.
+func testCSV(prepared *int) csvKind[string] {
+	return csvKind[string]{
+		columns:  []string{"name"},
+		required: []string{"name"},
+		parse: func(row csvRow) (string, string) {
+			if row["name"] == "bad" {
+				return "", "bad row"
+			}
+			return row["name"], ""
+		},
+		prepare: func(v string) (string, string) {
+			*prepared++
+			return v, ""
+		},
+		apply:   func(*http.Request, string) (string, error) { return "", nil },
+		records: func() (csvRows, error) { return func(func([]string) error) error { return nil }, nil },
+	}
+}
+
+func TestImportCSVPreparesOnlyRowsToApply(t *testing.T) {
+	tests := []struct {
+		mode         string
+		body         string
+		wantCode     int
+		wantPrepared int
+	}{
+		{"all", "name\na\nb\n", 200, 2},
+		{"all", "name\na\nbad\nb\n", 400, 0},
+		{"best-effort", "name\na\nbad\nb\n", 200, 2},
+	}
+	openTestStore(t)
+	for _, tt := range tests {
+		prepared := 0
+		w := httptest.NewRecorder()
+		importCSV(w, httptest.NewRequest("POST", "/api/csv/x?mode="+tt.mode, strings.NewReader(tt.body)), testCSV(&prepared))
+		if w.Code != tt.wantCode || prepared != tt.wantPrepared {
+			t.Errorf("%s %q: status %d, prepared %d; want %d, %d", tt.mode, tt.body, w.Code, prepared, tt.wantCode, tt.wantPrepared)
+		}
+	}
+}
+
+func TestExportCSVEscapesFormulas(t *testing.T) {
+	openTestStore(t)
+	if err := store.Books().Create(Book{ID: "B1", BookCode: "C1", Title: "=1+1", Category: bookStandard}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	exportCSV(w, "books", bookCSV)
+	if !strings.Contains(w.Body.String(), "B1,C1,'=1+1,") {
+		t.Errorf("export does not escape the title:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Overdue fines: the lending rule's daily rate (FINE_PER_DAY unless a rule
+// sets one) for every open day a loan is late past fineGraceDays
+// (FINE_GRACE_DAYS), capped at fineMax (FINE_MAX, 0 = no fixed cap) and never
+// more than the book's price. The scheduler re-runs the scan every
+// scanInterval (SCAN_INTERVAL); returns settle the final amount.
+var (
+	finePerDay    Money = 5000
+	fineGraceDays       = 1
+	fineMax       Money = 0
+	scanInterval        = time.Hour
+)
+
+func loadFineConfig() {
+	if m, err := parseMoney(os.Getenv("FINE_PER_DAY")); err == nil && m >= 0 {
+		finePerDay = m
+	}
+	if n, err := strconv.Atoi(os.Getenv("FINE_GRACE_DAYS")); err == nil && n >= 0 {
+		fineGraceDays = n
+	}
+	if m, err := parseMoney(os.Getenv("FINE_MAX")); err == nil && m >= 0 {
+		fineMax = m
+	}
+	if d, err := time.ParseDuration(os.Getenv("SCAN_INTERVAL")); err == nil && d > 0 {
+		scanInterval = d
+	}
+}
+
+const (
+	loanBorrowed = "borrowed"
+	loanOverdue  = "overdue"
+	loanReturned = "returned"
+	loanLost     = "lost"
+)
+
+// active reports whether the copy is still out with the reader.
+func (l Loan) active() bool {
+	return l.Status == loanBorrowed || l.Status == loanOverdue
+}
+
+// overdueFine is what a loan owes after late open days at rate per day,
+// including whatever it had accrued before its last renewal.
+func overdueFine(l Loan, late int, rate, price Money) Money {
+	fine := l.CarriedFine
+	if days := late - fineGraceDays; days > 0 {
+		fine += Money(days) * rate
+	}
+	if fineMax > 0 {
+		fine = min(fine, fineMax)
+	}
+	if price > 0 {
+		fine = min(fine, price)
+	}
+	return fine
+}
+
+// accrueFines marks active loans past their due date as overdue (and back, if
+// a renewal moved the date) and brings their running fine up to date. It
+// reports how many loans changed. Callers must hold mu.
+func accrueFines(day time.Time) (int, error) {
+	loans, err := store.Loans().All()
+	if err != nil {
+		return 0, err
+	}
+	cal, err := loadCalendar()
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	err = store.Atomic(func() error {
+		for _, l := range loans {
+			if !l.active() {
+				continue
+			}
+			book, err := store.Books().ByID(l.BookID)
+			if err != nil {
+				return err
+			}
+			var price Money
+			if book != nil {
+				price = book.Price
+			}
+			terms, err := termsForLoan(l, book)
+			if err != nil {
+				return err
+			}
+
+			late := cal.daysLate(l, day)
+			status := loanBorrowed
+			if late > 0 {
+				status = loanOverdue
+			}
+			fine := overdueFine(l, late, terms.FinePerDay, price)
+			if status == l.Status && fine == l.FineAmount {
+				continue
+			}
+			l.Status = status
+			l.FineAmount = fine
+			if err := store.Loans().Update(l); err != nil {
+				return err
+			}
+			changed++
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// runScan is one pass of the background jobs: overdue fines, unclaimed holds
+// and login counters that have run out.
+func runScan() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	n, err := accrueFines(today())
+	if err != nil {
+		log.Printf("fine scan: %v", err)
+	} else if n > 0 {
+		log.Printf("fine scan: updated %d loans", n)
+	}
+	if err := expireHolds(); err != nil {
+		log.Printf("hold expiry: %v", err)
+	}
+	if err := purgeLoginAttempts(time.Now().UTC()); err != nil {
+		log.Printf("login attempt expiry: %v", err)
+	}
+}
+
+// startScheduler runs runScan now and then every scanInterval.
+func startScheduler() {
+	runScan()
+	go func() {
+		t := time.NewTicker(scanInterval)
+		defer t.Stop()
+		for range t.C {
+			runScan()
+		}
+	}()
+}
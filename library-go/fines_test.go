@@ -0,0 +1,147 @@
+package main
+
+import "testing"
+
+// setFineConfig replaces the fine settings for the rest of the test.
+func setFineConfig(t *testing.T, rate Money, grace int, maxFine Money) {
+	t.Helper()
+	oldRate, oldGrace, oldMax := finePerDay, fineGraceDays, fineMax
+	finePerDay, fineGraceDays, fineMax = rate, grace, maxFine
+	t.Cleanup(func() { finePerDay, fineGraceDays, fineMax = oldRate, oldGrace, oldMax })
+}
+
+func TestOverdueFine(t *testing.T) {
+	tests := []struct {
+		name    string
+		late    int
+		carried Money
+		max     Money
+		price   Money
+		want    Money
+	}{
+		{name: "on time", late: 0, want: 0},
+		{name: "inside grace", late: 1, want: 0},
+		{name: "first day past grace", late: 2, want: 1000},
+		{name: "rate per day", late: 5, want: 4000},
+		{name: "capped by FINE_MAX", late: 30, max: 5000, want: 5000},
+		{name: "capped by price", late: 30, price: 3000, want: 3000},
+		{name: "lower of both caps", late: 30, max: 5000, price: 3000, want: 3000},
+		{name: "carried over from before renewal", late: 3, carried: 1500, want: 3500},
+		{name: "carried only, back within grace", late: 0, carried: 1500, want: 1500},
+		{name: "carried counts toward cap", late: 5, carried: 4000, max: 5000, want: 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFineConfig(t, 1000, 1, tt.max)
+			l := Loan{CarriedFine: tt.carried}
+			if got := overdueFine(l, tt.late, finePerDay, tt.price); got != tt.want {
+				t.Errorf("overdueFine(late %d) = %v, want %v", tt.late, got, tt.want)
+			}
+		})
+	}
+}
+
+// seedFineLoan stores a reader, a book priced at price and one loan of it due
+// on due, and returns the loan's ID.
+func seedFineLoan(t *testing.T, due string, price Money, status string, fine Money) string {
+	t.Helper()
+	if err := store.Users().Create(User{ID: "U1", Role: "reader", Category: readerStudent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Books().Create(Book{ID: "B1", Category: bookStandard, Price: price}); err != nil {
+		t.Fatal(err)
+	}
+	l := Loan{ID: "L1", ReaderID: "U1", BookID: "B1", LoanDate: "2026-02-23", DueDate: due, Status: status, FineAmount: fine}
+	if err := store.Loans().Create(l); err != nil {
+		t.Fatal(err)
+	}
+	return l.ID
+}
+
+func loanAfterScan(t *testing.T, id string) (*Loan, int) {
+	t.Helper()
+	n, err := accrueFines(today())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := store.Loans().ByID(id)
+	if err != nil || l == nil {
+		t.Fatalf("loan %s: %v", id, err)
+	}
+	return l, n
+}
+
+// March 2026 starts on a Sunday, the library's default closed day; 2026-03-02
+// is a Monday.
+func TestAccrueFines(t *testing.T) {
+	tests := []struct {
+		name       string
+		due, today string
+		closed     []string
+		max, price Money
+		status     string
+		fine       Money
+		wantStatus string
+		wantFine   Money
+	}{
+		{name: "due today", due: "2026-03-02", today: "2026-03-02", wantStatus: loanBorrowed},
+		{name: "late inside grace", due: "2026-03-02", today: "2026-03-03", wantStatus: loanOverdue},
+		{name: "late past grace", due: "2026-03-02", today: "2026-03-05", wantStatus: loanOverdue, wantFine: 2000},
+		{name: "Sunday not counted", due: "2026-03-06", today: "2026-03-09", wantStatus: loanOverdue, wantFine: 1000},
+		{name: "closed day not counted", due: "2026-03-02", today: "2026-03-05", closed: []string{"2026-03-04"},
+			wantStatus: loanOverdue, wantFine: 1000},
+		{name: "capped by FINE_MAX", due: "2026-03-02", today: "2026-03-31", max: 5000, wantStatus: loanOverdue, wantFine: 5000},
+		{name: "capped by price", due: "2026-03-02", today: "2026-03-31", price: 3000, wantStatus: loanOverdue, wantFine: 3000},
+		{name: "renewed past today", due: "2026-03-20", today: "2026-03-05", status: loanOverdue, fine: 2000,
+			wantStatus: loanBorrowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestStore(t)
+			setFineConfig(t, 1000, 1, tt.max)
+			setClock(t, tt.today)
+			for _, d := range tt.closed {
+				if err := store.ClosedDays().Put(ClosedDay{ID: d}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			status := tt.status
+			if status == "" {
+				status = loanBorrowed
+			}
+			id := seedFineLoan(t, tt.due, tt.price, status, tt.fine)
+
+			l, _ := loanAfterScan(t, id)
+			if l.Status != tt.wantStatus || l.FineAmount != tt.wantFine {
+				t.Errorf("after scan: status %q, fine %v; want %q, %v", l.Status, l.FineAmount, tt.wantStatus, tt.wantFine)
+			}
+		})
+	}
+}
+
+func TestAccrueFinesRepeatedScans(t *testing.T) {
+	openTestStore(t)
+	setFineConfig(t, 1000, 1, 0)
+	id := seedFineLoan(t, "2026-03-02", 0, loanBorrowed, 0)
+
+	steps := []struct {
+		today       string
+		wantChanged int
+		wantFine    Money
+	}{
+		{"2026-03-05", 1, 2000},
+		{"2026-03-05", 0, 2000}, // same day again: nothing to do
+		{"2026-03-05", 0, 2000},
+		{"2026-03-06", 1, 3000},
+		{"2026-03-07", 1, 4000},
+		{"2026-03-08", 0, 4000}, // Sunday adds no day
+		{"2026-03-09", 1, 5000},
+	}
+	for _, s := range steps {
+		setClock(t, s.today)
+		l, n := loanAfterScan(t, id)
+		if n != s.wantChanged || l.FineAmount != s.wantFine {
+			t.Errorf("scan on %s: changed %d, fine %v; want %d, %v", s.today, n, l.FineAmount, s.wantChanged, s.wantFine)
+		}
+	}
+}
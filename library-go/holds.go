@@ -0,0 +1,471 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hold is a reader's place in the queue for a book that is out of stock.
+// Holds are served first come, first served: a copy coming back (or a new
+// copy being shelved) is set aside for the oldest waiting hold, which then has
+// until PickupBy to borrow it.
+type Hold struct {
+	ID       string `json:"id"`
+	BookID   string `json:"bookId"`
+	ReaderID string `json:"readerId"`
+	PlacedAt string `json:"placedAt"`
+	Status   string `json:"status"`
+
+	CopyID   string `json:"copyId,omitempty"`
+	ReadyAt  string `json:"readyAt,omitempty"`
+	PickupBy string `json:"pickupBy,omitempty"`
+	LoanID   string `json:"loanId,omitempty"`
+	ClosedAt string `json:"closedAt,omitempty"`
+}
+
+const (
+	holdWaiting   = "waiting"
+	holdReady     = "ready"
+	holdFulfilled = "fulfilled"
+	holdCancelled = "cancelled"
+	holdExpired   = "expired"
+)
+
+// holdPickupDays is how long a copy stays set aside for a reader
+// (HOLD_PICKUP_DAYS).
+var holdPickupDays = 3
+
+func loadHoldConfig() {
+	if n, err := strconv.Atoi(os.Getenv("HOLD_PICKUP_DAYS")); err == nil && n > 0 {
+		holdPickupDays = n
+	}
+}
+
+func (h Hold) active() bool {
+	return h.Status == holdWaiting || h.Status == holdReady
+}
+
+// promoteHold sets copy c aside for the next reader waiting for its book, or
+// puts it back on the shelf when nobody is. It returns the hold that became
+// ready, if any, so the caller can notify the reader once the write is
+// committed. Callers must hold mu and sync the book's counts afterwards.
+func promoteHold(c *Copy) (*Hold, error) {
+	holds, err := store.Holds().ByBook(c.BookID)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range holds {
+		if h.Status != holdWaiting {
+			continue
+		}
+		cal, err := loadCalendar()
+		if err != nil {
+			return nil, err
+		}
+		c.Status = copyOnHold
+		h.Status = holdReady
+		h.CopyID = c.ID
+		h.ReadyAt = nowDate()
+		h.PickupBy = cal.dueDate(today(), holdPickupDays)
+		if err := store.Copies().Update(*c); err != nil {
+			return nil, err
+		}
+		return &h, store.Holds().Update(h)
+	}
+	c.Status = copyAvailable
+	return nil, store.Copies().Update(*c)
+}
+
+// holdForCopy finds the ready hold a copy is set aside for.
+func holdForCopy(c *Copy) (*Hold, error) {
+	holds, err := store.Holds().ByBook(c.BookID)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range holds {
+		if h.Status == holdReady && h.CopyID == c.ID {
+			return &h, nil
+		}
+	}
+	return nil, nil
+}
+
+// releaseHeldCopy passes the copy a closed hold had set aside on down the
+// queue. Callers must hold mu.
+func releaseHeldCopy(h Hold) (*Hold, error) {
+	if h.CopyID == "" {
+		return nil, nil
+	}
+	c, err := store.Copies().ByID(h.CopyID)
+	if err != nil || c == nil || c.Status != copyOnHold {
+		return nil, err
+	}
+	next, err := promoteHold(c)
+	if err != nil {
+		return nil, err
+	}
+	_, err = syncBookCounts(c.BookID)
+	return next, err
+}
+
+// expireHolds closes ready holds whose pickup date has passed and hands their
+// copies to whoever is next. It runs lazily from the handlers that look at
+// holds or stock. Callers must hold mu.
+func expireHolds() error {
+	holds, err := store.Holds().ByStatus(holdReady)
+	if err != nil {
+		return err
+	}
+	date := nowDate()
+	var ready []Hold
+	err = store.Atomic(func() error {
+		for _, h := range holds {
+			if h.PickupBy >= date {
+				continue
+			}
+			h.Status = holdExpired
+			h.ClosedAt = date
+			if err := store.Holds().Update(h); err != nil {
+				return err
+			}
+			next, err := releaseHeldCopy(h)
+			if err != nil {
+				return err
+			}
+			if next != nil {
+				ready = append(ready, *next)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	notifyHoldsReady(ready...)
+	return nil
+}
+
+// notifyHoldsReady tells readers their copy is waiting. Delivery failures are
+// only logged: the hold stays ready either way.
+func notifyHoldsReady(holds ...Hold) {
+	for _, h := range holds {
+		reader, err := store.Users().ByID(h.ReaderID)
+		if err != nil || reader == nil {
+			continue
+		}
+		book, err := store.Books().ByID(h.BookID)
+		if err != nil || book == nil {
+			continue
+		}
+		body := "\"" + book.Title + "\" is waiting for you at the desk.\n" +
+			"Please pick it up by " + h.PickupBy + "; after that it goes to the next reader."
+		if err := notifier.Send(reader.Email, "Your hold is ready", body); err != nil {
+			log.Printf("notify hold %s: %v", h.ID, err)
+		}
+	}
+}
+
+// holdView adds the book and, for waiting holds, the place in the queue.
+func holdView(h Hold) (map[string]any, error) {
+	book, err := store.Books().ByID(h.BookID)
+	if err != nil {
+		return nil, err
+	}
+	v := map[string]any{
+		"id": h.ID, "bookId": h.BookID, "readerId": h.ReaderID, "placedAt": h.PlacedAt, "status": h.Status,
+		"pickupBy": h.PickupBy, "book": book,
+	}
+	if h.Status == holdWaiting {
+		holds, err := store.Holds().ByBook(h.BookID)
+		if err != nil {
+			return nil, err
+		}
+		pos := 0
+		for _, x := range holds {
+			if x.Status == holdWaiting {
+				pos++
+			}
+			if x.ID == h.ID {
+				break
+			}
+		}
+		v["position"] = pos
+	}
+	return v, nil
+}
+
+func apiPlaceHold(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		BookID string `json:"bookId"`
+		// ReaderID lets desk staff place a hold for a reader.
+		ReaderID string `json:"readerId"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	readerID := u.ID
+	if u.Role != "reader" {
+		if !hasPermission(u, permLoansIssue) {
+			jsonWrite(w, 403, map[string]any{"error": "Missing permission: " + permLoansIssue})
+			return
+		}
+		readerID = req.ReaderID
+	}
+	reader, err := store.Users().ByID(readerID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if reader == nil || reader.Role != "reader" {
+		jsonWrite(w, 404, map[string]any{"error": "Reader not found"})
+		return
+	}
+	if reader.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Reader account is archived"})
+		return
+	}
+
+	if err := expireHolds(); err != nil {
+		storeError(w, err)
+		return
+	}
+	book, err := store.Books().ByID(req.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if book == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+		return
+	}
+	if book.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Book is archived"})
+		return
+	}
+	if book.AvailableQty > 0 {
+		jsonWrite(w, 400, map[string]any{"error": "Book is on the shelf; borrow it instead"})
+		return
+	}
+	if book.TotalQty == 0 {
+		jsonWrite(w, 400, map[string]any{"error": "Library has no copies of this book"})
+		return
+	}
+	mine, err := store.Holds().ByReader(readerID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	for _, h := range mine {
+		if h.BookID == book.ID && h.active() {
+			jsonWrite(w, 409, map[string]any{"error": "Already on hold"})
+			return
+		}
+	}
+
+	id, err := newID("hold")
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	h := Hold{
+		ID:       id,
+		BookID:   book.ID,
+		ReaderID: readerID,
+		PlacedAt: clock.Now().UTC().Format(time.RFC3339),
+		Status:   holdWaiting,
+	}
+	err = store.Atomic(func() error {
+		if err := store.Holds().Create(h); err != nil {
+			return err
+		}
+		return recordAudit(r, "hold.place", "hold", h.ID, nil, h)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	v, err := holdView(h)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, v)
+}
+
+func apiMyHolds(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	if err := expireHolds(); err != nil {
+		storeError(w, err)
+		return
+	}
+	holds, err := store.Holds().ByReader(u.ID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	out := []any{}
+	for _, h := range holds {
+		v, err := holdView(h)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		out = append(out, v)
+	}
+	jsonWrite(w, 200, out)
+}
+
+// apiListHolds shows the desk every active hold, optionally for one book.
+func apiListHolds(w http.ResponseWriter, r *http.Request) {
+	bookID := r.URL.Query().Get("bookId")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := expireHolds(); err != nil {
+		storeError(w, err)
+		return
+	}
+	var holds []Hold
+	var err error
+	if bookID != "" {
+		holds, err = store.Holds().ByBook(bookID)
+	} else {
+		holds, err = store.Holds().All()
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	out := []any{}
+	for _, h := range holds {
+		if !h.active() {
+			continue
+		}
+		v, err := holdView(h)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		reader, err := store.Users().ByID(h.ReaderID)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if reader != nil {
+			v["readerName"] = reader.FullName
+			v["readerPhone"] = reader.Phone
+		}
+		if h.CopyID != "" {
+			c, err := store.Copies().ByID(h.CopyID)
+			if err != nil {
+				storeError(w, err)
+				return
+			}
+			if c != nil {
+				v["barcode"] = c.Barcode
+			}
+		}
+		out = append(out, v)
+	}
+	jsonWrite(w, 200, out)
+}
+
+func apiCancelHold(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/holds/"), "/cancel")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	h, err := store.Holds().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if h == nil || (h.ReaderID != u.ID && !hasPermission(u, permLoansIssue)) {
+		jsonWrite(w, 404, map[string]any{"error": "Hold not found"})
+		return
+	}
+	if !h.active() {
+		jsonWrite(w, 400, map[string]any{"error": "Hold is already " + h.Status})
+		return
+	}
+
+	before := *h
+	h.Status = holdCancelled
+	h.ClosedAt = nowDate()
+	var next *Hold
+	err = store.Atomic(func() error {
+		if err := store.Holds().Update(*h); err != nil {
+			return err
+		}
+		var err error
+		if next, err = releaseHeldCopy(*h); err != nil {
+			return err
+		}
+		return recordAudit(r, "hold.cancel", "hold", h.ID, before, h)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if next != nil {
+		notifyHoldsReady(*next)
+	}
+	jsonWrite(w, 200, h)
+}
+
+// holdsHandler serves /api/holds, /api/holds/mine and /api/holds/{id}/cancel.
+func holdsHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/holds":
+		if r.Method == "GET" {
+			requirePermission(permLoansRead, apiListHolds)(w, r)
+			return
+		}
+		if r.Method == "POST" {
+			apiPlaceHold(w, r)
+			return
+		}
+		jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
+	case r.URL.Path == "/api/holds/mine":
+		if !method(w, r, "GET") {
+			return
+		}
+		apiMyHolds(w, r)
+	case strings.HasSuffix(r.URL.Path, "/cancel"):
+		if !method(w, r, "POST") {
+			return
+		}
+		apiCancelHold(w, r)
+	default:
+		jsonWrite(w, 404, map[string]any{"error": "Not found"})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// icsEvent is the part of a VEVENT the calendar import needs: the days it
+// covers, as [Start, End) midnight-UTC dates, and its summary.
+type icsEvent struct {
+	Start, End time.Time
+	Summary    string
+}
+
+// maxEventDays bounds a single imported event, so a typo in DTEND cannot
+// close the library for a decade.
+const maxEventDays = 366
+
+// parseICS reads the events of an iCalendar (RFC 5545) file. Only the date
+// part of DTSTART/DTEND is used, in the time zone the file wrote it in. It
+// returns the events it understood and a note for each one it skipped.
+func parseICS(src string) ([]icsEvent, []string, error) {
+	lines := unfoldICS(src)
+	if len(lines) == 0 || !strings.EqualFold(strings.TrimSpace(lines[0]), "BEGIN:VCALENDAR") {
+		return nil, nil, errors.New("not an iCalendar file (expected BEGIN:VCALENDAR)")
+	}
+
+	var events []icsEvent
+	skipped := []string{}
+	var props map[string]icsProp
+	for _, line := range lines {
+		name, p := splitICSLine(line)
+		switch {
+		case name == "BEGIN" && strings.EqualFold(p.value, "VEVENT"):
+			props = map[string]icsProp{}
+		case name == "END" && strings.EqualFold(p.value, "VEVENT") && props != nil:
+			ev, why := icsEventFrom(props)
+			if why != "" {
+				skipped = append(skipped, why)
+			} else {
+				events = append(events, ev)
+			}
+			props = nil
+		case props != nil && name != "":
+			if _, seen := props[name]; !seen {
+				props[name] = p
+			}
+		}
+	}
+	return events, skipped, nil
+}
+
+type icsProp struct {
+	params map[string]string
+	value  string
+}
+
+// unfoldICS joins continuation lines (those starting with a space or tab)
+// onto the line before them.
+func unfoldICS(src string) []string {
+	var out []string
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(out) > 0 {
+			out[len(out)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// splitICSLine splits `NAME;PARAM=x;PARAM="y:z":value`. The first colon
+// outside quotes ends the name and parameters.
+func splitICSLine(line string) (string, icsProp) {
+	quoted := false
+	for i, ch := range line {
+		switch {
+		case ch == '"':
+			quoted = !quoted
+		case ch == ':' && !quoted:
+			head := strings.Split(line[:i], ";")
+			p := icsProp{params: map[string]string{}, value: line[i+1:]}
+			for _, kv := range head[1:] {
+				k, v, _ := strings.Cut(kv, "=")
+				p.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+			}
+			return strings.ToUpper(head[0]), p
+		}
+	}
+	return "", icsProp{}
+}
+
+func icsEventFrom(props map[string]icsProp) (icsEvent, string) {
+	summary := unescapeICS(props["SUMMARY"].value)
+	label := summary
+	if label == "" {
+		label = props["UID"].value
+	}
+	if _, ok := props["RRULE"]; ok {
+		return icsEvent{}, "recurring event not imported: " + label
+	}
+	start, _, ok := icsDate(props["DTSTART"])
+	if !ok {
+		return icsEvent{}, "event without a readable DTSTART: " + label
+	}
+	end := start.AddDate(0, 0, 1)
+	if p, ok := props["DTEND"]; ok {
+		e, endAllDay, ok := icsDate(p)
+		if !ok {
+			return icsEvent{}, "event with an unreadable DTEND: " + label
+		}
+		// An all-day DTEND is exclusive; a timed one closes its own day
+		// unless it ends exactly at midnight.
+		if !endAllDay && !strings.HasSuffix(strings.TrimSuffix(p.value, "Z"), "T000000") {
+			e = e.AddDate(0, 0, 1)
+		}
+		// A DTEND at or before DTSTART is malformed; treat the event as
+		// covering its first day.
+		if e.After(start) {
+			end = e
+		}
+	}
+	if daysBetween(start, end) > maxEventDays {
+		return icsEvent{}, "event longer than a year not imported: " + label
+	}
+	return icsEvent{Start: start, End: end, Summary: summary}, ""
+}
+
+// icsDate reads the date part of a DATE or DATE-TIME value.
+func icsDate(p icsProp) (time.Time, bool, bool) {
+	if len(p.value) < 8 {
+		return time.Time{}, false, false
+	}
+	d, err := time.Parse("20060102", p.value[:8])
+	if err != nil {
+		return time.Time{}, false, false
+	}
+	allDay := p.params["VALUE"] == "DATE" || len(p.value) == 8
+	return d, allDay, true
+}
+
+func unescapeICS(s string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(strings.TrimSpace(s))
+}
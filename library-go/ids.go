@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Record IDs are a prefix and a number taken from a per-entity sequence that
+// is stored with the data, so a number is never handed out twice, not even
+// after the record that had it is deleted.
+
+// Sequence is the last number issued for one entity kind.
+type Sequence struct {
+	ID   string `json:"id"` // entity kind, e.g. "book"
+	Last int    `json:"last"`
+}
+
+// idSequences lists the entities that get sequence IDs, with their prefix,
+// the document key they are stored under and the fields other records refer
+// to them by.
+var idSequences = []struct {
+	kind, prefix, doc string
+	refs              []string
+}{
+	{"user", "U", "users", []string{"readerId", "userId", "actorId"}},
+	{"book", "B", "books", []string{"bookId"}},
+	{"author", "A", "authors", []string{"authorId"}},
+	{"copy", "C", "copies", []string{"copyId"}},
+	{"loan", "L", "loans", []string{"loanId"}},
+	{"hold", "H", "holds", nil},
+	{"fine", "F", "fines", nil},
+}
+
+// newID takes the next ID for kind. Called inside an Atomic block, the
+// sequence step is rolled back with the rest when the block fails; outside
+// one, a failed create just leaves a gap. Callers must hold mu.
+func newID(kind string) (string, error) {
+	for _, s := range idSequences {
+		if s.kind != kind {
+			continue
+		}
+		n, err := store.Sequences().Next(kind)
+		if err != nil {
+			return "", err
+		}
+		return genID(s.prefix, n), nil
+	}
+	return "", fmt.Errorf("no ID sequence for %q", kind)
+}
+
+// idNumber reads the number out of an ID with the given prefix, or 0 when
+// the ID has some other shape.
+func idNumber(id, prefix string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(id, prefix))
+	if err != nil || !strings.HasPrefix(id, prefix) || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// docSequences returns the raw sequence records of doc by kind, creating the
+// ones that are missing with Last set past every ID still in sight: those of
+// the records themselves, the references other records hold and the audit
+// log, which remembers records that were deleted since.
+func docSequences(doc map[string]any) map[string]map[string]any {
+	seqs := map[string]map[string]any{}
+	for _, s := range docRecords(doc, "sequences") {
+		if kind, ok := s["id"].(string); ok {
+			seqs[kind] = s
+		}
+	}
+	list, _ := doc["sequences"].([]any)
+	for _, s := range idSequences {
+		if seqs[s.kind] != nil {
+			continue
+		}
+		last := 0
+		for _, rec := range docRecords(doc, s.doc) {
+			id, _ := rec["id"].(string)
+			last = max(last, idNumber(id, s.prefix))
+		}
+		for key, v := range doc {
+			if _, ok := v.([]any); !ok || key == "sequences" {
+				continue
+			}
+			for _, rec := range docRecords(doc, key) {
+				last = max(last, refNumber(rec, s.refs, s.prefix))
+				if key == "audit" && rec["entity"] == s.kind {
+					id, _ := rec["entityId"].(string)
+					last = max(last, idNumber(id, s.prefix))
+				}
+			}
+		}
+		seqs[s.kind] = map[string]any{"id": s.kind, "last": last}
+		list = append(list, seqs[s.kind])
+	}
+	doc["sequences"] = list
+	return seqs
+}
+
+// refNumber is the highest ID number among rec's fields named in refs,
+// looking into nested records too (book contributors carry authorId).
+func refNumber(rec map[string]any, refs []string, prefix string) int {
+	n := 0
+	for k, v := range rec {
+		switch v := v.(type) {
+		case string:
+			if slices.Contains(refs, k) {
+				n = max(n, idNumber(v, prefix))
+			}
+		case []any:
+			for _, item := range v {
+				if m, ok := item.(map[string]any); ok {
+					n = max(n, refNumber(m, refs, prefix))
+				}
+			}
+		}
+	}
+	return n
+}
+
+// repairIDs gives a fresh ID to every record that shares its ID with an
+// earlier record of the same kind, as older builds could do after a delete,
+// and returns one line per record it changed. Other records that held the
+// shared ID keep pointing at the first record: which one they meant cannot be
+// told from the data, so the report names both for a person to check.
+func repairIDs(doc map[string]any) []string {
+	seqs := docSequences(doc)
+	var report []string
+	for _, s := range idSequences {
+		seen := map[string]bool{}
+		for i, rec := range docRecords(doc, s.doc) {
+			id, _ := rec["id"].(string)
+			if !seen[id] {
+				seen[id] = true
+				continue
+			}
+			seq := seqs[s.kind]
+			n := docInt(seq["last"]) + 1
+			seq["last"] = n
+			rec["id"] = genID(s.prefix, n)
+			report = append(report, fmt.Sprintf("%s[%d] (%s) shared ID %s with an earlier %s and is now %s; references to %s still mean the first one",
+				s.doc, i, describeRecord(rec), id, s.kind, rec["id"], id))
+		}
+	}
+	return report
+}
+
+// describeRecord picks the field a person would recognise a record by.
+func describeRecord(rec map[string]any) string {
+	for _, k := range []string{"email", "bookCode", "name", "barcode", "readerId", "userId"} {
+		if v, ok := rec[k].(string); ok && v != "" {
+			return k + " " + v
+		}
+	}
+	return "no identifying fields"
+}
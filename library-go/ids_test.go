@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testDoc(t *testing.T, raw string) map[string]any {
+	t.Helper()
+	doc, err := decodeDoc(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestDocSequences(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		kind string
+		want int
+	}{
+		{"empty", `{}`, "book", 0},
+		{"highest record", `{"books":[{"id":"B1"},{"id":"B5"},{"id":"B3"}]}`, "book", 5},
+		{"odd IDs ignored", `{"books":[{"id":"B2"},{"id":"legacy-7"},{"id":"B-9"}]}`, "book", 2},
+		{"loan refers to a deleted book", `{"books":[{"id":"B1"}],"loans":[{"id":"L1","bookId":"B9"}]}`, "book", 9},
+		{"contributor refers to a deleted author",
+			`{"authors":[{"id":"A1"}],"books":[{"id":"B1","contributors":[{"authorId":"A4"}]}]}`, "author", 4},
+		{"fine refers to a deleted reader", `{"fines":[{"id":"F1","userId":"U6"}]}`, "user", 6},
+		{"audit remembers a purged book", `{"books":[{"id":"B1"}],"audit":[{"entity":"book","entityId":"B12"}]}`, "book", 12},
+		{"audit actor is a user", `{"audit":[{"entity":"book","entityId":"B1","actorId":"U7"}]}`, "user", 7},
+		{"audit of another kind", `{"audit":[{"entity":"loan","entityId":"L30"}]}`, "book", 0},
+		{"stored sequence kept", `{"books":[{"id":"B5"}],"sequences":[{"id":"book","last":20}]}`, "book", 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := testDoc(t, tt.doc)
+			seqs := docSequences(doc)
+			if got := docInt(seqs[tt.kind]["last"]); got != tt.want {
+				t.Errorf("%s sequence = %d, want %d", tt.kind, got, tt.want)
+			}
+			if n := len(doc["sequences"].([]any)); n != len(idSequences) {
+				t.Errorf("doc has %d sequences, want %d", n, len(idSequences))
+			}
+		})
+	}
+}
+
+func TestRepairIDs(t *testing.T) {
+	doc := testDoc(t, `{
+		"books": [
+			{"id":"B1","bookCode":"C1"},
+			{"id":"B2","bookCode":"C2"},
+			{"id":"B2","bookCode":"C3"},
+			{"id":"B2","bookCode":"C4"}
+		],
+		"loans": [{"id":"L1","bookId":"B2"}],
+		"audit": [{"entity":"book","entityId":"B6"}]
+	}`)
+	report := repairIDs(doc)
+	if len(report) != 2 {
+		t.Fatalf("report has %d lines, want 2: %v", len(report), report)
+	}
+	if !strings.Contains(report[0], "bookCode C3") || !strings.Contains(report[0], "now B7") {
+		t.Errorf("report[0] = %q", report[0])
+	}
+	var ids []string
+	for _, b := range docRecords(doc, "books") {
+		ids = append(ids, b["id"].(string))
+	}
+	// B3..B6 may have belonged to deleted books (the audit log names B6), so
+	// the copies of B2 go after them.
+	if got := strings.Join(ids, " "); got != "B1 B2 B7 B8" {
+		t.Errorf("book IDs = %s, want B1 B2 B7 B8", got)
+	}
+	if got := docRecords(doc, "loans")[0]["bookId"]; got != "B2" {
+		t.Errorf("loan bookId = %v, want B2 (the first record)", got)
+	}
+	if got := docInt(docSequences(doc)["book"]["last"]); got != 8 {
+		t.Errorf("book sequence = %d, want 8", got)
+	}
+	if again := repairIDs(doc); len(again) != 0 {
+		t.Errorf("second repair changed %v", again)
+	}
+}
+
+func TestDeletedIDStaysUnused(t *testing.T) {
+	openTestStore(t)
+	for _, want := range []string{"B1", "B2"} {
+		id, err := newID("book")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != want {
+			t.Fatalf("newID = %s, want %s", id, want)
+		}
+		if err := store.Books().Create(Book{ID: id, BookCode: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Books().Delete("B2"); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := newID("book"); id != "B3" {
+		t.Errorf("after deleting B2: newID = %s, want B3", id)
+	}
+}
+
+func TestLoadRepairsDuplicateIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	raw := `{"schemaVersion":` + strconv.Itoa(schemaVersion) + `,
+		"books":[{"id":"B1","bookCode":"C1"},{"id":"B2","bookCode":"C2"},{"id":"B2","bookCode":"C3"}],
+		"sequences":[{"id":"book","last":2}]}`
+	if err := os.WriteFile(path, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if b, _ := s.Books().ByCode("C3"); b == nil || b.ID != "B3" {
+		t.Errorf("C3 = %+v, want ID B3", b)
+	}
+	if _, err := os.Stat(path + ".ids.bak"); err != nil {
+		t.Errorf("no backup of the file before the repair: %v", err)
+	}
+	old := store
+	store = s
+	defer func() { store = old }()
+	if id, _ := newID("book"); id != "B4" {
+		t.Errorf("newID after repair = %s, want B4", id)
+	}
+}
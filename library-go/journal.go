@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// The JSON store appends every committed Atomic block to data.json.journal as
+// one line and fsyncs it before answering. data.json itself is only rewritten
+// when the journal is compacted into a snapshot; on start the snapshot is
+// loaded and the newer journal entries are replayed on top of it.
+
+type journalOp struct {
+	Op   string          `json:"op"` // "put" or "delete"
+	Kind string          `json:"kind"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type journalEntry struct {
+	Seq  int64       `json:"seq"`
+	Time string      `json:"time"`
+	Ops  []journalOp `json:"ops"`
+}
+
+func putOp(kind, id string, v any) (journalOp, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return journalOp{}, err
+	}
+	return journalOp{Op: "put", Kind: kind, ID: id, Data: data}, nil
+}
+
+func deleteOp(kind, id string) journalOp {
+	return journalOp{Op: "delete", Kind: kind, ID: id}
+}
+
+// journalCollections maps an op kind to the list it lives in on disk, for
+// replaying onto the raw document before migrations run.
+var journalCollections = map[string]string{
+	"user":    "users",
+	"book":    "books",
+	"author":  "authors",
+	"copy":    "copies",
+	"loan":    "loans",
+	"hold":    "holds",
+	"fine":    "fines",
+	"audit":   "audit",
+	"rule":    "lendingRules",
+	"hours":   "openingHours",
+	"closed":  "closedDays",
+	"session": "sessions",
+	"attempt": "loginAttempts",
+	"seq":     "sequences",
+}
+
+func applyRawOp(doc map[string]any, op journalOp) error {
+	coll, ok := journalCollections[op.Kind]
+	if !ok {
+		return fmt.Errorf("journal: unknown kind %q", op.Kind)
+	}
+	list, _ := doc[coll].([]any)
+	idx := -1
+	for i, rec := range list {
+		if m, ok := rec.(map[string]any); ok && m["id"] == op.ID {
+			idx = i
+			break
+		}
+	}
+	switch op.Op {
+	case "put":
+		v, err := decodeDoc(bytes.NewReader(op.Data))
+		if err != nil {
+			return err
+		}
+		if idx == -1 {
+			list = append(list, v)
+		} else {
+			list[idx] = v
+		}
+	case "delete":
+		if idx != -1 {
+			list = append(list[:idx], list[idx+1:]...)
+		}
+	default:
+		return fmt.Errorf("journal: unknown op %q", op.Op)
+	}
+	doc[coll] = list
+	return nil
+}
+
+type journal struct {
+	f    *os.File
+	size int64
+	seq  int64
+	n    int // entries written since the last snapshot
+}
+
+// openJournal replays every entry newer than the snapshot's journalSeq into
+// the raw document and leaves the file open for appending. Replay happens
+// before migrations so entries written by an older build are upgraded along
+// with the snapshot they belong to. A torn last line (crash during append) is
+// cut off; damage anywhere else is reported so we never start on a partial
+// state.
+func openJournal(path string, doc map[string]any) (*journal, error) {
+	var snapSeq int64
+	if n, ok := doc["journalSeq"].(json.Number); ok {
+		snapSeq, _ = n.Int64()
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f, seq: snapSeq}
+
+	rd := bufio.NewReader(f)
+	var good int64
+	for {
+		line, err := rd.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("journal: dropping torn entry at offset %d", good)
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			if _, peekErr := rd.Peek(1); errors.Is(peekErr, io.EOF) {
+				log.Printf("journal: dropping torn entry at offset %d", good)
+				break
+			}
+			f.Close()
+			return nil, fmt.Errorf("journal: corrupt entry at offset %d: %w", good, err)
+		}
+		good += int64(len(line))
+		if e.Seq <= snapSeq {
+			continue
+		}
+		for _, op := range e.Ops {
+			if err := applyRawOp(doc, op); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("journal: entry %d: %w", e.Seq, err)
+			}
+		}
+		j.seq = e.Seq
+		j.n++
+	}
+
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.size = good
+	return j, nil
+}
+
+func (j *journal) append(ops []journalOp) error {
+	e := journalEntry{Seq: j.seq + 1, Time: time.Now().UTC().Format(time.RFC3339), Ops: ops}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := j.f.Write(line); err != nil {
+		j.rollback()
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		j.rollback()
+		return err
+	}
+	j.size += int64(len(line))
+	j.seq = e.Seq
+	j.n++
+	return nil
+}
+
+// rollback cuts a partially written entry so the next append starts clean.
+func (j *journal) rollback() {
+	_ = j.f.Truncate(j.size)
+	_, _ = j.f.Seek(j.size, io.SeekStart)
+}
+
+// reset empties the journal once its entries are safely in a snapshot.
+func (j *journal) reset() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.size = 0
+	j.n = 0
+	return j.f.Sync()
+}
+
+func (j *journal) Close() error { return j.f.Close() }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// FineTx is one line of the fines ledger. The ledger is append-only: a
+// mistake is corrected by a waiver or refund, never by editing a line.
+// Amounts are always positive; Kind says which way they count.
+type FineTx struct {
+	ID        string `json:"id"`
+	UserID    string `json:"userId"`
+	LoanID    string `json:"loanId,omitempty"`
+	Kind      string `json:"kind"`
+	Amount    Money  `json:"amount"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+const (
+	fineAssessed = "assessed" // a loan closed owing money
+	finePayment  = "payment"
+	fineWaiver   = "waiver"
+	fineRefund   = "refund" // money handed back out of a credit
+)
+
+// fineBlockThreshold is the amount owed above which a reader cannot borrow
+// (FINE_BLOCK_THRESHOLD, in major units). Fines still accruing on overdue
+// loans count, so keeping books out is no way around the limit.
+var fineBlockThreshold Money = 100000
+
+func loadLedgerConfig() {
+	if m, err := parseMoney(os.Getenv("FINE_BLOCK_THRESHOLD")); err == nil && m >= 0 {
+		fineBlockThreshold = m
+	}
+}
+
+// loanFine is what the ledger says about one loan's fine.
+type loanFine struct {
+	LoanID      string `json:"loanId"`
+	Assessed    Money  `json:"assessed"`
+	Paid        Money  `json:"paid"`
+	Waived      Money  `json:"waived"`
+	Outstanding Money  `json:"outstanding"`
+	Status      string `json:"status"`
+}
+
+func (f *loanFine) settle() {
+	f.Outstanding = max(f.Assessed-f.Paid-f.Waived, 0)
+	switch {
+	case f.Assessed == 0:
+		f.Status = ""
+	case f.Waived >= f.Assessed:
+		f.Status = "waived"
+	case f.Outstanding == 0:
+		f.Status = "paid"
+	case f.Paid+f.Waived > 0:
+		f.Status = "partially_paid"
+	default:
+		f.Status = "unpaid"
+	}
+}
+
+type fineAccount struct {
+	UserID string `json:"userId"`
+	// Balance is what the reader owes; negative means the library owes a
+	// refund.
+	Balance Money `json:"balance"`
+	// Accruing is the running overdue fine on loans still out; it joins the
+	// balance when they come back.
+	Accruing     Money      `json:"accruing"`
+	Loans        []loanFine `json:"loans"`
+	Transactions []FineTx   `json:"transactions"`
+}
+
+// fineAccountFor folds a user's ledger into a balance and per-loan fines.
+// Callers must hold mu.
+func fineAccountFor(userID string) (*fineAccount, error) {
+	txs, err := store.Fines().ByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	acct := &fineAccount{UserID: userID, Loans: []loanFine{}, Transactions: txs}
+	byLoan := map[string]*loanFine{}
+	var order []string
+	for _, tx := range txs {
+		var f *loanFine
+		if tx.LoanID != "" {
+			if f = byLoan[tx.LoanID]; f == nil {
+				f = &loanFine{LoanID: tx.LoanID}
+				byLoan[tx.LoanID] = f
+				order = append(order, tx.LoanID)
+			}
+		}
+		switch tx.Kind {
+		case fineAssessed:
+			acct.Balance += tx.Amount
+			if f != nil {
+				f.Assessed += tx.Amount
+			}
+		case finePayment:
+			acct.Balance -= tx.Amount
+			if f != nil {
+				f.Paid += tx.Amount
+			}
+		case fineWaiver:
+			acct.Balance -= tx.Amount
+			if f != nil {
+				f.Waived += tx.Amount
+			}
+		case fineRefund:
+			acct.Balance += tx.Amount
+		}
+	}
+	for _, id := range order {
+		f := byLoan[id]
+		f.settle()
+		acct.Loans = append(acct.Loans, *f)
+	}
+
+	loans, err := store.Loans().ByReader(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range loans {
+		if l.active() {
+			acct.Accruing += l.FineAmount
+		}
+	}
+	return acct, nil
+}
+
+// postFine appends one ledger line and returns it as stored. Callers must
+// hold mu.
+func postFine(tx FineTx) (FineTx, error) {
+	id, err := newID("fine")
+	if err != nil {
+		return tx, err
+	}
+	tx.ID = id
+	tx.CreatedAt = clock.Now().UTC().Format(time.RFC3339)
+	return tx, store.Fines().Create(tx)
+}
+
+// assessLoanFine books the final fine of a loan that is being closed.
+// Callers must hold mu and run it in the same Atomic block as the loan update.
+func assessLoanFine(l Loan, reason string) error {
+	if l.FineAmount <= 0 {
+		return nil
+	}
+	_, err := postFine(FineTx{UserID: l.ReaderID, LoanID: l.ID, Kind: fineAssessed, Amount: l.FineAmount, Reason: reason})
+	return err
+}
+
+// fineBlock says why a reader may not borrow, or "" if they may.
+func fineBlock(userID string) (string, error) {
+	acct, err := fineAccountFor(userID)
+	if err != nil {
+		return "", err
+	}
+	owed := acct.Balance + acct.Accruing
+	if owed <= fineBlockThreshold {
+		return "", nil
+	}
+	if acct.Accruing > 0 {
+		return "Reader owes " + owed.String() + " in fines, " + acct.Accruing.String() +
+			" of it on overdue loans (limit " + fineBlockThreshold.String() + ")", nil
+	}
+	return "Reader owes " + owed.String() + " in fines (limit " + fineBlockThreshold.String() + ")", nil
+}
+
+func apiMyFines(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	acct, err := fineAccountFor(u.ID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, acct)
+}
+
+func apiUserFines(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/fines")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	acct, err := fineAccountFor(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, acct)
+}
+
+// apiPostFineTx records a payment, waiver or refund for the user in the path
+// (/api/users/{id}/fines/{payments|waivers|refunds}).
+func apiPostFineTx(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	id, action, _ := strings.Cut(rest, "/fines/")
+	kind := map[string]string{"payments": finePayment, "waivers": fineWaiver, "refunds": fineRefund}[action]
+	if kind == "" {
+		jsonWrite(w, 404, map[string]any{"error": "Not found"})
+		return
+	}
+	type Req struct {
+		LoanID string `json:"loanId"`
+		// Amount may be left out of a waiver to waive everything the loan
+		// still owes.
+		Amount Money  `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Amount < 0 || (req.Amount == 0 && kind != fineWaiver) {
+		jsonWrite(w, 400, map[string]any{"error": "amount must be positive"})
+		return
+	}
+	if kind != finePayment && req.Reason == "" {
+		jsonWrite(w, 400, map[string]any{"error": "A reason is required"})
+		return
+	}
+	if kind == fineWaiver && req.LoanID == "" {
+		jsonWrite(w, 400, map[string]any{"error": "Waivers are made against a loan (loanId)"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	staff, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	acct, err := fineAccountFor(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	var target *loanFine
+	if req.LoanID != "" {
+		for i := range acct.Loans {
+			if acct.Loans[i].LoanID == req.LoanID {
+				target = &acct.Loans[i]
+			}
+		}
+		if target == nil {
+			jsonWrite(w, 404, map[string]any{"error": "No fine for this loan"})
+			return
+		}
+	}
+
+	// Payments are split over the loans they settle, oldest first, so each
+	// loan's fine status stays exact.
+	var lines []FineTx
+	line := FineTx{UserID: id, Kind: kind, Reason: req.Reason, CreatedBy: staff.ID}
+	switch kind {
+	case finePayment:
+		if req.Amount > acct.Balance {
+			jsonWrite(w, 400, map[string]any{"error": "Payment exceeds the balance of " + acct.Balance.String()})
+			return
+		}
+		left := req.Amount
+		for _, f := range acct.Loans {
+			if left == 0 {
+				break
+			}
+			if f.Outstanding == 0 || (target != nil && f.LoanID != target.LoanID) {
+				continue
+			}
+			part := min(left, f.Outstanding)
+			line.LoanID, line.Amount = f.LoanID, part
+			lines = append(lines, line)
+			left -= part
+		}
+		if left > 0 {
+			jsonWrite(w, 400, map[string]any{"error": "Payment exceeds what this loan owes"})
+			return
+		}
+	case fineWaiver:
+		// A waiver may cover a fine that was already paid; that leaves a
+		// credit to refund.
+		room := target.Assessed - target.Waived
+		if req.Amount == 0 {
+			req.Amount = target.Outstanding
+		}
+		if req.Amount == 0 || req.Amount > room {
+			jsonWrite(w, 400, map[string]any{"error": "Waiver must be between 0 and " + room.String()})
+			return
+		}
+		line.LoanID, line.Amount = target.LoanID, req.Amount
+		lines = append(lines, line)
+	case fineRefund:
+		if req.Amount > -acct.Balance {
+			jsonWrite(w, 400, map[string]any{"error": "Refund exceeds the credit of " + max(-acct.Balance, 0).String()})
+			return
+		}
+		line.Amount = req.Amount
+		lines = append(lines, line)
+	}
+
+	err = store.Atomic(func() error {
+		for _, tx := range lines {
+			tx, err := postFine(tx)
+			if err != nil {
+				return err
+			}
+			if err := recordAudit(r, "fine."+tx.Kind, "fine", tx.ID, nil, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	acct, err = fineAccountFor(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, acct)
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestFineBlock(t *testing.T) {
+	tests := []struct {
+		name      string
+		assessed  Money
+		paid      Money
+		accruing  Money
+		wantBlock bool
+	}{
+		{name: "nothing owed"},
+		{name: "balance at the limit", assessed: 10000},
+		{name: "balance over the limit", assessed: 10001, wantBlock: true},
+		{name: "paid back under the limit", assessed: 15000, paid: 6000},
+		{name: "accruing alone over the limit", accruing: 12000, wantBlock: true},
+		{name: "balance and accruing together over", assessed: 6000, accruing: 5000, wantBlock: true},
+		{name: "balance and accruing together under", assessed: 6000, accruing: 4000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestStore(t)
+			old := fineBlockThreshold
+			fineBlockThreshold = 10000
+			t.Cleanup(func() { fineBlockThreshold = old })
+
+			txs := []FineTx{
+				{ID: "F1", UserID: "U1", Kind: fineAssessed, Amount: tt.assessed},
+				{ID: "F2", UserID: "U1", Kind: finePayment, Amount: tt.paid},
+			}
+			for _, tx := range txs {
+				if err := store.Fines().Create(tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			l := Loan{ID: "L1", ReaderID: "U1", Status: loanOverdue, FineAmount: tt.accruing}
+			if err := store.Loans().Create(l); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := fineBlock("U1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (msg != "") != tt.wantBlock {
+				t.Errorf("fineBlock = %q, want blocked %v", msg, tt.wantBlock)
+			}
+		})
+	}
+}
@@ -7,12 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -26,46 +29,68 @@ type User struct {
 	PasswordHash string `json:"passwordHash"`
 	Role         string `json:"role"`
 	CreatedAt    string `json:"createdAt"`
+	Category     string `json:"category"`
+
+	// Tokens carry the generation they were issued under and cannot be
+	// refreshed once it moves on (password changes, "log out everywhere").
+	TokenGeneration int    `json:"tokenGeneration,omitempty"`
+	ResetTokenHash  string `json:"resetTokenHash,omitempty"`
+	ResetExpiresAt  string `json:"resetExpiresAt,omitempty"`
+
+	// Archived accounts cannot log in or borrow but stay on record for
+	// loan history until purged (archive.go).
+	ArchivedAt    string `json:"archivedAt,omitempty"`
+	ArchiveReason string `json:"archiveReason,omitempty"`
 }
 
+// TotalQty and AvailableQty are derived from the book's copies (copies.go)
+// and kept here so the catalog can be listed without counting them. Author
+// is likewise the byline derived from Contributors (bibliography.go), and
+// ISBN is stored normalized to ISBN-13.
 type Book struct {
-	ID           string  `json:"id"`
-	BookCode     string  `json:"bookCode"`
-	Title        string  `json:"title"`
-	Author       string  `json:"author"`
-	Price        float64 `json:"price"`
-	TotalQty     int     `json:"totalQty"`
-	AvailableQty int     `json:"availableQty"`
-	CreatedAt    string  `json:"createdAt"`
+	ID           string        `json:"id"`
+	BookCode     string        `json:"bookCode"`
+	Title        string        `json:"title"`
+	Author       string        `json:"author"`
+	Contributors []Contributor `json:"contributors"`
+	ISBN         string        `json:"isbn,omitempty"`
+	Publisher    string        `json:"publisher,omitempty"`
+	Year         int           `json:"year,omitempty"`
+	Language     string        `json:"language,omitempty"`
+	Edition      string        `json:"edition,omitempty"`
+	Subjects     []string      `json:"subjects"`
+	Price        Money         `json:"price"`
+	TotalQty     int           `json:"totalQty"`
+	AvailableQty int           `json:"availableQty"`
+	CreatedAt    string        `json:"createdAt"`
+	Category     string        `json:"category"`
+
+	// Archived books leave the catalog but still resolve for loan history
+	// until purged (archive.go).
+	ArchivedAt    string `json:"archivedAt,omitempty"`
+	ArchiveReason string `json:"archiveReason,omitempty"`
 }
 
 type Loan struct {
-	ID         string  `json:"id"`
-	ReaderID   string  `json:"readerId"`
-	BookID     string  `json:"bookId"`
-	LoanDate   string  `json:"loanDate"`
-	DueDate    string  `json:"dueDate"`
-	ReturnDate string  `json:"returnDate"`
-	Status     string  `json:"status"`
-	FineAmount float64 `json:"fineAmount"`
+	ID         string `json:"id"`
+	ReaderID   string `json:"readerId"`
+	BookID     string `json:"bookId"`
+	CopyID     string `json:"copyId"`
+	LoanDate   string `json:"loanDate"`
+	DueDate    string `json:"dueDate"`
+	ReturnDate string `json:"returnDate"`
+	Status     string `json:"status"`
+	FineAmount Money  `json:"fineAmount"`
+	Renewals   int    `json:"renewals"`
+	// CarriedFine is the overdue fine accrued before the last renewal moved
+	// the due date; the scan adds on top of it.
+	CarriedFine Money `json:"carriedFine,omitempty"`
 }
 
-type Database struct {
-	Users []User `json:"users"`
-	Books []Book `json:"books"`
-	Loans []Loan `json:"loans"`
-}
-
-var (
-	dbFile = "data.json"
-	db     Database
-	mu     sync.Mutex
-
-	tokenStore = map[string]string{}
-)
+var mu sync.Mutex
 
 func nowDate() string {
-	return time.Now().Format("2006-01-02")
+	return clock.Now().Format(dateLayout)
 }
 
 func jsonWrite(w http.ResponseWriter, status int, v any) {
@@ -85,24 +110,9 @@ func jsonRead(r *http.Request, dst any) error {
 	return json.Unmarshal(body, dst)
 }
 
-func loadDB() {
-	f, err := os.Open(dbFile)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	_ = json.NewDecoder(f).Decode(&db)
-}
-
-func saveDB() {
-	tmp := dbFile + ".tmp"
-	f, err := os.Create(tmp)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	_ = json.NewEncoder(f).Encode(db)
-	_ = os.Rename(tmp, dbFile)
+func storeError(w http.ResponseWriter, err error) {
+	log.Printf("storage error: %v", err)
+	jsonWrite(w, 500, map[string]any{"error": "Storage error"})
 }
 
 func genID(prefix string, n int) string {
@@ -115,69 +125,49 @@ func genToken() string {
 	return hex.EncodeToString(b)
 }
 
-func findUserByEmail(email string) (*User, int) {
-	for i := range db.Users {
-		if strings.EqualFold(db.Users[i].Email, email) {
-			return &db.Users[i], i
-		}
-	}
-	return nil, -1
-}
-
-func findUserByID(id string) (*User, int) {
-	for i := range db.Users {
-		if db.Users[i].ID == id {
-			return &db.Users[i], i
-		}
-	}
-	return nil, -1
-}
-
-func findBookByID(id string) (*Book, int) {
-	for i := range db.Books {
-		if db.Books[i].ID == id {
-			return &db.Books[i], i
-		}
-	}
-	return nil, -1
-}
-
-func findLoanByID(id string) (*Loan, int) {
-	for i := range db.Loans {
-		if db.Loans[i].ID == id {
-			return &db.Loans[i], i
-		}
+func anyAdminExists() (bool, error) {
+	users, err := store.Users().All()
+	if err != nil {
+		return false, err
 	}
-	return nil, -1
-}
-
-func anyAdminExists() bool {
-	for _, u := range db.Users {
+	for _, u := range users {
 		if u.Role == "admin" {
-			return true
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
+// authUser identifies the caller from the access token alone: its signature,
+// expiry and claims. Nothing is read from the store, so any instance sharing
+// JWT_SECRET can serve the request. The User it returns carries only the ID,
+// role and token generation; handlers that need more read the record.
+// Logging out everywhere, a password change or archiving takes effect at the
+// next refresh (apiRefresh), so a revoked access token lasts at most
+// accessTTL.
 func authUser(r *http.Request) (*User, error) {
-	h := r.Header.Get("Authorization")
-	if !strings.HasPrefix(h, "Bearer ") {
+	token := bearerToken(r)
+	if token == "" {
 		return nil, errors.New("no token")
 	}
-	token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
-	mu.Lock()
-	uid, ok := tokenStore[token]
-	mu.Unlock()
-	if !ok {
-		return nil, errors.New("invalid token")
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		return nil, err
 	}
+	return &User{ID: claims.Subject, Role: claims.Role, TokenGeneration: claims.Gen}, nil
+}
 
-	mu.Lock()
-	defer mu.Unlock()
-	u, _ := findUserByID(uid)
-	if u == nil {
-		return nil, errors.New("user not found")
+// authRecord is the stored record of me, the caller authUser returned, for
+// the few handlers that act on the account itself and so cannot wait for the
+// next refresh: it is nil when the user is gone, archived or logged out since
+// the token was issued. Callers must hold mu.
+func authRecord(me *User) (*User, error) {
+	u, err := store.Users().ByID(me.ID)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	if u.archived() || u.TokenGeneration != me.TokenGeneration {
+		return nil, nil
 	}
 	return u, nil
 }
@@ -193,26 +183,16 @@ func requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		u, err := authUser(r)
-		if err != nil {
-			jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
-			return
-		}
-		if u.Role != "admin" {
-			jsonWrite(w, 403, map[string]any{"error": "Admin only"})
-			return
-		}
-		next(w, r)
-	}
-}
-
 func apiMeta(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
 	defer mu.Unlock()
+	hasAdmin, err := anyAdminExists()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	jsonWrite(w, 200, map[string]any{
-		"needBootstrapAdmin": !anyAdminExists(),
+		"needBootstrapAdmin": !hasAdmin,
 	})
 }
 
@@ -231,43 +211,78 @@ func apiRegister(w http.ResponseWriter, r *http.Request) {
 	}
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
 	req.Role = strings.ToLower(strings.TrimSpace(req.Role))
-	if req.Role != "admin" {
+	if !validRole(req.Role) {
 		req.Role = "reader"
 	}
 	if req.FullName == "" || req.Email == "" || req.Phone == "" || req.Password == "" {
 		jsonWrite(w, 400, map[string]any{"error": "Missing fields"})
 		return
 	}
+	if errs := checkPassword(req.Password, req.Email); len(errs) > 0 {
+		writePasswordErrors(w, errs)
+		return
+	}
 
 	mu.Lock()
 	defer mu.Unlock()
 
-	if u, _ := findUserByEmail(req.Email); u != nil {
+	existing, err := store.Users().ByEmail(req.Email)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if existing != nil {
 		jsonWrite(w, 409, map[string]any{"error": "Email already exists"})
 		return
 	}
 
-	if req.Role == "admin" && anyAdminExists() {
+	hasAdmin, err := anyAdminExists()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	// Anyone may sign up as a reader, and the very first account may be the
+	// bootstrap admin; every other role is handed out by a user manager.
+	bootstrap := req.Role == "admin" && !hasAdmin
+	if req.Role != "reader" && !bootstrap {
 		creator, err := authUser(r)
-		if err != nil || creator.Role != "admin" {
-			jsonWrite(w, 403, map[string]any{"error": "Only admin can create another admin"})
+		if err != nil || !hasPermission(creator, permUsersManage) {
+			jsonWrite(w, 403, map[string]any{"error": "Only a user manager can create staff accounts"})
 			return
 		}
 	}
 
-	hash, _ := bcrypt.GenerateFromPassword([]byte(req.Password), 10)
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 
+	id, err := newID("user")
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	user := User{
-		ID:           genID("U", len(db.Users)+1),
+		ID:           id,
 		FullName:     req.FullName,
 		Email:        req.Email,
 		Phone:        req.Phone,
-		PasswordHash: string(hash),
+		PasswordHash: hash,
 		Role:         req.Role,
 		CreatedAt:    nowDate(),
+		Category:     readerStudent,
+	}
+	err = store.Atomic(func() error {
+		if err := store.Users().Create(user); err != nil {
+			return err
+		}
+		return recordAudit(r, "user.register", "user", user.ID, nil, user)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
 	}
-	db.Users = append(db.Users, user)
-	saveDB()
 
 	jsonWrite(w, 200, map[string]any{
 		"ok":   true,
@@ -286,73 +301,205 @@ func apiLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	ip := clientIP(r)
+	acctKey, addrKey := accountKey(req.Email), ipKey(ip)
 
 	mu.Lock()
-	u, _ := findUserByEmail(req.Email)
+	now := time.Now().UTC()
+	wait, err := loginBlockedFor(acctKey, now)
+	if err == nil {
+		var ipWait time.Duration
+		ipWait, err = loginBlockedFor(addrKey, now)
+		wait = max(wait, ipWait)
+	}
+	var u *User
+	if err == nil && wait == 0 {
+		u, err = store.Users().ByEmail(req.Email)
+	}
+	// The attempt is counted before mu is released, not after the slow
+	// password check, or a burst of parallel guesses would all get through.
+	if err == nil && wait == 0 {
+		err = store.Atomic(func() error {
+			if err := reserveLoginAttempt(acctKey, accountMaxFailures, now, ip); err != nil {
+				return err
+			}
+			return reserveLoginAttempt(addrKey, ipMaxFailures, now, "")
+		})
+	}
 	mu.Unlock()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
 
-	if u == nil {
+	// Unknown emails still pay for a bcrypt comparison so response times do
+	// not reveal which accounts exist.
+	hash := dummyPasswordHash
+	if u != nil {
+		hash = []byte(u.PasswordHash)
+	}
+	ok := bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) == nil && u != nil && !u.archived()
+
+	// BCRYPT_COST was raised since this hash was made; the plaintext is at
+	// hand now, so upgrade it. The new hash is made before mu is taken.
+	var rehash string
+	if ok && needsRehash(u.PasswordHash) {
+		rehash, _ = hashPassword(req.Password)
+	}
+
+	mu.Lock()
+	if !ok {
+		now := time.Now().UTC()
+		err := store.Atomic(func() error {
+			if err := failLoginAttempt(acctKey, accountMaxFailures, now); err != nil {
+				return err
+			}
+			return failLoginAttempt(addrKey, ipMaxFailures, now)
+		})
+		mu.Unlock()
+		if err != nil {
+			storeError(w, err)
+			return
+		}
 		jsonWrite(w, 401, map[string]any{"error": "Invalid email/password"})
 		return
 	}
-	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.Password)) != nil {
+	err = store.Atomic(func() error {
+		if err := clearLoginFailures(acctKey); err != nil {
+			return err
+		}
+		return releaseLoginAttempt(addrKey, ipMaxFailures)
+	})
+	if err != nil {
+		mu.Unlock()
+		storeError(w, err)
+		return
+	}
+	// u was read before the password check, and saving it would undo
+	// whatever changed since: carry on with the current record, as long as
+	// its password is still the one that was checked.
+	fresh, err := store.Users().ByID(u.ID)
+	if err != nil {
+		mu.Unlock()
+		storeError(w, err)
+		return
+	}
+	if fresh == nil || fresh.archived() || fresh.PasswordHash != u.PasswordHash {
+		mu.Unlock()
 		jsonWrite(w, 401, map[string]any{"error": "Invalid email/password"})
 		return
 	}
-
-	token := genToken()
-	mu.Lock()
-	tokenStore[token] = u.ID
+	u = fresh
+	// Failure to store the upgraded hash must not block the login.
+	if rehash != "" {
+		u.PasswordHash = rehash
+		if err := store.Users().Update(*u); err != nil {
+			log.Printf("rehash password for %s: %v", u.ID, err)
+		}
+	}
+	if err := purgeExpiredSessions(time.Now().UTC()); err != nil {
+		log.Printf("purge sessions: %v", err)
+	}
+	pair, err := issueTokens(u, r, "", time.Time{})
 	mu.Unlock()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 
 	jsonWrite(w, 200, map[string]any{
-		"ok":    true,
-		"token": token,
-		"user":  map[string]any{"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role},
+		"ok":               true,
+		"token":            pair.AccessToken,
+		"accessToken":      pair.AccessToken,
+		"accessExpiresAt":  pair.AccessExpiresAt,
+		"refreshToken":     pair.RefreshToken,
+		"refreshExpiresAt": pair.RefreshExpiresAt,
+		"user":             map[string]any{"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role},
 	})
 }
 
 func apiMe(w http.ResponseWriter, r *http.Request) {
-	u, err := authUser(r)
+	me, err := authUser(r)
 	if err != nil {
 		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
 		return
 	}
+	mu.Lock()
+	u, err := store.Users().ByID(me.ID)
+	mu.Unlock()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	perms := rolePermissions[u.Role]
 	jsonWrite(w, 200, map[string]any{
-		"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role,
+		"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role, "permissions": perms,
 	})
 }
 
+// userView is how user records are shown to staff: without secrets.
+func userView(u *User) map[string]any {
+	v := map[string]any{
+		"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role, "createdAt": u.CreatedAt,
+		"category": readerCategoryOf(u),
+	}
+	if u.archived() {
+		v["archivedAt"], v["archiveReason"] = u.ArchivedAt, u.ArchiveReason
+	}
+	return v
+}
+
 func apiListUsers(w http.ResponseWriter, r *http.Request) {
 	role := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("role")))
+	keep, msg := archivedFilter(r.URL.Query())
+	if msg != "" {
+		jsonWrite(w, 400, map[string]any{"error": msg})
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 
+	users, err := store.Users().All()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	out := []any{}
-	for _, u := range db.Users {
-		if role != "" && u.Role != role {
+	for _, u := range users {
+		if role != "" && u.Role != role || !keep(u.archived()) {
 			continue
 		}
-		out = append(out, map[string]any{
-			"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role, "createdAt": u.CreatedAt,
-		})
+		out = append(out, userView(&u))
 	}
 	jsonWrite(w, 200, out)
 }
 
-func apiGetBooks(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
-	jsonWrite(w, 200, db.Books)
-}
-
 func apiCreateBook(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
-		BookCode string  `json:"bookCode"`
-		Title    string  `json:"title"`
-		Author   string  `json:"author"`
-		Price    float64 `json:"price"`
-		TotalQty int     `json:"totalQty"`
+		BookCode string `json:"bookCode"`
+		Title    string `json:"title"`
+		// Author is shorthand for a single author contributor.
+		Author       string        `json:"author"`
+		Contributors []Contributor `json:"contributors"`
+		ISBN         string        `json:"isbn"`
+		Publisher    string        `json:"publisher"`
+		Year         int           `json:"year"`
+		Language     string        `json:"language"`
+		Edition      string        `json:"edition"`
+		Subjects     []string      `json:"subjects"`
+		Price        Money         `json:"price"`
+		// TotalQty copies are shelved with generated barcodes.
+		TotalQty int    `json:"totalQty"`
+		Location string `json:"location"`
+		Category string `json:"category"`
 	}
 	var req Req
 	if err := jsonRead(r, &req); err != nil {
@@ -360,33 +507,108 @@ func apiCreateBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.BookCode = strings.TrimSpace(req.BookCode)
-	if req.BookCode == "" || req.Title == "" || req.Author == "" || req.TotalQty <= 0 {
+	if req.BookCode == "" || req.Title == "" || req.TotalQty < 0 {
 		jsonWrite(w, 400, map[string]any{"error": "Missing/invalid fields"})
 		return
 	}
+	if len(req.Contributors) == 0 && req.Author != "" {
+		req.Contributors = []Contributor{{Name: req.Author, Role: roleAuthor}}
+	}
+	if req.ISBN != "" {
+		isbn, err := normalizeISBN(req.ISBN)
+		if err != nil {
+			jsonWrite(w, 400, map[string]any{"error": err.Error()})
+			return
+		}
+		req.ISBN = isbn
+	}
+	if !checkYear(req.Year) {
+		jsonWrite(w, 400, map[string]any{"error": "year must be between 1450 and next year"})
+		return
+	}
+	if req.Category == "" {
+		req.Category = bookStandard
+	}
+	if !validCategory(bookCategories, req.Category) {
+		jsonWrite(w, 400, map[string]any{"error": "Unknown category"})
+		return
+	}
 
 	mu.Lock()
 	defer mu.Unlock()
 
-	for _, b := range db.Books {
-		if strings.EqualFold(b.BookCode, req.BookCode) {
-			jsonWrite(w, 409, map[string]any{"error": "bookCode already exists"})
-			return
-		}
+	existing, err := store.Books().ByCode(req.BookCode)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if existing != nil {
+		jsonWrite(w, 409, map[string]any{"error": "bookCode already exists"})
+		return
+	}
+	taken, err := isbnTaken(req.ISBN, "")
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if taken {
+		jsonWrite(w, 409, map[string]any{"error": "isbn already exists"})
+		return
+	}
+	contributors, msg, err := checkContributors(req.Contributors)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if msg != "" {
+		jsonWrite(w, 400, map[string]any{"error": msg})
+		return
 	}
 
-	book := Book{
-		ID:           genID("B", len(db.Books)+1),
-		BookCode:     req.BookCode,
-		Title:        req.Title,
-		Author:       req.Author,
-		Price:        req.Price,
-		TotalQty:     req.TotalQty,
-		AvailableQty: req.TotalQty,
-		CreatedAt:    nowDate(),
+	id, err := newID("book")
+	if err != nil {
+		storeError(w, err)
+		return
 	}
-	db.Books = append(db.Books, book)
-	saveDB()
+	book := &Book{
+		ID:        id,
+		BookCode:  req.BookCode,
+		Title:     req.Title,
+		ISBN:      req.ISBN,
+		Publisher: strings.TrimSpace(req.Publisher),
+		Year:      req.Year,
+		Language:  strings.TrimSpace(req.Language),
+		Edition:   strings.TrimSpace(req.Edition),
+		Subjects:  cleanSubjects(req.Subjects),
+		Price:     req.Price,
+		CreatedAt: nowDate(),
+		Category:  req.Category,
+	}
+	err = store.Atomic(func() error {
+		if err := linkAuthors(contributors); err != nil {
+			return err
+		}
+		book.Contributors = contributors
+		book.Author = byline(contributors)
+		if err := store.Books().Create(*book); err != nil {
+			return err
+		}
+		for i := 0; i < req.TotalQty; i++ {
+			if _, err := addCopy(book, Copy{Location: req.Location}); err != nil {
+				return err
+			}
+		}
+		var err error
+		if book, err = syncBookCounts(book.ID); err != nil {
+			return err
+		}
+		return recordAudit(r, "book.create", "book", book.ID, nil, book)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	catalog.put(*book)
 	jsonWrite(w, 200, book)
 }
 
@@ -399,176 +621,392 @@ func apiUpdateBook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type Req struct {
-		Title    *string  `json:"title"`
-		Author   *string  `json:"author"`
-		Price    *float64 `json:"price"`
-		TotalQty *int     `json:"totalQty"`
+		Title        *string        `json:"title"`
+		Author       *string        `json:"author"`
+		Contributors *[]Contributor `json:"contributors"`
+		ISBN         *string        `json:"isbn"`
+		Publisher    *string        `json:"publisher"`
+		Year         *int           `json:"year"`
+		Language     *string        `json:"language"`
+		Edition      *string        `json:"edition"`
+		Subjects     *[]string      `json:"subjects"`
+		Price        *Money         `json:"price"`
+		TotalQty     *int           `json:"totalQty"`
+		Category     *string        `json:"category"`
 	}
 	var req Req
 	if err := jsonRead(r, &req); err != nil {
 		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
 		return
 	}
+	if req.Author != nil && req.Contributors != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Send either author or contributors, not both"})
+		return
+	}
+	if req.Author != nil {
+		req.Contributors = &[]Contributor{{Name: *req.Author, Role: roleAuthor}}
+	}
+	if req.ISBN != nil && *req.ISBN != "" {
+		isbn, err := normalizeISBN(*req.ISBN)
+		if err != nil {
+			jsonWrite(w, 400, map[string]any{"error": err.Error()})
+			return
+		}
+		req.ISBN = &isbn
+	}
+	if req.Year != nil && !checkYear(*req.Year) {
+		jsonWrite(w, 400, map[string]any{"error": "year must be between 1450 and next year"})
+		return
+	}
 
 	mu.Lock()
 	defer mu.Unlock()
 
-	book, idx := findBookByID(id)
+	book, err := store.Books().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	if book == nil {
 		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
 		return
 	}
+	before := *book
 
-	if req.TotalQty != nil {
-		newTotal := *req.TotalQty
-		if newTotal < 0 {
-			jsonWrite(w, 400, map[string]any{"error": "totalQty invalid"})
+	// Stock changes go through copies so we always know which item left.
+	if req.TotalQty != nil && *req.TotalQty != book.TotalQty {
+		jsonWrite(w, 400, map[string]any{"error": "totalQty follows the copies; add or withdraw copies instead"})
+		return
+	}
+	if req.Title != nil {
+		book.Title = *req.Title
+	}
+	var contributors []Contributor
+	if req.Contributors != nil {
+		var msg string
+		contributors, msg, err = checkContributors(*req.Contributors)
+		if err != nil {
+			storeError(w, err)
 			return
 		}
-		diff := newTotal - db.Books[idx].TotalQty
-		db.Books[idx].TotalQty = newTotal
-		db.Books[idx].AvailableQty += diff
-		if db.Books[idx].AvailableQty < 0 {
-			db.Books[idx].AvailableQty = 0
+		if msg != "" {
+			jsonWrite(w, 400, map[string]any{"error": msg})
+			return
 		}
 	}
-	if req.Title != nil {
-		db.Books[idx].Title = *req.Title
+	if req.ISBN != nil {
+		taken, err := isbnTaken(*req.ISBN, book.ID)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if taken {
+			jsonWrite(w, 409, map[string]any{"error": "isbn already exists"})
+			return
+		}
+		book.ISBN = *req.ISBN
 	}
-	if req.Author != nil {
-		db.Books[idx].Author = *req.Author
+	if req.Publisher != nil {
+		book.Publisher = strings.TrimSpace(*req.Publisher)
 	}
-	if req.Price != nil {
-		db.Books[idx].Price = *req.Price
+	if req.Year != nil {
+		book.Year = *req.Year
 	}
-
-	saveDB()
-	jsonWrite(w, 200, db.Books[idx])
-}
-
-func apiDeleteBook(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/books/")
-	if id == "" {
-		jsonWrite(w, 400, map[string]any{"error": "Missing id"})
-		return
+	if req.Language != nil {
+		book.Language = strings.TrimSpace(*req.Language)
 	}
-
-	mu.Lock()
-	defer mu.Unlock()
-
-	_, idx := findBookByID(id)
-	if idx == -1 {
-		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
-		return
+	if req.Edition != nil {
+		book.Edition = strings.TrimSpace(*req.Edition)
 	}
-
-	for _, l := range db.Loans {
-		if l.BookID == id && l.Status == "borrowed" {
-			jsonWrite(w, 400, map[string]any{"error": "Cannot delete: book is borrowed now"})
+	if req.Subjects != nil {
+		book.Subjects = cleanSubjects(*req.Subjects)
+	}
+	if req.Price != nil {
+		book.Price = *req.Price
+	}
+	if req.Category != nil {
+		if !validCategory(bookCategories, *req.Category) {
+			jsonWrite(w, 400, map[string]any{"error": "Unknown category"})
 			return
 		}
+		book.Category = *req.Category
 	}
 
-	db.Books = append(db.Books[:idx], db.Books[idx+1:]...)
-	saveDB()
-	jsonWrite(w, 200, map[string]any{"ok": true})
+	err = store.Atomic(func() error {
+		if contributors != nil {
+			if err := linkAuthors(contributors); err != nil {
+				return err
+			}
+			book.Contributors = contributors
+			book.Author = byline(contributors)
+		}
+		if err := store.Books().Update(*book); err != nil {
+			return err
+		}
+		return recordAudit(r, "book.update", "book", book.ID, before, book)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	catalog.put(*book)
+	jsonWrite(w, 200, book)
 }
 
 func apiBorrow(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
 		ReaderID string `json:"readerId"`
-		BookID   string `json:"bookId"`
-		DueDate  string `json:"dueDate"`
+		// Barcode names the copy handed out; with only BookID any copy on
+		// the shelf is taken.
+		Barcode string `json:"barcode"`
+		BookID  string `json:"bookId"`
+		DueDate string `json:"dueDate"`
 	}
 	var req Req
 	if err := jsonRead(r, &req); err != nil {
 		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
 		return
 	}
-	if req.ReaderID == "" || req.BookID == "" {
-		jsonWrite(w, 400, map[string]any{"error": "Missing readerId/bookId"})
+	req.Barcode = strings.TrimSpace(req.Barcode)
+	if req.ReaderID == "" || (req.BookID == "" && req.Barcode == "") {
+		jsonWrite(w, 400, map[string]any{"error": "Missing readerId/barcode"})
 		return
 	}
 
 	mu.Lock()
 	defer mu.Unlock()
 
-	reader, _ := findUserByID(req.ReaderID)
+	reader, err := store.Users().ByID(req.ReaderID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	if reader == nil || reader.Role != "reader" {
 		jsonWrite(w, 404, map[string]any{"error": "Reader not found"})
 		return
 	}
-	book, bidx := findBookByID(req.BookID)
-	if book == nil {
-		jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+	if reader.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Reader account is archived"})
+		return
+	}
+	block, err := fineBlock(reader.ID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if block != "" {
+		policyError(w, 403, codeFinesOutstanding, block)
+		return
+	}
+	if err := expireHolds(); err != nil {
+		storeError(w, err)
+		return
+	}
+	if req.Barcode == "" {
+		book, err := store.Books().ByID(req.BookID)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if book == nil {
+			jsonWrite(w, 404, map[string]any{"error": "Book not found"})
+			return
+		}
+	}
+	c, hold, msg, err := copyForLoan(req.ReaderID, req.Barcode, req.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if c == nil {
+		status := 400
+		if msg == "Copy not found" {
+			status = 404
+		}
+		jsonWrite(w, status, map[string]any{"error": msg})
+		return
+	}
+	book, err := store.Books().ByID(c.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if book != nil && book.archived() {
+		jsonWrite(w, 400, map[string]any{"error": "Book is archived"})
 		return
 	}
-	if db.Books[bidx].AvailableQty <= 0 {
-		jsonWrite(w, 400, map[string]any{"error": "Book out of stock"})
+	terms, code, msg, err := checkBorrow(reader, book)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if code != "" {
+		policyError(w, 403, code, msg)
 		return
 	}
 
-	due := req.DueDate
-	if due == "" {
-		due = time.Now().Add(7 * 24 * time.Hour).Format("2006-01-02")
+	// Due dates, given or computed, land on a day the library is open.
+	cal, err := loadCalendar()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	due := cal.dueDate(today(), terms.LoanDays)
+	if req.DueDate != "" {
+		d, err := parseDate(req.DueDate)
+		if err != nil {
+			jsonWrite(w, 400, map[string]any{"error": "dueDate must be YYYY-MM-DD"})
+			return
+		}
+		due = cal.dueDate(d, 0)
 	}
 
-	db.Books[bidx].AvailableQty--
+	c.Status = copyOnLoan
 
-	loan := Loan{
-		ID:         genID("L", len(db.Loans)+1),
-		ReaderID:   req.ReaderID,
-		BookID:     req.BookID,
-		LoanDate:   nowDate(),
-		DueDate:    due,
-		ReturnDate: "",
-		Status:     "borrowed",
-		FineAmount: 0,
+	var loan Loan
+	err = store.Atomic(func() error {
+		id, err := newID("loan")
+		if err != nil {
+			return err
+		}
+		loan = Loan{
+			ID:         id,
+			ReaderID:   req.ReaderID,
+			BookID:     c.BookID,
+			CopyID:     c.ID,
+			LoanDate:   nowDate(),
+			DueDate:    due,
+			ReturnDate: "",
+			Status:     loanBorrowed,
+			FineAmount: 0,
+		}
+		if err := store.Copies().Update(*c); err != nil {
+			return err
+		}
+		if hold != nil {
+			hold.Status = holdFulfilled
+			hold.LoanID = loan.ID
+			hold.ClosedAt = nowDate()
+			if err := store.Holds().Update(*hold); err != nil {
+				return err
+			}
+		}
+		if _, err := syncBookCounts(c.BookID); err != nil {
+			return err
+		}
+		if err := store.Loans().Create(loan); err != nil {
+			return err
+		}
+		return recordAudit(r, "loan.borrow", "loan", loan.ID, nil, loan)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
 	}
-	db.Loans = append(db.Loans, loan)
-	saveDB()
 	jsonWrite(w, 200, loan)
 }
 
 func apiReturn(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
-		LoanID string `json:"loanId"`
+		LoanID  string `json:"loanId"`
+		Barcode string `json:"barcode"`
+		// Condition optionally records the state the copy came back in.
+		Condition string `json:"condition"`
 	}
 	var req Req
 	if err := jsonRead(r, &req); err != nil {
 		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
 		return
 	}
+	if req.Condition != "" && !validCondition(req.Condition) {
+		jsonWrite(w, 400, map[string]any{"error": "Unknown condition"})
+		return
+	}
 
 	mu.Lock()
 	defer mu.Unlock()
 
-	loan, lidx := findLoanByID(req.LoanID)
+	loan, err := findActiveLoan(req.LoanID, strings.TrimSpace(req.Barcode))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	if loan == nil {
 		jsonWrite(w, 404, map[string]any{"error": "Loan not found"})
 		return
 	}
-	if db.Loans[lidx].Status != "borrowed" {
+	if !loan.active() {
 		jsonWrite(w, 400, map[string]any{"error": "Loan is not active"})
 		return
 	}
+	before := *loan
+	book, err := store.Books().ByID(loan.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	var price Money
+	if book != nil {
+		price = book.Price
+	}
+	terms, err := termsForLoan(*loan, book)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 
-	db.Loans[lidx].Status = "returned"
-	db.Loans[lidx].ReturnDate = nowDate()
-
-	_, bidx := findBookByID(db.Loans[lidx].BookID)
-	if bidx != -1 {
-		db.Books[bidx].AvailableQty++
+	// Settle the overdue fine as of today; the scan may be up to an
+	// interval behind.
+	cal, err := loadCalendar()
+	if err != nil {
+		storeError(w, err)
+		return
 	}
+	loan.FineAmount = overdueFine(*loan, cal.daysLate(*loan, today()), terms.FinePerDay, price)
+	loan.Status = loanReturned
+	loan.ReturnDate = nowDate()
 
-	saveDB()
-	jsonWrite(w, 200, db.Loans[lidx])
+	var ready *Hold
+	err = store.Atomic(func() error {
+		c, err := store.Copies().ByID(loan.CopyID)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			if req.Condition != "" {
+				c.Condition = req.Condition
+			}
+			// The copy goes to the next reader in the hold queue, if any.
+			if ready, err = promoteHold(c); err != nil {
+				return err
+			}
+		}
+		if _, err := syncBookCounts(loan.BookID); err != nil {
+			return err
+		}
+		if err := assessLoanFine(*loan, "overdue"); err != nil {
+			return err
+		}
+		if err := store.Loans().Update(*loan); err != nil {
+			return err
+		}
+		return recordAudit(r, "loan.return", "loan", loan.ID, before, loan)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if ready != nil {
+		notifyHoldsReady(*ready)
+	}
+	jsonWrite(w, 200, loan)
 }
 
 func apiLost(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
-		LoanID     string   `json:"loanId"`
-		FineAmount *float64 `json:"fineAmount"`
+		LoanID     string `json:"loanId"`
+		Barcode    string `json:"barcode"`
+		FineAmount *Money `json:"fineAmount"`
 	}
 	var req Req
 	if err := jsonRead(r, &req); err != nil {
@@ -579,58 +1017,92 @@ func apiLost(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	loan, lidx := findLoanByID(req.LoanID)
+	loan, err := findActiveLoan(req.LoanID, strings.TrimSpace(req.Barcode))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	if loan == nil {
 		jsonWrite(w, 404, map[string]any{"error": "Loan not found"})
 		return
 	}
-	if db.Loans[lidx].Status != "borrowed" {
+	if !loan.active() {
 		jsonWrite(w, 400, map[string]any{"error": "Loan is not active"})
 		return
 	}
 
-	fine := 0.0
-	book, bidx := findBookByID(db.Loans[lidx].BookID)
+	book, err := store.Books().ByID(loan.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	var fine Money
 	if req.FineAmount != nil {
+		if *req.FineAmount < 0 {
+			jsonWrite(w, 400, map[string]any{"error": "fineAmount must not be negative"})
+			return
+		}
 		fine = *req.FineAmount
 	} else if book != nil {
 		fine = book.Price
 	}
 
-	db.Loans[lidx].Status = "lost"
-	db.Loans[lidx].ReturnDate = nowDate()
-	db.Loans[lidx].FineAmount = fine
-
-	if bidx != -1 && db.Books[bidx].TotalQty > 0 {
-		db.Books[bidx].TotalQty--
+	before := *loan
+	loan.Status = loanLost
+	loan.ReturnDate = nowDate()
+	loan.FineAmount = fine
 
-		if db.Books[bidx].AvailableQty > db.Books[bidx].TotalQty {
-			db.Books[bidx].AvailableQty = db.Books[bidx].TotalQty
+	err = store.Atomic(func() error {
+		if err := markCopyLost(loan.CopyID); err != nil {
+			return err
+		}
+		if _, err := syncBookCounts(loan.BookID); err != nil {
+			return err
 		}
+		if err := assessLoanFine(*loan, "lost"); err != nil {
+			return err
+		}
+		if err := store.Loans().Update(*loan); err != nil {
+			return err
+		}
+		return recordAudit(r, "loan.lost", "loan", loan.ID, before, loan)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
 	}
-
-	saveDB()
-	jsonWrite(w, 200, db.Loans[lidx])
+	jsonWrite(w, 200, loan)
 }
 
-func apiListLoans(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
+// LoanView is a loan joined with the reader, book and copy it refers to, as
+// the staff loan list (and its CSV export) shows it.
+type LoanView struct {
+	Loan
+	ReaderName  string `json:"readerName"`
+	ReaderPhone string `json:"readerPhone"`
+	ReaderEmail string `json:"readerEmail"`
+	BookCode    string `json:"bookCode"`
+	BookTitle   string `json:"bookTitle"`
+	BookAuthor  string `json:"bookAuthor"`
+	Barcode     string `json:"barcode"`
+}
 
-	type LoanView struct {
-		Loan
-		ReaderName  string `json:"readerName"`
-		ReaderPhone string `json:"readerPhone"`
-		ReaderEmail string `json:"readerEmail"`
-		BookCode    string `json:"bookCode"`
-		BookTitle   string `json:"bookTitle"`
-		BookAuthor  string `json:"bookAuthor"`
+// loanViews joins every loan. Callers must hold mu.
+func loanViews() ([]LoanView, error) {
+	loans, err := store.Loans().All()
+	if err != nil {
+		return nil, err
 	}
-
 	out := []LoanView{}
-	for _, l := range db.Loans {
-		reader, _ := findUserByID(l.ReaderID)
-		book, _ := findBookByID(l.BookID)
+	for _, l := range loans {
+		reader, err := store.Users().ByID(l.ReaderID)
+		if err != nil {
+			return nil, err
+		}
+		book, err := store.Books().ByID(l.BookID)
+		if err != nil {
+			return nil, err
+		}
 		v := LoanView{Loan: l}
 		if reader != nil {
 			v.ReaderName = reader.FullName
@@ -642,9 +1114,29 @@ func apiListLoans(w http.ResponseWriter, r *http.Request) {
 			v.BookTitle = book.Title
 			v.BookAuthor = book.Author
 		}
+		if l.CopyID != "" {
+			c, err := store.Copies().ByID(l.CopyID)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				v.Barcode = c.Barcode
+			}
+		}
 		out = append(out, v)
 	}
+	return out, nil
+}
+
+func apiListLoans(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
 
+	out, err := loanViews()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	jsonWrite(w, 200, out)
 }
 
@@ -662,14 +1154,20 @@ func apiMyLoans(w http.ResponseWriter, r *http.Request) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	loans, err := store.Loans().ByReader(u.ID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
 	out := []any{}
-	for _, l := range db.Loans {
-		if l.ReaderID != u.ID {
-			continue
+	for _, l := range loans {
+		book, err := store.Books().ByID(l.BookID)
+		if err != nil {
+			storeError(w, err)
+			return
 		}
-		book, _ := findBookByID(l.BookID)
 		out = append(out, map[string]any{
-			"id": l.ID, "status": l.Status, "loanDate": l.LoanDate, "dueDate": l.DueDate, "returnDate": l.ReturnDate, "fineAmount": l.FineAmount,
+			"id": l.ID, "status": l.Status, "loanDate": l.LoanDate, "dueDate": l.DueDate, "returnDate": l.ReturnDate, "fineAmount": l.FineAmount, "renewals": l.Renewals,
 			"book": book,
 		})
 	}
@@ -692,20 +1190,58 @@ func booksHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if r.Method == "POST" {
-			requireAdmin(apiCreateBook)(w, r)
+			requirePermission(permBooksWrite, apiCreateBook)(w, r)
 			return
 		}
 		jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
 		return
 	}
 
+	if r.URL.Path == "/api/books/import" {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permBooksWrite, apiImportMARC)(w, r)
+		return
+	}
+	if r.URL.Path == "/api/books/export" {
+		if !method(w, r, "GET") {
+			return
+		}
+		requirePermission(permBooksWrite, apiExportMARC)(w, r)
+		return
+	}
+
 	if strings.HasPrefix(r.URL.Path, "/api/books/") {
+		if strings.HasSuffix(r.URL.Path, "/restore") || strings.HasSuffix(r.URL.Path, "/purge") {
+			if !method(w, r, "POST") {
+				return
+			}
+			if strings.HasSuffix(r.URL.Path, "/restore") {
+				requirePermission(permArchiveManage, apiRestoreBook)(w, r)
+			} else {
+				requirePermission(permArchiveManage, apiPurgeBook)(w, r)
+			}
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/copies") {
+			if r.Method == "GET" {
+				requireAuth(apiListCopies)(w, r)
+				return
+			}
+			if r.Method == "POST" {
+				requirePermission(permBooksWrite, apiAddCopy)(w, r)
+				return
+			}
+			jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
+			return
+		}
 		if r.Method == "PATCH" {
-			requireAdmin(apiUpdateBook)(w, r)
+			requirePermission(permBooksWrite, apiUpdateBook)(w, r)
 			return
 		}
 		if r.Method == "DELETE" {
-			requireAdmin(apiDeleteBook)(w, r)
+			requirePermission(permBooksWrite, apiArchiveBook)(w, r)
 			return
 		}
 		jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
@@ -716,7 +1252,41 @@ func booksHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	loadDB()
+	loadSessionConfig()
+	loadTokenConfig()
+	loadPasswordPolicy()
+	loadThrottleConfig()
+	loadPasswordConfig()
+	loadHoldConfig()
+	loadArchiveConfig()
+	loadRenewalConfig()
+	loadFineConfig()
+	loadLedgerConfig()
+	loadLendingConfig()
+	loadNotifier()
+
+	var err error
+	store, err = openStore()
+	if err != nil {
+		log.Fatalf("open storage: %v", err)
+	}
+	if err := rebuildCatalog(); err != nil {
+		log.Fatalf("index catalog: %v", err)
+	}
+
+	startScheduler()
+
+	// Flush the store (the JSON backend compacts its journal) on shutdown.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		mu.Lock()
+		if err := store.Close(); err != nil {
+			log.Printf("close storage: %v", err)
+		}
+		os.Exit(0)
+	}()
 
 	publicDir := filepath.Join(".", "public")
 	fs := http.FileServer(http.Dir(publicDir))
@@ -741,9 +1311,39 @@ func main() {
 		}
 		apiLogin(w, r)
 	})
+	http.HandleFunc("/api/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "POST") {
+			return
+		}
+		apiRefresh(w, r)
+	})
+	http.HandleFunc("/api/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "POST") {
+			return
+		}
+		apiLogout(w, r)
+	})
+	http.HandleFunc("/api/auth/logout-all", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "POST") {
+			return
+		}
+		apiLogoutAll(w, r)
+	})
+	http.HandleFunc("/api/auth/reset", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "POST") {
+			return
+		}
+		apiResetPassword(w, r)
+	})
 	http.HandleFunc("/api/me", requireAuth(apiMe))
+	http.HandleFunc("/api/me/password", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "POST") {
+			return
+		}
+		apiChangePassword(w, r)
+	}))
 
-	http.HandleFunc("/api/users", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/users", requirePermission(permUsersRead, func(w http.ResponseWriter, r *http.Request) {
 		if !method(w, r, "GET") {
 			return
 		}
@@ -753,36 +1353,76 @@ func main() {
 	http.HandleFunc("/api/books", booksHandler)
 	http.HandleFunc("/api/books/", booksHandler)
 
-	http.HandleFunc("/api/loans", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/copies", copiesHandler)
+	http.HandleFunc("/api/copies/", copiesHandler)
+	http.HandleFunc("/api/authors", authorsHandler)
+	http.HandleFunc("/api/authors/", authorsHandler)
+
+	http.HandleFunc("/api/users/", usersHandler)
+	http.HandleFunc("/api/lending-rules", lendingRulesHandler)
+	http.HandleFunc("/api/lending-rules/", lendingRulesHandler)
+	http.HandleFunc("/api/calendar", calendarHandler)
+	http.HandleFunc("/api/calendar/", calendarHandler)
+	http.HandleFunc("/api/csv/", csvHandler)
+	http.HandleFunc("/api/audit", auditHandler)
+	http.HandleFunc("/api/audit/", auditHandler)
+	http.HandleFunc("/api/reports/", requirePermission(permReportsRead, func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "GET") {
+			return
+		}
+		apiReport(w, r)
+	}))
+	http.HandleFunc("/api/roles", requirePermission(permUsersManage, func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "GET") {
+			return
+		}
+		apiListRoles(w, r)
+	}))
+
+	http.HandleFunc("/api/loans", requirePermission(permLoansRead, func(w http.ResponseWriter, r *http.Request) {
 		if !method(w, r, "GET") {
 			return
 		}
 		apiListLoans(w, r)
 	}))
-	http.HandleFunc("/api/loans/borrow", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/loans/borrow", requirePermission(permLoansIssue, func(w http.ResponseWriter, r *http.Request) {
 		if !method(w, r, "POST") {
 			return
 		}
 		apiBorrow(w, r)
 	}))
-	http.HandleFunc("/api/loans/return", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/loans/return", requirePermission(permLoansIssue, func(w http.ResponseWriter, r *http.Request) {
 		if !method(w, r, "POST") {
 			return
 		}
 		apiReturn(w, r)
 	}))
-	http.HandleFunc("/api/loans/lost", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/loans/lost", requirePermission(permLoansMarkLost, func(w http.ResponseWriter, r *http.Request) {
 		if !method(w, r, "POST") {
 			return
 		}
 		apiLost(w, r)
 	}))
+	http.HandleFunc("/api/loans/renew", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "POST") {
+			return
+		}
+		apiRenew(w, r)
+	}))
+	http.HandleFunc("/api/holds", holdsHandler)
+	http.HandleFunc("/api/holds/", holdsHandler)
 	http.HandleFunc("/api/myloans", requireAuth(func(w http.ResponseWriter, r *http.Request) {
 		if !method(w, r, "GET") {
 			return
 		}
 		apiMyLoans(w, r)
 	}))
+	http.HandleFunc("/api/myfines", requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "GET") {
+			return
+		}
+		apiMyFines(w, r)
+	}))
 
 	port := 8080
 	if p := os.Getenv("PORT"); p != "" {
@@ -792,5 +1432,7 @@ func main() {
 	}
 
 	fmt.Printf("✅ Library app running: http://localhost:%d\n", port)
-	_ = http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock stuck at a chosen time.
+type fakeClock struct{ t time.Time }
+
+func (c fakeClock) Now() time.Time { return c.t }
+
+// setClock points the clock at day (a "2006-01-02" date) for the rest of the
+// test.
+func setClock(tb testing.TB, day string) {
+	tb.Helper()
+	t, err := parseDate(day)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	old := clock
+	clock = fakeClock{t.Add(12 * time.Hour)}
+	tb.Cleanup(func() { clock = old })
+}
+
+// openTestStore makes an empty JSON store in a temporary directory the global
+// store for the rest of the test.
+func openTestStore(tb testing.TB) *jsonStore {
+	tb.Helper()
+	s, err := openJSONStore(tb.TempDir() + "/data.json")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	old := store
+	store = s
+	tb.Cleanup(func() {
+		store = old
+		s.Close()
+	})
+	return s
+}
+
+// authRequest builds a request carrying a fresh access token for u.
+func authRequest(tb testing.TB, u *User, method, path, body string) *http.Request {
+	tb.Helper()
+	if jwtKey == nil {
+		jwtKey = []byte("test key")
+	}
+	token, _, err := issueAccessToken(u, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// call runs handler on r and returns the recorded response.
+func call(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
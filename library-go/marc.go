@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// marcRecord is a MARC 21 bibliographic record, read from or written to
+// either ISO 2709 or MARCXML.
+type marcRecord struct {
+	Leader string
+	Fields []marcField
+}
+
+// marcField is one variable field. Control fields (001-009) carry Value;
+// data fields carry indicators and subfields.
+type marcField struct {
+	Tag        string
+	Ind1, Ind2 byte
+	Value      string
+	Subfields  []marcSubfield
+}
+
+type marcSubfield struct {
+	Code  byte
+	Value string
+}
+
+// marcEntry is one record of an input file, or why it could not be read.
+type marcEntry struct {
+	Record marcRecord
+	Err    error
+}
+
+const (
+	marcRecordEnd = 0x1D
+	marcFieldEnd  = 0x1E
+	marcDelimiter = 0x1F
+)
+
+func isControlTag(tag string) bool {
+	return strings.HasPrefix(tag, "00")
+}
+
+func (r marcRecord) control(tag string) string {
+	for _, f := range r.Fields {
+		if f.Tag == tag {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func (r marcRecord) fields(tag string) []marcField {
+	var out []marcField
+	for _, f := range r.Fields {
+		if f.Tag == tag {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// sub is the first subfield with code, or "".
+func (f marcField) sub(code byte) string {
+	for _, s := range f.Subfields {
+		if s.Code == code {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+// readMARC reads a file in either MARC serialization: MARCXML when it starts
+// with "<", ISO 2709 otherwise. A file-level error means nothing could be
+// read; a record that cannot be read is returned with its Err set.
+func readMARC(data []byte) ([]marcEntry, string, error) {
+	trimmed := bytes.TrimLeft(data, " \t\r\n\ufeff")
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		entries, err := readMARCXML(trimmed)
+		return entries, "marcxml", err
+	}
+	entries, err := readISO2709(data)
+	return entries, "iso2709", err
+}
+
+func readISO2709(data []byte) ([]marcEntry, error) {
+	var out []marcEntry
+	for _, chunk := range bytes.Split(data, []byte{marcRecordEnd}) {
+		if len(bytes.TrimSpace(chunk)) == 0 {
+			continue
+		}
+		rec, err := parseISO2709Record(bytes.TrimLeft(chunk, "\r\n"))
+		out = append(out, marcEntry{Record: rec, Err: err})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no MARC records found")
+	}
+	return out, nil
+}
+
+// parseISO2709Record reads one record without its terminator: a 24-byte
+// leader, a directory of 12-byte entries (tag, length, offset) and the
+// field data starting at the base address given in the leader.
+func parseISO2709Record(b []byte) (marcRecord, error) {
+	if len(b) < 24 {
+		return marcRecord{}, errors.New("record shorter than its leader")
+	}
+	rec := marcRecord{Leader: string(b[:24])}
+	base, ok := marcNumber(b[12:17])
+	if !ok || base < 25 || base > len(b) {
+		return rec, errors.New("leader has no valid base address")
+	}
+	dir := bytes.TrimSuffix(b[24:base], []byte{marcFieldEnd})
+	if len(dir)%12 != 0 {
+		return rec, errors.New("directory is not made of 12-byte entries")
+	}
+	for i := 0; i < len(dir); i += 12 {
+		tag := string(dir[i : i+3])
+		length, ok1 := marcNumber(dir[i+3 : i+7])
+		start, ok2 := marcNumber(dir[i+7 : i+12])
+		if !ok1 || !ok2 || base+start+length > len(b) {
+			return rec, fmt.Errorf("directory entry for field %s points outside the record", tag)
+		}
+		raw := bytes.TrimSuffix(b[base+start:base+start+length], []byte{marcFieldEnd})
+		if !utf8.Valid(raw) {
+			return rec, fmt.Errorf("field %s is not UTF-8 (MARC-8 records are not supported)", tag)
+		}
+		rec.Fields = append(rec.Fields, parseMARCField(tag, raw))
+	}
+	return rec, nil
+}
+
+// marcNumber reads a fixed-width number of the leader or directory. Only
+// ASCII digits count: strconv.Atoi would also take a sign, and a negative
+// length or offset would slice outside the record.
+func marcNumber(b []byte) (int, bool) {
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, len(b) > 0
+}
+
+func parseMARCField(tag string, raw []byte) marcField {
+	f := marcField{Tag: tag}
+	if isControlTag(tag) {
+		f.Value = string(raw)
+		return f
+	}
+	f.Ind1, f.Ind2 = ' ', ' '
+	if len(raw) >= 2 && raw[0] != marcDelimiter {
+		f.Ind1, f.Ind2 = raw[0], raw[1]
+	}
+	parts := bytes.Split(raw, []byte{marcDelimiter})
+	for _, p := range parts[1:] {
+		if len(p) > 0 {
+			f.Subfields = append(f.Subfields, marcSubfield{Code: p[0], Value: string(p[1:])})
+		}
+	}
+	return f
+}
+
+// writeISO2709 writes records in ISO 2709, UTF-8 encoded (leader/09 "a").
+// Lengths and offsets are computed here, so the leader only needs its
+// descriptive positions.
+func writeISO2709(w io.Writer, recs []marcRecord) error {
+	for _, r := range recs {
+		var dir, body bytes.Buffer
+		for _, f := range r.Fields {
+			var data bytes.Buffer
+			if isControlTag(f.Tag) {
+				data.WriteString(f.Value)
+			} else {
+				data.WriteByte(f.Ind1)
+				data.WriteByte(f.Ind2)
+				for _, s := range f.Subfields {
+					data.WriteByte(marcDelimiter)
+					data.WriteByte(s.Code)
+					data.WriteString(s.Value)
+				}
+			}
+			data.WriteByte(marcFieldEnd)
+			fmt.Fprintf(&dir, "%s%04d%05d", f.Tag, data.Len(), body.Len())
+			body.Write(data.Bytes())
+		}
+		dir.WriteByte(marcFieldEnd)
+		base := 24 + dir.Len()
+		total := base + body.Len() + 1
+		if total > 99999 {
+			return fmt.Errorf("record %s is too long for ISO 2709", r.control("001"))
+		}
+		leader := []byte(r.Leader)
+		copy(leader[0:5], fmt.Sprintf("%05d", total))
+		leader[9] = 'a'
+		copy(leader[12:17], fmt.Sprintf("%05d", base))
+		if _, err := w.Write(leader); err != nil {
+			return err
+		}
+		if _, err := w.Write(dir.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.Write(body.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{marcRecordEnd}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The MARCXML element types. Tags without a namespace match the elements
+// whatever prefix the file uses; writing puts them in the MARC 21 slim
+// namespace declared on the collection.
+type marcXMLCollection struct {
+	XMLName xml.Name        `xml:"http://www.loc.gov/MARC21/slim collection"`
+	Records []marcXMLRecord `xml:"record"`
+}
+
+type marcXMLRecord struct {
+	Leader        string           `xml:"leader"`
+	ControlFields []marcXMLControl `xml:"controlfield"`
+	DataFields    []marcXMLData    `xml:"datafield"`
+}
+
+type marcXMLControl struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcXMLData struct {
+	Tag       string            `xml:"tag,attr"`
+	Ind1      string            `xml:"ind1,attr"`
+	Ind2      string            `xml:"ind2,attr"`
+	Subfields []marcXMLSubfield `xml:"subfield"`
+}
+
+type marcXMLSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// readMARCXML accepts a <collection> of records or a lone <record>.
+func readMARCXML(data []byte) ([]marcEntry, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var out []marcEntry
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("MARCXML: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "record" {
+			continue
+		}
+		var x marcXMLRecord
+		if err := dec.DecodeElement(&x, &start); err != nil {
+			return nil, fmt.Errorf("MARCXML: %w", err)
+		}
+		out = append(out, marcEntry{Record: x.record()})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no MARC records found")
+	}
+	return out, nil
+}
+
+func (x marcXMLRecord) record() marcRecord {
+	r := marcRecord{Leader: strings.TrimSpace(x.Leader)}
+	for _, c := range x.ControlFields {
+		r.Fields = append(r.Fields, marcField{Tag: c.Tag, Value: c.Value})
+	}
+	for _, d := range x.DataFields {
+		f := marcField{Tag: d.Tag, Ind1: indicator(d.Ind1), Ind2: indicator(d.Ind2)}
+		for _, s := range d.Subfields {
+			if s.Code != "" {
+				f.Subfields = append(f.Subfields, marcSubfield{Code: s.Code[0], Value: s.Value})
+			}
+		}
+		r.Fields = append(r.Fields, f)
+	}
+	return r
+}
+
+func indicator(s string) byte {
+	if s == "" {
+		return ' '
+	}
+	return s[0]
+}
+
+func writeMARCXML(w io.Writer, recs []marcRecord) error {
+	c := marcXMLCollection{}
+	for _, r := range recs {
+		x := marcXMLRecord{Leader: r.Leader}
+		for _, f := range r.Fields {
+			if isControlTag(f.Tag) {
+				x.ControlFields = append(x.ControlFields, marcXMLControl{Tag: f.Tag, Value: f.Value})
+				continue
+			}
+			d := marcXMLData{Tag: f.Tag, Ind1: string(f.Ind1), Ind2: string(f.Ind2)}
+			for _, s := range f.Subfields {
+				d.Subfields = append(d.Subfields, marcXMLSubfield{Code: string(s.Code), Value: s.Value})
+			}
+			x.DataFields = append(x.DataFields, d)
+		}
+		c.Records = append(c.Records, x)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(c)
+}
+
+// trimISBD drops the punctuation cataloguers put between fields (" /",
+// " :", trailing commas and full stops), keeping a full stop that ends an
+// initial ("Auezov, M.").
+func trimISBD(s string) string {
+	s = strings.TrimRight(strings.TrimSpace(s), " /:;,=")
+	if strings.HasSuffix(s, ".") {
+		words := strings.Fields(s)
+		if last := words[len(words)-1]; utf8.RuneCountInString(last) > 2 {
+			s = strings.TrimSuffix(s, ".")
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// marcRoles maps relator terms ($e) and codes ($4) onto contributor roles.
+var marcRoles = map[string]string{
+	"author": roleAuthor, "aut": roleAuthor,
+	"translator": roleTranslator, "trl": roleTranslator,
+	"editor": roleEditor, "edt": roleEditor,
+}
+
+// contributorFromMARC reads a 100 or 700 field. A field without a relator
+// is an author; one whose relator is not a role we keep (an illustrator,
+// say) is dropped.
+func contributorFromMARC(f marcField) (Contributor, bool) {
+	name := trimISBD(f.sub('a'))
+	if name == "" {
+		return Contributor{}, false
+	}
+	relator := strings.ToLower(trimISBD(f.sub('e')))
+	if relator == "" {
+		relator = strings.ToLower(strings.TrimSpace(f.sub('4')))
+	}
+	if relator == "" {
+		return Contributor{Name: name, Role: roleAuthor}, true
+	}
+	role, ok := marcRoles[relator]
+	return Contributor{Name: name, Role: role}, ok
+}
+
+var fourDigits = regexp.MustCompile(`\d{4}`)
+
+// bookFromMARC maps a bibliographic record onto a Book and its contributors:
+//
+//	001       bookCode (the ISBN when there is no 001)
+//	020 $a    ISBN, the first one that validates
+//	100/700   contributors, role from $e or $4
+//	245 $a $b title (and subtitle)
+//	250 $a    edition
+//	264/260   $b publisher, $c year
+//	041/008   language
+//	650/651   subjects, subdivisions joined with " -- "
+//
+// It returns why the record cannot become a book when it cannot.
+func bookFromMARC(r marcRecord) (Book, []Contributor, string) {
+	b := Book{Subjects: []string{}}
+	for _, f := range r.fields("020") {
+		if words := strings.Fields(f.sub('a')); len(words) > 0 {
+			if isbn, err := normalizeISBN(words[0]); err == nil {
+				b.ISBN = isbn
+				break
+			}
+		}
+	}
+	b.BookCode = strings.TrimSpace(r.control("001"))
+	if b.BookCode == "" {
+		b.BookCode = b.ISBN
+	}
+	if b.BookCode == "" {
+		return b, nil, "no control number (001) or valid ISBN (020) to use as the book code"
+	}
+
+	if t := r.fields("245"); len(t) > 0 {
+		b.Title = trimISBD(t[0].sub('a'))
+		if sub := trimISBD(t[0].sub('b')); sub != "" {
+			b.Title += " : " + sub
+		}
+	}
+	if b.Title == "" {
+		return b, nil, "no title (245 $a)"
+	}
+
+	var cs []Contributor
+	for _, tag := range []string{"100", "700"} {
+		for _, f := range r.fields(tag) {
+			if c, ok := contributorFromMARC(f); ok {
+				cs = append(cs, c)
+			}
+		}
+	}
+
+	if e := r.fields("250"); len(e) > 0 {
+		b.Edition = trimISBD(e[0].sub('a'))
+	}
+	var pub *marcField
+	for _, tag := range []string{"264", "260"} {
+		for _, f := range r.fields(tag) {
+			// 264 second indicator 1 is publication; 0, 2, 3 are
+			// production, distribution and manufacture.
+			if tag == "264" && f.Ind2 != '1' {
+				continue
+			}
+			if pub == nil {
+				f := f
+				pub = &f
+			}
+		}
+	}
+	if pub != nil {
+		b.Publisher = trimISBD(pub.sub('b'))
+		if y, err := strconv.Atoi(fourDigits.FindString(pub.sub('c'))); err == nil && checkYear(y) {
+			b.Year = y
+		}
+	}
+	if l := r.fields("041"); len(l) > 0 {
+		b.Language = strings.TrimSpace(l[0].sub('a'))
+	}
+	if f008 := r.control("008"); b.Language == "" && len(f008) >= 38 {
+		if lang := strings.Trim(f008[35:38], " |#"); len(lang) == 3 {
+			b.Language = lang
+		}
+	}
+	for _, tag := range []string{"650", "651"} {
+		for _, f := range r.fields(tag) {
+			var parts []string
+			for _, s := range f.Subfields {
+				if strings.IndexByte("axyz", s.Code) >= 0 {
+					if v := trimISBD(s.Value); v != "" {
+						parts = append(parts, v)
+					}
+				}
+			}
+			if len(parts) > 0 {
+				b.Subjects = append(b.Subjects, strings.Join(parts, " -- "))
+			}
+		}
+	}
+	b.Subjects = cleanSubjects(b.Subjects)
+	return b, cs, ""
+}
+
+// marcFromBook is the export counterpart of bookFromMARC.
+func marcFromBook(b Book) marcRecord {
+	r := marcRecord{Leader: "00000nam a2200000 i 4500"}
+	field := func(tag string, ind1, ind2 byte, subs ...marcSubfield) {
+		var kept []marcSubfield
+		for _, s := range subs {
+			if s.Value != "" {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) > 0 {
+			r.Fields = append(r.Fields, marcField{Tag: tag, Ind1: ind1, Ind2: ind2, Subfields: kept})
+		}
+	}
+
+	r.Fields = append(r.Fields, marcField{Tag: "001", Value: b.BookCode})
+	f008 := []byte(strings.Repeat(" ", 40))
+	if created, err := parseDate(b.CreatedAt); err == nil {
+		copy(f008[0:6], created.Format("060102"))
+	}
+	f008[6] = 'n'
+	copy(f008[7:11], "uuuu")
+	if b.Year != 0 {
+		f008[6] = 's'
+		copy(f008[7:11], fmt.Sprintf("%04d", b.Year))
+	}
+	if len(b.Language) == 3 {
+		copy(f008[35:38], strings.ToLower(b.Language))
+	}
+	f008[39] = 'd'
+	r.Fields = append(r.Fields, marcField{Tag: "008", Value: string(f008)})
+
+	field("020", ' ', ' ', marcSubfield{'a', b.ISBN})
+	field("041", ' ', ' ', marcSubfield{'a', b.Language})
+	main := -1
+	for i, c := range b.Contributors {
+		if c.Role == roleAuthor {
+			main = i
+			field("100", '1', ' ', marcSubfield{'a', c.Name}, marcSubfield{'e', c.Role})
+			break
+		}
+	}
+	title, subtitle, _ := strings.Cut(b.Title, " : ")
+	titleInd := byte('0')
+	if main >= 0 {
+		titleInd = '1'
+	}
+	field("245", titleInd, '0', marcSubfield{'a', title}, marcSubfield{'b', subtitle})
+	field("250", ' ', ' ', marcSubfield{'a', b.Edition})
+	year := ""
+	if b.Year != 0 {
+		year = strconv.Itoa(b.Year)
+	}
+	field("264", ' ', '1', marcSubfield{'b', b.Publisher}, marcSubfield{'c', year})
+	for _, s := range b.Subjects {
+		field("650", ' ', '4', marcSubfield{'a', s})
+	}
+	for i, c := range b.Contributors {
+		if i != main {
+			field("700", '1', ' ', marcSubfield{'a', c.Name}, marcSubfield{'e', c.Role})
+		}
+	}
+	return r
+}
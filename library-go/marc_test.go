@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// isoRecord is a valid ISO 2709 record of one control and one data field,
+// without its terminator.
+func isoRecord(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	rec := marcRecord{Leader: "00000nam a2200000 i 4500", Fields: []marcField{
+		{Tag: "001", Value: "C1"},
+		{Tag: "245", Ind1: '1', Ind2: '0', Subfields: []marcSubfield{{'a', "Abai Joly"}}},
+	}}
+	if err := writeISO2709(&buf, []marcRecord{rec}); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{marcRecordEnd})
+}
+
+func TestParseISO2709Record(t *testing.T) {
+	// The directory starts at 24; each entry is tag (3), length (4) and
+	// offset (5), so the first entry's length is at 27:31.
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+		wantErr string
+	}{
+		{"valid", func(b []byte) []byte { return b }, ""},
+		{"shorter than the leader", func(b []byte) []byte { return b[:20] }, "shorter than its leader"},
+		{"base address not a number", func(b []byte) []byte { copy(b[12:17], "00x49"); return b }, "base address"},
+		{"signed base address", func(b []byte) []byte { copy(b[12:17], "+0049"); return b }, "base address"},
+		{"base address inside the leader", func(b []byte) []byte { copy(b[12:17], "00010"); return b }, "base address"},
+		{"base address past the end", func(b []byte) []byte { copy(b[12:17], "99999"); return b }, "base address"},
+		{"directory cut short", func(b []byte) []byte {
+			return append(append(append([]byte{}, b[:24]...), b[25:]...), 0)
+		}, "12-byte entries"},
+		{"signed field length", func(b []byte) []byte { copy(b[27:31], "-003"); return b }, "outside the record"},
+		{"field past the end", func(b []byte) []byte { copy(b[27:31], "9999"); return b }, "outside the record"},
+		{"field not UTF-8", func(b []byte) []byte { return bytes.Replace(b, []byte("C1"), []byte{0xff, 0xfe}, 1) }, "not UTF-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := parseISO2709Record(tt.corrupt(isoRecord(t)))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr == "" && rec.control("001") != "C1":
+				t.Errorf("001 = %q, want C1", rec.control("001"))
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error = %v, want one about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadISO2709KeepsGoodRecords(t *testing.T) {
+	good := isoRecord(t)
+	data := append(append(append([]byte{}, good...), marcRecordEnd), "garbage"...)
+	data = append(append(data, marcRecordEnd), good...)
+	entries, format, err := readMARC(data)
+	if err != nil || format != "iso2709" {
+		t.Fatalf("readMARC: %v, %s", err, format)
+	}
+	if len(entries) != 3 || entries[0].Err != nil || entries[1].Err == nil || entries[2].Err != nil {
+		t.Errorf("entries = %+v, want good, bad, good", entries)
+	}
+}
+
+func TestMARCRoundTrip(t *testing.T) {
+	book := Book{
+		BookCode: "C10", Title: "Abai Joly : roman-epopeia", ISBN: "9780306406157", Publisher: "Zhazushy",
+		Year: 1958, Language: "kaz", Edition: "2nd ed", Subjects: []string{"Novels", "Kazakh literature -- History"},
+		Contributors: []Contributor{
+			{Name: "Auezov, Mukhtar", Role: roleAuthor},
+			{Name: "Sobolev, Leonid", Role: roleTranslator},
+			{Name: "Kenzheev, B.", Role: roleEditor},
+		},
+	}
+	var iso bytes.Buffer
+	if err := writeISO2709(&iso, []marcRecord{marcFromBook(book)}); err != nil {
+		t.Fatal(err)
+	}
+	entries, format, err := readMARC(iso.Bytes())
+	if err != nil || format != "iso2709" || len(entries) != 1 || entries[0].Err != nil {
+		t.Fatalf("reading ISO 2709: %v, %s, %+v", err, format, entries)
+	}
+	var xmlOut bytes.Buffer
+	if err := writeMARCXML(&xmlOut, []marcRecord{entries[0].Record}); err != nil {
+		t.Fatal(err)
+	}
+	entries, format, err = readMARC(xmlOut.Bytes())
+	if err != nil || format != "marcxml" || len(entries) != 1 {
+		t.Fatalf("reading MARCXML: %v, %s, %d records", err, format, len(entries))
+	}
+
+	got, cs, msg := bookFromMARC(entries[0].Record)
+	if msg != "" {
+		t.Fatal(msg)
+	}
+	got.Contributors = cs
+	if !reflect.DeepEqual(got, book) {
+		t.Errorf("after ISO 2709 and MARCXML:\n got  %+v\n want %+v", got, book)
+	}
+}
+
+func TestBookFromMARC(t *testing.T) {
+	field := func(tag string, ind2 byte, subs ...string) marcField {
+		f := marcField{Tag: tag, Ind1: ' ', Ind2: ind2}
+		for i := 0; i+1 < len(subs); i += 2 {
+			f.Subfields = append(f.Subfields, marcSubfield{subs[i][0], subs[i+1]})
+		}
+		return f
+	}
+	control := func(tag, v string) marcField { return marcField{Tag: tag, Value: v} }
+	title := field("245", '0', "a", "Abai Joly /")
+
+	tests := []struct {
+		name      string
+		fields    []marcField
+		want      Book
+		wantCS    []Contributor
+		wantError string
+	}{
+		{
+			name:   "264 publication wins over production and 260",
+			fields: []marcField{control("001", "C1"), title, field("264", '0', "b", "Printer,", "c", "1957"), field("260", ' ', "b", "Old Press", "c", "1950"), field("264", '1', "b", "Zhazushy,", "c", "c1958.")},
+			want:   Book{BookCode: "C1", Title: "Abai Joly", Publisher: "Zhazushy", Year: 1958},
+		},
+		{
+			name:   "260 when no 264 is a publication",
+			fields: []marcField{control("001", "C1"), title, field("264", '4', "c", "2001"), field("260", ' ', "b", "Old Press :", "c", "[1950?]")},
+			want:   Book{BookCode: "C1", Title: "Abai Joly", Publisher: "Old Press", Year: 1950},
+		},
+		{
+			name:   "ISBN as book code, first valid one",
+			fields: []marcField{field("020", ' ', "a", "123 (invalid)"), field("020", ' ', "a", "0-306-40615-2 (pbk.)"), title},
+			want:   Book{BookCode: "9780306406157", ISBN: "9780306406157", Title: "Abai Joly"},
+		},
+		{
+			name: "contributors by relator",
+			fields: []marcField{control("001", "C1"), title, field("100", ' ', "a", "Auezov, M.,", "e", "author."),
+				field("700", ' ', "a", "Sobolev, Leonid,", "4", "trl"), field("700", ' ', "a", "Kasteev, Abylkhan,", "e", "illustrator.")},
+			want:   Book{BookCode: "C1", Title: "Abai Joly"},
+			wantCS: []Contributor{{Name: "Auezov, M.", Role: roleAuthor}, {Name: "Sobolev, Leonid", Role: roleTranslator}},
+		},
+		{
+			name:   "language from 008 without 041",
+			fields: []marcField{control("001", "C1"), control("008", "260301s1958    ru            000 1 kaz d"), title},
+			want:   Book{BookCode: "C1", Title: "Abai Joly", Language: "kaz"},
+		},
+		{
+			name:      "no book code",
+			fields:    []marcField{title},
+			wantError: "no control number",
+		},
+		{
+			name:      "no title",
+			fields:    []marcField{control("001", "C1")},
+			wantError: "no title",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cs, msg := bookFromMARC(marcRecord{Fields: tt.fields})
+			if tt.wantError != "" {
+				if !strings.Contains(msg, tt.wantError) {
+					t.Errorf("message %q, want one about %q", msg, tt.wantError)
+				}
+				return
+			}
+			if msg != "" {
+				t.Fatal(msg)
+			}
+			tt.want.Subjects = []string{}
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(cs, tt.wantCS) {
+				t.Errorf("got %+v %v\nwant %+v %v", got, cs, tt.want, tt.wantCS)
+			}
+		})
+	}
+}
+
+func TestTrimISBD(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Abai Joly /", "Abai Joly"},
+		{"Zhazushy,", "Zhazushy"},
+		{"Almaty :", "Almaty"},
+		{"roman-epopeia.", "roman-epopeia"},
+		{"Auezov, M.", "Auezov, M."},
+		{"Auezov, M.,", "Auezov, M."},
+		{"  spaced ;  ", "spaced"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := trimISBD(tt.in); got != tt.want {
+			t.Errorf("trimISBD(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
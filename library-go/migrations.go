@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+)
+
+// schemaVersion is the shape of the persisted document this binary writes.
+// Bump it together with a new entry in migrations whenever a stored struct
+// changes in a way old files need help with.
+const schemaVersion = 12
+
+type migration struct {
+	to    int
+	about string
+	apply func(doc map[string]any) error
+}
+
+// migrations run in order on the raw JSON document, before it is decoded into
+// Database, so they can still see fields the current structs no longer have.
+var migrations = []migration{
+	{to: 1, about: "add schemaVersion, fill default loan/book/user fields", apply: migrateV1},
+	{to: 2, about: "add persisted sessions", apply: migrateV2},
+	{to: 3, about: "sessions become refresh-token families", apply: migrateV3},
+	{to: 4, about: "add persisted login attempt counters", apply: migrateV4},
+	{to: 5, about: "track individual copies with barcodes", apply: migrateV5},
+	{to: 6, about: "add hold queue", apply: migrateV6},
+	{to: 7, about: "add fines ledger, opening it with fines already charged; round amounts to minor units", apply: migrateV7},
+	{to: 8, about: "add reader/book categories and lending rules", apply: migrateV8},
+	{to: 9, about: "add library calendar", apply: migrateV9},
+	{to: 10, about: "add bibliographic fields; authors become contributor records", apply: migrateV10},
+	{to: 11, about: "add audit log", apply: migrateV11},
+	{to: 12, about: "add per-entity ID sequences", apply: migrateV12},
+}
+
+func migrateV1(doc map[string]any) error {
+	for _, u := range docRecords(doc, "users") {
+		setDefault(u, "role", "reader")
+		setDefault(u, "phone", "")
+		setDefault(u, "createdAt", "")
+	}
+	for _, b := range docRecords(doc, "books") {
+		setDefault(b, "price", 0)
+		setDefault(b, "totalQty", 0)
+		setDefault(b, "availableQty", b["totalQty"])
+		setDefault(b, "createdAt", "")
+	}
+	for _, l := range docRecords(doc, "loans") {
+		setDefault(l, "status", loanBorrowed)
+		setDefault(l, "returnDate", "")
+		setDefault(l, "fineAmount", 0)
+	}
+	return nil
+}
+
+func migrateV2(doc map[string]any) error {
+	docRecords(doc, "sessions")
+	return nil
+}
+
+// migrateV3 drops the opaque v2 sessions: clients still hold them as bearer
+// tokens, which are JWTs now, so everyone simply logs in once more.
+func migrateV3(doc map[string]any) error {
+	doc["sessions"] = []any{}
+	return nil
+}
+
+func migrateV4(doc map[string]any) error {
+	docRecords(doc, "loginAttempts")
+	return nil
+}
+
+// migrateV5 turns each book's quantity counters into copy records with
+// generated barcodes. Borrowed and lost loans get a copy of their own so they
+// keep pointing at something; the rest of the stock is shelved as available.
+func migrateV5(doc map[string]any) error {
+	loansByBook := map[string][]map[string]any{}
+	for _, l := range docRecords(doc, "loans") {
+		id, _ := l["bookId"].(string)
+		loansByBook[id] = append(loansByBook[id], l)
+	}
+	copies, _ := doc["copies"].([]any)
+	n := len(copies)
+	for _, b := range docRecords(doc, "books") {
+		id, _ := b["id"].(string)
+		code, _ := b["bookCode"].(string)
+		acquired, _ := b["createdAt"].(string)
+		seq := 0
+		add := func(status string) string {
+			n++
+			seq++
+			c := map[string]any{
+				"id":         fmt.Sprintf("C%d", n),
+				"bookId":     id,
+				"barcode":    fmt.Sprintf("%s-%03d", code, seq),
+				"condition":  "good",
+				"location":   "",
+				"acquiredAt": acquired,
+				"status":     status,
+			}
+			copies = append(copies, c)
+			return c["id"].(string)
+		}
+
+		onLoan := 0
+		for _, l := range loansByBook[id] {
+			switch l["status"] {
+			case loanBorrowed:
+				l["copyId"] = add("on_loan")
+				onLoan++
+			case loanLost:
+				l["copyId"] = add("lost")
+			}
+		}
+		// availableQty could drift from the loans (it was clamped, never
+		// recounted), so trust the borrowed loans and the total.
+		total := max(docInt(b["totalQty"]), onLoan)
+		for i := onLoan; i < total; i++ {
+			add("available")
+		}
+		b["totalQty"] = total
+		b["availableQty"] = total - onLoan
+	}
+	doc["copies"] = copies
+	return nil
+}
+
+func migrateV6(doc map[string]any) error {
+	docRecords(doc, "holds")
+	return nil
+}
+
+// migrateV7 books the fine of every closed loan as an assessed, unpaid ledger
+// line; the old data had no record of payments. Amounts were floats until
+// now and are rounded to whole minor units first. A fine that cannot be read
+// stops the migration rather than vanish from the ledger.
+func migrateV7(doc map[string]any) error {
+	for _, b := range docRecords(doc, "books") {
+		if err := roundLegacyAmount(b, "price"); err != nil {
+			return fmt.Errorf("book %v: %w", b["id"], err)
+		}
+	}
+	fines := []any{}
+	for _, l := range docRecords(doc, "loans") {
+		if err := roundLegacyAmount(l, "fineAmount"); err != nil {
+			return fmt.Errorf("loan %v: %w", l["id"], err)
+		}
+		if l["status"] != loanReturned && l["status"] != loanLost {
+			continue
+		}
+		amount, err := parseMoney(fmt.Sprint(l["fineAmount"]))
+		if err != nil {
+			return fmt.Errorf("loan %v: %w", l["id"], err)
+		}
+		if amount <= 0 {
+			continue
+		}
+		at, _ := l["returnDate"].(string)
+		if at != "" {
+			at += "T00:00:00Z"
+		}
+		fines = append(fines, map[string]any{
+			"id":        genID("F", len(fines)+1),
+			"userId":    l["readerId"],
+			"loanId":    l["id"],
+			"kind":      fineAssessed,
+			"amount":    json.Number(amount.String()),
+			"reason":    "carried over from loan records",
+			"createdAt": at,
+		})
+	}
+	doc["fines"] = fines
+	return nil
+}
+
+// roundLegacyAmount rewrites the float amount under key with two decimals,
+// rounding halves away from zero (12.345 becomes 12.35), so that it decodes
+// as Money.
+func roundLegacyAmount(rec map[string]any, key string) error {
+	v, ok := rec[key]
+	if !ok || v == nil {
+		return nil
+	}
+	r, ok := new(big.Rat).SetString(fmt.Sprint(v))
+	if !ok {
+		return fmt.Errorf("%s %v is not a number", key, v)
+	}
+	rec[key] = json.Number(r.FloatString(2))
+	return nil
+}
+
+// migrateV8 puts every existing reader and book in the default category, so
+// they keep the terms they had: 7-day loans, no cap on concurrent loans.
+func migrateV8(doc map[string]any) error {
+	for _, u := range docRecords(doc, "users") {
+		setDefault(u, "category", readerStudent)
+	}
+	for _, b := range docRecords(doc, "books") {
+		setDefault(b, "category", bookStandard)
+	}
+	docRecords(doc, "lendingRules")
+	return nil
+}
+
+func migrateV9(doc map[string]any) error {
+	docRecords(doc, "openingHours")
+	docRecords(doc, "closedDays")
+	return nil
+}
+
+// migrateV10 turns each book's author text into one author contributor,
+// sharing the Author record between books that spell the name the same way.
+// The text is not split: "Ильф, Петров" might be one person or two.
+func migrateV10(doc map[string]any) error {
+	authors, _ := doc["authors"].([]any)
+	byKey := map[string]string{}
+	for _, b := range docRecords(doc, "books") {
+		setDefault(b, "subjects", []any{})
+		if _, ok := b["contributors"]; ok {
+			continue
+		}
+		contributors := []any{}
+		name, _ := b["author"].(string)
+		if name = cleanName(name); name != "" {
+			id, ok := byKey[authorKey(name)]
+			if !ok {
+				id = genID("A", len(authors)+1)
+				byKey[authorKey(name)] = id
+				authors = append(authors, map[string]any{"id": id, "name": name, "createdAt": b["createdAt"]})
+			}
+			contributors = append(contributors, map[string]any{"authorId": id, "name": name, "role": roleAuthor})
+			b["author"] = name
+		}
+		b["contributors"] = contributors
+	}
+	if authors == nil {
+		authors = []any{}
+	}
+	doc["authors"] = authors
+	return nil
+}
+
+// migrateV11 starts an empty audit log; nothing is known about who made the
+// changes already stored.
+func migrateV11(doc map[string]any) error {
+	docRecords(doc, "audit")
+	return nil
+}
+
+// migrateV12 starts each ID sequence after the highest number still in
+// sight. A number whose record was deleted without leaving a reference or an
+// audit entry may be handed out once more; that cannot be helped now.
+func migrateV12(doc map[string]any) error {
+	docSequences(doc)
+	return nil
+}
+
+// docVersion reads schemaVersion from a raw document; files written before
+// versioning existed have none and count as version 0.
+func docVersion(doc map[string]any) (int, error) {
+	v, ok := doc["schemaVersion"]
+	if !ok {
+		return 0, nil
+	}
+	switch n := v.(type) {
+	case json.Number:
+		i, err := strconv.Atoi(n.String())
+		if err != nil {
+			return 0, fmt.Errorf("schemaVersion %q is not an integer", n)
+		}
+		return i, nil
+	case int:
+		return n, nil
+	case float64:
+		return int(n), nil
+	}
+	return 0, fmt.Errorf("schemaVersion has unexpected type %T", v)
+}
+
+// docInt reads a number out of a raw document, or 0 if there is none.
+func docInt(v any) int {
+	switch n := v.(type) {
+	case json.Number:
+		i, _ := n.Int64()
+		return int(i)
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// migrateDoc upgrades doc to schemaVersion one step at a time and reports
+// the version it started from. A document newer than this binary is refused
+// rather than risk dropping fields we do not know about.
+func migrateDoc(doc map[string]any) (int, error) {
+	from, err := docVersion(doc)
+	if err != nil {
+		return 0, err
+	}
+	if from > schemaVersion {
+		return from, fmt.Errorf("data schema version %d is newer than this build supports (%d); upgrade the server", from, schemaVersion)
+	}
+	for _, m := range migrations {
+		if m.to <= from {
+			continue
+		}
+		if err := m.apply(doc); err != nil {
+			return from, fmt.Errorf("migration to v%d (%s): %w", m.to, m.about, err)
+		}
+		doc["schemaVersion"] = m.to
+		log.Printf("migrated data to schema v%d: %s", m.to, m.about)
+	}
+	return from, nil
+}
+
+// docRecords returns the objects stored under key, creating an empty list
+// when the document does not have one yet.
+func docRecords(doc map[string]any, key string) []map[string]any {
+	list, ok := doc[key].([]any)
+	if !ok {
+		doc[key] = []any{}
+		return nil
+	}
+	out := make([]map[string]any, 0, len(list))
+	for _, rec := range list {
+		if m, ok := rec.(map[string]any); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func setDefault(rec map[string]any, key string, v any) {
+	if _, ok := rec[key]; !ok {
+		rec[key] = v
+	}
+}
+
+func decodeDoc(r io.Reader) (map[string]any, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	doc := map[string]any{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// backupFile keeps a copy of path before a migration rewrites it.
+func backupFile(path, suffix string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path + suffix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in minor units (1/100 of a tenge). It is written to JSON
+// as a plain decimal in major units (1250 → 12.5), so the API and the stored
+// files keep the shape they had when prices were floats, while all arithmetic
+// stays in integers.
+type Money int64
+
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	if m%100 == 0 {
+		return fmt.Sprintf("%s%d", sign, m/100)
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, m/100, m%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" {
+		return nil
+	}
+	v, err := parseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// parseMoney reads a decimal amount in major units with at most two
+// fractional digits ("5000", "12.5", "-3.25").
+func parseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if strings.ContainsAny(s, "eE") {
+		// Exponent notation only comes from other tools; round it once.
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+		return Money(math.Round(f * 100)), nil
+	}
+	neg := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" && frac == "" || len(frac) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	var w, f int64
+	var err error
+	if whole != "" {
+		if w, err = strconv.ParseInt(whole, 10, 64); err != nil || w < 0 {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+	if f, err = strconv.ParseInt(frac, 10, 64); err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if w > math.MaxInt64/100-1 {
+		return 0, errors.New("amount too large")
+	}
+	m := Money(w*100 + f)
+	if neg {
+		m = -m
+	}
+	return m, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Notifier delivers messages to users. Real email can be plugged in later;
+// until then messages go to the log or to an outbox file (NOTIFY_FILE).
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Send(to, subject, body string) error {
+	log.Printf("notify %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+type fileNotifier struct{ path string }
+
+func (n fileNotifier) Send(to, subject, body string) error {
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().UTC().Format(time.RFC1123Z), to, subject, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var notifier Notifier = logNotifier{}
+
+func loadNotifier() {
+	if p := os.Getenv("NOTIFY_FILE"); p != "" {
+		notifier = fileNotifier{path: p}
+	}
+}
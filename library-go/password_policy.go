@@ -0,0 +1,131 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+var commonPasswords = map[string]bool{}
+
+// passwordPolicy is checked on every password a user picks (registration,
+// change, reset). MaxBytes never exceeds 72: bcrypt ignores anything past
+// that, so longer passwords would silently be truncated.
+type passwordPolicy struct {
+	MinLength  int // PASSWORD_MIN_LENGTH, in characters
+	MaxBytes   int // PASSWORD_MAX_BYTES
+	MinClasses int // PASSWORD_MIN_CLASSES: of lower, upper, digit, symbol
+}
+
+var (
+	policy     = passwordPolicy{MinLength: 10, MaxBytes: 72, MinClasses: 3}
+	bcryptCost = 10 // BCRYPT_COST
+)
+
+func loadPasswordPolicy() {
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		policy.MinLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_BYTES")); err == nil && n > 0 {
+		policy.MaxBytes = min(n, 72)
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CLASSES")); err == nil && n >= 0 {
+		policy.MinClasses = min(n, 4)
+	}
+	if n, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil {
+		bcryptCost = max(bcrypt.MinCost, min(n, bcrypt.MaxCost))
+	}
+
+	for _, line := range strings.Split(commonPasswordsFile, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commonPasswords[strings.ToLower(line)] = true
+	}
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// checkPassword lists every way password breaks the policy; email is used to
+// reject passwords built from the account name.
+func checkPassword(password, email string) []fieldError {
+	var errs []fieldError
+	add := func(code, msg string) {
+		errs = append(errs, fieldError{Field: "password", Code: code, Message: msg})
+	}
+
+	if n := len([]rune(password)); n < policy.MinLength {
+		add("too_short", fmt.Sprintf("must be at least %d characters", policy.MinLength))
+	}
+	if len(password) > policy.MaxBytes {
+		add("too_long", fmt.Sprintf("must be at most %d bytes", policy.MaxBytes))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < policy.MinClasses {
+		add("too_simple", fmt.Sprintf("must mix at least %d of: lowercase, uppercase, digits, symbols", policy.MinClasses))
+	}
+
+	lowered := strings.ToLower(password)
+	if commonPasswords[lowered] {
+		add("common", "is too common")
+	}
+	if name, _, _ := strings.Cut(strings.ToLower(email), "@"); len(name) >= 3 && strings.Contains(lowered, name) {
+		add("contains_email", "must not contain your email name")
+	}
+	return errs
+}
+
+func writePasswordErrors(w http.ResponseWriter, errs []fieldError) {
+	jsonWrite(w, 400, map[string]any{
+		"error":  "Password does not meet the policy: " + errs[0].Message,
+		"fields": errs,
+	})
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// needsRehash reports whether hash was made with a lower cost than the one
+// configured now, so a successful login can upgrade it.
+func needsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < bcryptCost
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// resetTTL is how long an admin-issued reset token stays usable (RESET_TTL).
+var resetTTL = time.Hour
+
+func loadPasswordConfig() {
+	if d, err := time.ParseDuration(os.Getenv("RESET_TTL")); err == nil && d > 0 {
+		resetTTL = d
+	}
+}
+
+// setPassword stores a new hash for u, burns any pending reset token and
+// logs the user out everywhere. Callers must hold mu.
+func setPassword(u *User, hash string) error {
+	return store.Atomic(func() error {
+		u.PasswordHash = hash
+		u.ResetTokenHash = ""
+		u.ResetExpiresAt = ""
+		if err := store.Users().Update(*u); err != nil {
+			return err
+		}
+		if _, err := revokeUserSessions(u.ID); err != nil {
+			return err
+		}
+		// revokeUserSessions rewrote the user; pick up the new generation.
+		fresh, err := store.Users().ByID(u.ID)
+		if err != nil {
+			return err
+		}
+		*u = *fresh
+		return clearLoginFailures(accountKey(u.Email))
+	})
+}
+
+func apiChangePassword(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		jsonWrite(w, 400, map[string]any{"error": "Missing fields"})
+		return
+	}
+
+	me, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	mu.Lock()
+	u, err := authRecord(me)
+	mu.Unlock()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	if errs := checkPassword(req.NewPassword, u.Email); len(errs) > 0 {
+		writePasswordErrors(w, errs)
+		return
+	}
+
+	// Guesses at the current password count against the account like failed
+	// logins do, or a stolen access token would allow unlimited tries.
+	acctKey := accountKey(u.Email)
+	mu.Lock()
+	now := time.Now().UTC()
+	wait, err := loginBlockedFor(acctKey, now)
+	if err == nil && wait == 0 {
+		err = reserveLoginAttempt(acctKey, accountMaxFailures, now, clientIP(r))
+	}
+	mu.Unlock()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.CurrentPassword)) != nil {
+		mu.Lock()
+		err := failLoginAttempt(acctKey, accountMaxFailures, time.Now().UTC())
+		mu.Unlock()
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		jsonWrite(w, 403, map[string]any{"error": "Current password is wrong"})
+		return
+	}
+	hash, hashErr := hashPassword(req.NewPassword)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// u is from before the unlocked bcrypt calls. Write to the current
+	// record, and only if nothing that matters changed in between: saving
+	// the old copy would undo an archive, a role change or a logout-all.
+	fresh, err := store.Users().ByID(u.ID)
+	refuse := func(status int, msg string) {
+		if err := releaseLoginAttempt(acctKey, accountMaxFailures); err != nil {
+			storeError(w, err)
+			return
+		}
+		jsonWrite(w, status, map[string]any{"error": msg})
+	}
+	switch {
+	case err != nil:
+		storeError(w, err)
+		return
+	case hashErr != nil:
+		storeError(w, hashErr)
+		return
+	case fresh == nil || fresh.archived() || fresh.TokenGeneration != u.TokenGeneration:
+		refuse(401, "Unauthorized")
+		return
+	case fresh.PasswordHash != u.PasswordHash:
+		refuse(409, "The password was changed meanwhile; try again")
+		return
+	}
+
+	var pair *tokenPair
+	err = store.Atomic(func() error {
+		if err := setPassword(fresh, hash); err != nil {
+			return err
+		}
+		// Every other device is logged out; this one gets a fresh pair.
+		var err error
+		pair, err = issueTokens(fresh, r, "", time.Time{})
+		return err
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{
+		"ok":               true,
+		"token":            pair.AccessToken,
+		"accessToken":      pair.AccessToken,
+		"accessExpiresAt":  pair.AccessExpiresAt,
+		"refreshToken":     pair.RefreshToken,
+		"refreshExpiresAt": pair.RefreshExpiresAt,
+	})
+}
+
+// apiAdminResetPassword issues a one-time reset token for a user and sends
+// it through the notifier. The token is "<userID>.<secret>"; only a hash of
+// it is kept.
+func apiAdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/reset-password")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+
+	before := *u
+	token := u.ID + "." + genToken()
+	u.ResetTokenHash = hashToken(token)
+	u.ResetExpiresAt = time.Now().UTC().Add(resetTTL).Format(time.RFC3339)
+	err = store.Atomic(func() error {
+		if err := store.Users().Update(*u); err != nil {
+			return err
+		}
+		return recordAudit(r, "user.resetPassword", "user", u.ID, before, u)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	body := "A librarian started a password reset for your account.\n" +
+		"Use this code at POST /api/auth/reset before " + u.ResetExpiresAt + ":\n\n" + token
+	if err := notifier.Send(u.Email, "Library password reset", body); err != nil {
+		jsonWrite(w, 502, map[string]any{"error": "Could not deliver reset token"})
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true, "expiresAt": u.ResetExpiresAt})
+}
+
+func apiResetPassword(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	if req.Token == "" || req.NewPassword == "" {
+		jsonWrite(w, 400, map[string]any{"error": "Missing fields"})
+		return
+	}
+	userID, _, _ := strings.Cut(req.Token, ".")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(userID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil || u.ResetTokenHash == "" ||
+		subtle.ConstantTimeCompare([]byte(u.ResetTokenHash), []byte(hashToken(req.Token))) != 1 {
+		jsonWrite(w, 400, map[string]any{"error": "Invalid or used reset token"})
+		return
+	}
+	if !time.Now().UTC().Before(parseTime(u.ResetExpiresAt)) {
+		jsonWrite(w, 400, map[string]any{"error": "Reset token expired"})
+		return
+	}
+	if errs := checkPassword(req.NewPassword, u.Email); len(errs) > 0 {
+		writePasswordErrors(w, errs)
+		return
+	}
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	if err := setPassword(u, hash); err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true})
+}
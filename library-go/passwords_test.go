@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestChangePasswordGuessesAreThrottled(t *testing.T) {
+	openTestStore(t)
+	old := accountMaxFailures
+	accountMaxFailures = 2
+	t.Cleanup(func() { accountMaxFailures = old })
+	loadThrottleConfig()
+
+	hash, err := hashPassword("Str0ng!Passw0rd#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{ID: "U1", Email: "r@x.kz", Role: "reader", PasswordHash: hash}
+	if err := store.Users().Create(*u); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"currentPassword":"wrong","newPassword":"An0ther!Passw0rd#"}`
+	for i, want := range []int{403, 429, 429} {
+		w := call(apiChangePassword, authRequest(t, u, "POST", "/api/auth/change-password", body))
+		if w.Code != want {
+			t.Errorf("guess %d: status %d, want %d: %s", i+1, w.Code, want, w.Body)
+		}
+	}
+}
+
+func TestChangePasswordKeepsTheCurrentRecord(t *testing.T) {
+	openTestStore(t)
+	loadThrottleConfig()
+	hash, err := hashPassword("Str0ng!Passw0rd#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{ID: "U1", Email: "r@x.kz", Role: "reader", Category: readerStudent, PasswordHash: hash}
+	if err := store.Users().Create(*u); err != nil {
+		t.Fatal(err)
+	}
+	r := authRequest(t, u, "POST", "/api/auth/change-password",
+		`{"currentPassword":"Str0ng!Passw0rd#","newPassword":"An0ther!Passw0rd#"}`)
+	// A change made by staff after the token was issued must survive.
+	changed := *u
+	changed.Category = readerStaff
+	if err := store.Users().Update(changed); err != nil {
+		t.Fatal(err)
+	}
+	if w := call(apiChangePassword, r); w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	got, _ := store.Users().ByID("U1")
+	if got.Category != readerStaff || got.PasswordHash == hash {
+		t.Errorf("after change: category %q, hash changed %v", got.Category, got.PasswordHash != hash)
+	}
+}
+
+func TestLoginRehashesWeakHash(t *testing.T) {
+	openTestStore(t)
+	loadThrottleConfig()
+	old := bcryptCost
+	t.Cleanup(func() { bcryptCost = old })
+	bcryptCost = bcrypt.MinCost
+	hash, err := hashPassword("Str0ng!Passw0rd#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := User{ID: "U1", Email: "r@x.kz", Role: "reader", Category: readerStaff, TokenGeneration: 3, PasswordHash: hash}
+	if err := store.Users().Create(u); err != nil {
+		t.Fatal(err)
+	}
+	bcryptCost = bcrypt.MinCost + 1
+
+	if w := loginRequest("r@x.kz", "Str0ng!Passw0rd#"); w.Code != 200 {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	got, _ := store.Users().ByID("U1")
+	if needsRehash(got.PasswordHash) {
+		t.Error("hash was not upgraded")
+	}
+	if got.Category != u.Category || got.TokenGeneration != u.TokenGeneration {
+		t.Errorf("rehash changed other fields: %+v", got)
+	}
+}
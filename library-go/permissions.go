@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Handlers are guarded by permissions rather than role names; roles are just
+// named bundles of permissions. "reader" has none of these: readers only see
+// the catalog and their own loans.
+const (
+	permBooksWrite    = "books:write"
+	permLoansRead     = "loans:read"
+	permLoansIssue    = "loans:issue"
+	permLoansMarkLost = "loans:mark-lost"
+	permUsersRead     = "users:read"
+	permUsersManage   = "users:manage"
+	permFinesCollect  = "fines:collect"
+	permFinesWaive    = "fines:waive"
+	permRulesManage   = "rules:manage"
+	permCalendarWrite = "calendar:write"
+	permAuditRead     = "audit:read"
+	permReportsRead   = "reports:read"
+	permArchiveManage = "archive:manage"
+)
+
+var allPermissions = []string{
+	permBooksWrite,
+	permLoansRead,
+	permLoansIssue,
+	permLoansMarkLost,
+	permUsersRead,
+	permUsersManage,
+	permFinesCollect,
+	permFinesWaive,
+	permRulesManage,
+	permCalendarWrite,
+	permAuditRead,
+	permReportsRead,
+	permArchiveManage,
+}
+
+var rolePermissions = map[string][]string{
+	"admin": allPermissions,
+	// Front desk: lends and takes back books, but cannot touch the
+	// catalog or other staff accounts.
+	"librarian":  {permLoansRead, permLoansIssue, permLoansMarkLost, permUsersRead, permFinesCollect},
+	"cataloguer": {permBooksWrite},
+	"auditor":    {permLoansRead, permUsersRead, permAuditRead, permReportsRead},
+	"reader":     {},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func hasPermission(u *User, perm string) bool {
+	for _, p := range rolePermissions[u.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaff reports whether u works the admin panel (any role with at least
+// one permission).
+func isStaff(u *User) bool {
+	return len(rolePermissions[u.Role]) > 0
+}
+
+func requirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := authUser(r)
+		if err != nil {
+			jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+			return
+		}
+		if !hasPermission(u, perm) {
+			jsonWrite(w, 403, map[string]any{"error": "Missing permission: " + perm})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func apiListRoles(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(rolePermissions))
+	for name := range rolePermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := []any{}
+	for _, name := range names {
+		out = append(out, map[string]any{"role": name, "permissions": rolePermissions[name]})
+	}
+	jsonWrite(w, 200, out)
+}
+
+// lastActiveAdmin reports whether u is the only admin left who is not
+// archived, so demoting or archiving u would lock everyone out of admin
+// work. Callers must hold mu.
+func lastActiveAdmin(u *User) (bool, error) {
+	if u.Role != "admin" || u.archived() {
+		return false, nil
+	}
+	users, err := store.Users().All()
+	if err != nil {
+		return false, err
+	}
+	for _, x := range users {
+		if x.ID != u.ID && x.Role == "admin" && !x.archived() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func apiSetUserRole(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/role")
+	type Req struct {
+		Role string `json:"role"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	req.Role = strings.ToLower(strings.TrimSpace(req.Role))
+	if !validRole(req.Role) {
+		jsonWrite(w, 400, map[string]any{"error": "Unknown role"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	if req.Role != "admin" {
+		last, err := lastActiveAdmin(u)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if last {
+			jsonWrite(w, 400, map[string]any{"error": "Cannot demote the last admin"})
+			return
+		}
+	}
+
+	before := *u
+	u.Role = req.Role
+	err = store.Atomic(func() error {
+		if err := store.Users().Update(*u); err != nil {
+			return err
+		}
+		return recordAudit(r, "user.setRole", "user", u.ID, before, u)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{
+		"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role,
+	})
+}
+
+// usersHandler routes the per-user admin actions under /api/users/{id}/.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/role") {
+		if !method(w, r, "PATCH") {
+			return
+		}
+		requirePermission(permUsersManage, apiSetUserRole)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/reset-password") {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permUsersManage, apiAdminResetPassword)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/unlock") {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permUsersManage, apiUnlockUser)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/category") {
+		if !method(w, r, "PATCH") {
+			return
+		}
+		requirePermission(permUsersManage, apiSetUserCategory)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/fines") {
+		if !method(w, r, "GET") {
+			return
+		}
+		requirePermission(permUsersRead, apiUserFines)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/fines/payments") {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permFinesCollect, apiPostFineTx)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/fines/waivers") || strings.HasSuffix(r.URL.Path, "/fines/refunds") {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permFinesWaive, apiPostFineTx)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/restore") {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permArchiveManage, apiRestoreUser)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/purge") {
+		if !method(w, r, "POST") {
+			return
+		}
+		requirePermission(permArchiveManage, apiPurgeUser)(w, r)
+		return
+	}
+	if !strings.Contains(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/") {
+		if !method(w, r, "DELETE") {
+			return
+		}
+		requirePermission(permUsersManage, apiArchiveUser)(w, r)
+		return
+	}
+	jsonWrite(w, 404, map[string]any{"error": "Not found"})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Every reader has a category and every book has one; lending rules decide
+// the terms for each pairing.
+const (
+	readerStudent = "student"
+	readerStaff   = "staff"
+	readerGuest   = "guest"
+
+	bookStandard  = "standard"
+	bookShortLoan = "short-loan"
+	bookReference = "reference"
+
+	// anyCategory in a rule matches every category on that side.
+	anyCategory = "*"
+)
+
+var (
+	readerCategories = []string{readerStudent, readerStaff, readerGuest}
+	bookCategories   = []string{bookStandard, bookShortLoan, bookReference}
+)
+
+// loanDays is the loan period when no rule says otherwise (LOAN_DAYS).
+var loanDays = 7
+
+func loadLendingConfig() {
+	if n, err := strconv.Atoi(os.Getenv("LOAN_DAYS")); err == nil && n > 0 {
+		loanDays = n
+	}
+}
+
+func validCategory(list []string, c string) bool {
+	for _, x := range list {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// LendingRule sets terms for one reader category and book category, either
+// of which may be "*". Fields left out are inherited from the less specific
+// rules, and in the end from the built-in defaults.
+type LendingRule struct {
+	ID             string `json:"id"`
+	ReaderCategory string `json:"readerCategory"`
+	BookCategory   string `json:"bookCategory"`
+	LoanDays       *int   `json:"loanDays,omitempty"`
+	MaxLoans       *int   `json:"maxLoans,omitempty"`
+	MaxRenewals    *int   `json:"maxRenewals,omitempty"`
+	FinePerDay     *Money `json:"finePerDay,omitempty"`
+}
+
+func ruleID(readerCat, bookCat string) string {
+	return readerCat + ":" + bookCat
+}
+
+// lendingTerms is what a rule lookup resolves to.
+type lendingTerms struct {
+	// LoanDays 0 means the book is for use in the library only.
+	LoanDays int `json:"loanDays"`
+	// MaxLoans caps the reader's concurrent loans of books in the same
+	// category; 0 means no cap.
+	MaxLoans    int   `json:"maxLoans"`
+	MaxRenewals int   `json:"maxRenewals"`
+	FinePerDay  Money `json:"finePerDay"`
+}
+
+// builtinRule stands in for a "*:<book>" rule nobody has stored: reference
+// books stay in the building, short-loan books go out for two days without
+// renewal.
+func builtinRule(id string) *LendingRule {
+	zero, two := 0, 2
+	switch id {
+	case ruleID(anyCategory, bookShortLoan):
+		return &LendingRule{ID: id, ReaderCategory: anyCategory, BookCategory: bookShortLoan, LoanDays: &two, MaxRenewals: &zero}
+	case ruleID(anyCategory, bookReference):
+		return &LendingRule{ID: id, ReaderCategory: anyCategory, BookCategory: bookReference, LoanDays: &zero}
+	}
+	return nil
+}
+
+func (t *lendingTerms) apply(r LendingRule) {
+	if r.LoanDays != nil {
+		t.LoanDays = *r.LoanDays
+	}
+	if r.MaxLoans != nil {
+		t.MaxLoans = *r.MaxLoans
+	}
+	if r.MaxRenewals != nil {
+		t.MaxRenewals = *r.MaxRenewals
+	}
+	if r.FinePerDay != nil {
+		t.FinePerDay = *r.FinePerDay
+	}
+}
+
+// resolveTerms starts from the global settings and layers the matching rules
+// from least to most specific: "*:*", "reader:*", "*:book", "reader:book".
+// What a book is for outranks who the reader is, so a "guest:*" rule cannot
+// lend out reference books. Callers must hold mu.
+func resolveTerms(readerCat, bookCat string) (lendingTerms, error) {
+	t := lendingTerms{LoanDays: loanDays, MaxRenewals: renewMax, FinePerDay: finePerDay}
+	for _, id := range []string{
+		ruleID(anyCategory, anyCategory),
+		ruleID(readerCat, anyCategory),
+		ruleID(anyCategory, bookCat),
+		ruleID(readerCat, bookCat),
+	} {
+		r, err := store.LendingRules().ByID(id)
+		if err != nil {
+			return t, err
+		}
+		if r == nil {
+			r = builtinRule(id)
+		}
+		if r != nil {
+			t.apply(*r)
+		}
+	}
+	return t, nil
+}
+
+// Records written before categories existed count as the defaults.
+func readerCategoryOf(u *User) string {
+	if u == nil || u.Category == "" {
+		return readerStudent
+	}
+	return u.Category
+}
+
+func bookCategoryOf(b *Book) string {
+	if b == nil || b.Category == "" {
+		return bookStandard
+	}
+	return b.Category
+}
+
+// termsForLoan resolves the terms a loan runs under, from its reader's and
+// book's categories as they are now. Callers must hold mu.
+func termsForLoan(l Loan, book *Book) (lendingTerms, error) {
+	reader, err := store.Users().ByID(l.ReaderID)
+	if err != nil {
+		return lendingTerms{}, err
+	}
+	return resolveTerms(readerCategoryOf(reader), bookCategoryOf(book))
+}
+
+// Error codes for refused loans and renewals, returned next to the message
+// as "code" so clients need not parse the text.
+const (
+	codeNotLoanable      = "not_loanable"
+	codeLoanLimit        = "loan_limit_reached"
+	codeRenewalLimit     = "renewal_limit_reached"
+	codeTooOverdue       = "too_overdue_to_renew"
+	codeHoldQueue        = "hold_queue_waiting"
+	codeFinesOutstanding = "fines_outstanding"
+)
+
+func policyError(w http.ResponseWriter, status int, code, msg string) {
+	jsonWrite(w, status, map[string]any{"error": msg, "code": code})
+}
+
+// checkBorrow applies the lending rules to reader taking out a copy of book.
+// It returns the terms the loan gets, or a code and message saying why it is
+// refused. Callers must hold mu.
+func checkBorrow(reader *User, book *Book) (lendingTerms, string, string, error) {
+	readerCat, bookCat := readerCategoryOf(reader), bookCategoryOf(book)
+	t, err := resolveTerms(readerCat, bookCat)
+	if err != nil {
+		return t, "", "", err
+	}
+	if t.LoanDays == 0 {
+		return t, codeNotLoanable, "Books in category " + bookCat + " are not lent out", nil
+	}
+	if t.MaxLoans > 0 {
+		loans, err := store.Loans().ByReader(reader.ID)
+		if err != nil {
+			return t, "", "", err
+		}
+		n := 0
+		for _, l := range loans {
+			if !l.active() {
+				continue
+			}
+			b, err := store.Books().ByID(l.BookID)
+			if err != nil {
+				return t, "", "", err
+			}
+			if bookCategoryOf(b) == bookCat {
+				n++
+			}
+		}
+		if n >= t.MaxLoans {
+			return t, codeLoanLimit, fmt.Sprintf("Loan limit reached: %s readers may have %d %s books out at a time", readerCat, t.MaxLoans, bookCat), nil
+		}
+	}
+	return t, "", "", nil
+}
+
+// apiListLendingRules returns the stored rules and, for every pairing of
+// categories, the terms they resolve to.
+func apiListLendingRules(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	rules, err := store.LendingRules().All()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	matrix := []any{}
+	for _, rc := range readerCategories {
+		for _, bc := range bookCategories {
+			t, err := resolveTerms(rc, bc)
+			if err != nil {
+				storeError(w, err)
+				return
+			}
+			matrix = append(matrix, map[string]any{"readerCategory": rc, "bookCategory": bc, "terms": t})
+		}
+	}
+	jsonWrite(w, 200, map[string]any{
+		"readerCategories": readerCategories,
+		"bookCategories":   bookCategories,
+		"rules":            append([]LendingRule{}, rules...),
+		"matrix":           matrix,
+	})
+}
+
+// apiPutLendingRule creates or replaces the rule for a category pairing.
+// POST /api/lending-rules takes the categories in the body; PUT
+// /api/lending-rules/{id} names the rule in the path.
+func apiPutLendingRule(w http.ResponseWriter, r *http.Request) {
+	var rule LendingRule
+	if err := jsonRead(r, &rule); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	if id := strings.TrimPrefix(r.URL.Path, "/api/lending-rules/"); id != r.URL.Path && id != "" {
+		rule.ReaderCategory, rule.BookCategory, _ = strings.Cut(id, ":")
+	}
+	rule.ReaderCategory = strings.ToLower(strings.TrimSpace(rule.ReaderCategory))
+	rule.BookCategory = strings.ToLower(strings.TrimSpace(rule.BookCategory))
+	if rule.ReaderCategory != anyCategory && !validCategory(readerCategories, rule.ReaderCategory) {
+		jsonWrite(w, 400, map[string]any{"error": "readerCategory must be one of " + strings.Join(readerCategories, ", ") + " or *"})
+		return
+	}
+	if rule.BookCategory != anyCategory && !validCategory(bookCategories, rule.BookCategory) {
+		jsonWrite(w, 400, map[string]any{"error": "bookCategory must be one of " + strings.Join(bookCategories, ", ") + " or *"})
+		return
+	}
+	for name, v := range map[string]*int{"loanDays": rule.LoanDays, "maxLoans": rule.MaxLoans, "maxRenewals": rule.MaxRenewals} {
+		if v != nil && *v < 0 {
+			jsonWrite(w, 400, map[string]any{"error": name + " must not be negative"})
+			return
+		}
+	}
+	if rule.FinePerDay != nil && *rule.FinePerDay < 0 {
+		jsonWrite(w, 400, map[string]any{"error": "finePerDay must not be negative"})
+		return
+	}
+	rule.ID = ruleID(rule.ReaderCategory, rule.BookCategory)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	before, err := store.LendingRules().ByID(rule.ID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	err = store.Atomic(func() error {
+		if err := store.LendingRules().Put(rule); err != nil {
+			return err
+		}
+		return recordAudit(r, "rule.put", "lendingRule", rule.ID, before, rule)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, rule)
+}
+
+func apiDeleteLendingRule(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/lending-rules/")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	rule, err := store.LendingRules().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if rule == nil {
+		jsonWrite(w, 404, map[string]any{"error": "Rule not found"})
+		return
+	}
+	err = store.Atomic(func() error {
+		if err := store.LendingRules().Delete(id); err != nil {
+			return err
+		}
+		return recordAudit(r, "rule.delete", "lendingRule", id, rule, nil)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true})
+}
+
+// lendingRulesHandler serves /api/lending-rules and /api/lending-rules/{id}.
+func lendingRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/lending-rules" {
+		switch r.Method {
+		case "GET":
+			requirePermission(permLoansRead, apiListLendingRules)(w, r)
+		case "POST":
+			requirePermission(permRulesManage, apiPutLendingRule)(w, r)
+		default:
+			jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
+		}
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		requirePermission(permRulesManage, apiPutLendingRule)(w, r)
+	case "DELETE":
+		requirePermission(permRulesManage, apiDeleteLendingRule)(w, r)
+	default:
+		jsonWrite(w, 405, map[string]any{"error": "Method not allowed"})
+	}
+}
+
+// apiSetUserCategory moves a reader to another lending category.
+func apiSetUserCategory(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/category")
+	type Req struct {
+		Category string `json:"category"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+	req.Category = strings.ToLower(strings.TrimSpace(req.Category))
+	if !validCategory(readerCategories, req.Category) {
+		jsonWrite(w, 400, map[string]any{"error": "Unknown category"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	before := *u
+	u.Category = req.Category
+	err = store.Atomic(func() error {
+		if err := store.Users().Update(*u); err != nil {
+			return err
+		}
+		return recordAudit(r, "user.setCategory", "user", u.ID, before, u)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{
+		"id": u.ID, "fullName": u.FullName, "email": u.Email, "phone": u.Phone, "role": u.Role, "category": u.Category,
+	})
+}
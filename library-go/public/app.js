@@ -1,30 +1,86 @@
 const API = "";
 const tokenKey = "lib_token";
+const refreshKey = "lib_refresh";
 const userKey = "lib_user";
 
 function getToken(){ return localStorage.getItem(tokenKey) || ""; }
-function setAuth(token, user){
+function setAuth(token, user, refresh){
   localStorage.setItem(tokenKey, token);
-  localStorage.setItem(userKey, JSON.stringify(user));
+  if (refresh) localStorage.setItem(refreshKey, refresh);
+  if (user) localStorage.setItem(userKey, JSON.stringify(user));
 }
 function clearAuth(){
   localStorage.removeItem(tokenKey);
+  localStorage.removeItem(refreshKey);
   localStorage.removeItem(userKey);
 }
 function me(){ try { return JSON.parse(localStorage.getItem(userKey)||"null"); } catch { return null; } }
 
-async function api(path, method="GET", body=null){
-  const headers = { "Content-Type": "application/json" };
+// refreshAuth swaps the stored refresh token for a new token pair.
+async function refreshAuth(){
+  const refreshToken = localStorage.getItem(refreshKey);
+  if (!refreshToken) return false;
+  const res = await fetch(API + "/api/auth/refresh", {
+    method: "POST", headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({refreshToken}),
+  });
+  if (!res.ok) { clearAuth(); return false; }
+  const r = await res.json();
+  setAuth(r.accessToken, null, r.refreshToken);
+  return true;
+}
+
+async function api(path, method="GET", body=null, retried=false){
+  // A string body is sent as is (calendar files), and so is a File (catalog
+  // imports); anything else as JSON.
+  const file = body instanceof Blob;
+  const raw = typeof body === "string" || file;
+  const headers = { "Content-Type": file ? "application/octet-stream" : raw ? "text/calendar" : "application/json" };
   const t = getToken();
   if (t) headers.Authorization = "Bearer " + t;
 
-  const res = await fetch(API + path, { method, headers, body: body?JSON.stringify(body):null });
+  const res = await fetch(API + path, { method, headers, body: raw ? body : body?JSON.stringify(body):null });
+  if (res.status === 401 && t && !retried && await refreshAuth()) {
+    return api(path, method, body, true);
+  }
   const data = await res.json().catch(()=> ({}));
   if (!res.ok) throw new Error(data.error || "Request error");
   return data;
 }
 
 function $(id){ return document.getElementById(id); }
+
+// download saves an authenticated GET response as a file.
+async function download(path, filename){
+  const res = await fetch(API + path, { headers: { Authorization: "Bearer " + getToken() } });
+  if (!res.ok) throw new Error((await res.json().catch(()=>({}))).error || "Request error");
+  const a = document.createElement("a");
+  a.href = URL.createObjectURL(await res.blob());
+  a.download = filename;
+  a.click();
+  URL.revokeObjectURL(a.href);
+}
+
+// bookPager drives a searchable, paged book list: prefix names its search box
+// (<prefix>Search) and pager controls (<prefix>Prev, <prefix>Next,
+// <prefix>Page); render gets each page of books.
+function bookPager(prefix, render){
+  let page = 1;
+  async function load(){
+    const q = encodeURIComponent($(prefix+"Search").value.trim());
+    const archived = $(prefix+"Archived")?.checked ? "&archived=include" : "";
+    const r = await api(`/api/books?q=${q}&page=${page}${archived}`);
+    $(prefix+"Page").textContent = `${r.total} books · page ${r.page} of ${Math.max(r.pages,1)}`;
+    $(prefix+"Prev").disabled = r.page <= 1;
+    $(prefix+"Next").disabled = r.page >= r.pages;
+    render(r.items);
+  }
+  $(prefix+"Search").oninput = ()=>{ page = 1; load(); };
+  if ($(prefix+"Archived")) $(prefix+"Archived").onchange = ()=>{ page = 1; load(); };
+  $(prefix+"Prev").onclick = ()=>{ page--; load(); };
+  $(prefix+"Next").onclick = ()=>{ page++; load(); };
+  return load;
+}
 function show(el, on=true){ el.style.display = on ? "" : "none"; }
 
 
@@ -47,8 +103,8 @@ async function initIndex(){
       const email = $("l_email").value.trim();
       const password = $("l_pass").value.trim();
       const r = await api("/api/auth/login","POST",{email,password});
-      setAuth(r.token, r.user);
-      if (r.user.role === "admin") location.href = "/admin.html";
+      setAuth(r.accessToken, r.user, r.refreshToken);
+      if (r.user.role !== "reader") location.href = "/admin.html";
       else location.href = "/reader.html";
     }catch(e){ $("msg").textContent = e.message; }
   };
@@ -74,17 +130,25 @@ function initTopbar(){
   const u = me();
   if ($("who")) $("who").textContent = u ? `${u.fullName} (${u.role})` : "Guest";
   if ($("logout")){
-    $("logout").onclick = () => { clearAuth(); location.href = "/"; };
+    $("logout").onclick = async () => {
+      await api("/api/auth/logout","POST").catch(()=>{});
+      clearAuth(); location.href = "/";
+    };
   }
 }
 
 
 async function initAdmin(){
   const u = me();
-  if (!u || u.role !== "admin") { location.href="/"; return; }
+  if (!u || u.role === "reader") { location.href="/"; return; }
   initTopbar();
 
-  const tabs = ["books","readers","loans"];
+  const tabs = ["books","readers","loans","calendar"];
+  if (u.role === "admin" || u.role === "auditor") {
+    tabs.push("reports", "audit");
+    show($("tab_reports"), true);
+    show($("tab_audit"), true);
+  }
   let current = "books";
 
   function setTab(t){
@@ -101,40 +165,120 @@ async function initAdmin(){
   async function refresh(){
     $("amsg").textContent = "";
     if (current==="books"){
-      const books = await api("/api/books");
-      renderBooks(books);
+      await loadBooks();
     }
     if (current==="readers"){
-      const readers = await api("/api/users?role=reader");
+      const archived = $("readerArchived").checked ? "&archived=include" : "";
+      const readers = await api("/api/users?role=reader"+archived);
       renderReaders(readers);
     }
     if (current==="loans"){
       const loans = await api("/api/loans");
       renderLoans(loans);
+      renderHolds(await api("/api/holds"));
      
       const readers = await api("/api/users?role=reader");
-      const books = await api("/api/books");
+      const books = (await api("/api/books?sort=title&pageSize=100")).items;
       fillSelect("borrowReader", readers.map(r=>({id:r.id, label:`${r.fullName} (${r.phone})`})));
       fillSelect("borrowBook", books.map(b=>({id:b.id, label:`${b.bookCode} — ${b.title} (${b.availableQty}/${b.totalQty})`})));
     }
+    if (current==="reports"){
+      await loadReport();
+    }
+    if (current==="audit"){
+      await loadAudit();
+    }
+    if (current==="calendar"){
+      const cal = await api("/api/calendar?from=" + new Date().toISOString().slice(0,10));
+      $("hoursList").textContent = cal.hours.map(h=>`${h.id}: ${h.closed ? "closed" : h.open+"–"+h.close}`).join(" · ");
+      $("closedTable").innerHTML = cal.closedDays.map(d=>`
+        <tr>
+          <td>${d.id}</td>
+          <td>${d.reason||""}</td>
+          <td>${d.source||""}</td>
+          <td><button class="secondary" onclick="reopenDay('${d.id}')">Reopen</button></td>
+        </tr>
+      `).join("");
+    }
+  }
+
+  function reportQuery(){
+    const qs = new URLSearchParams({interval: $("reportInterval").value});
+    if ($("reportFrom").value.trim()) qs.set("from", $("reportFrom").value.trim());
+    if ($("reportTo").value.trim()) qs.set("to", $("reportTo").value.trim());
+    return `/api/reports/${$("reportName").value}?${qs}`;
+  }
+  async function loadReport(){
+    const r = await api(reportQuery());
+    $("reportSummary").textContent = `${r.from} – ${r.to} · ` + Object.entries(r.summary).map(([k,v])=>`${k}: ${v}`).join(" · ");
+    $("reportHead").innerHTML = `<tr>${r.columns.map(c=>`<th>${c}</th>`).join("")}</tr>`;
+    $("reportTable").innerHTML = r.items.map(x=>`<tr>${r.columns.map(c=>`<td>${x[c]}</td>`).join("")}</tr>`).join("");
+  }
+  $("reportRun").onclick = ()=>loadReport().catch(e=>$("amsg").textContent = e.message);
+  $("reportName").onchange = $("reportRun").onclick;
+  $("reportCsv").onclick = ()=>download(reportQuery()+"&format=csv", $("reportName").value+".csv").catch(e=>$("amsg").textContent = e.message);
+
+  let auditPage = 1;
+  async function loadAudit(){
+    const qs = new URLSearchParams({page: auditPage});
+    for (const [key, id] of [["actor","auditActor"],["entity","auditEntity"],["entityId","auditEntityId"],["from","auditFrom"],["to","auditTo"]]) {
+      const v = $(id).value.trim();
+      if (v) qs.set(key, v);
+    }
+    const r = await api("/api/audit?" + qs);
+    $("auditPage").textContent = `${r.total} entries · page ${r.page} of ${Math.max(r.pages,1)}`;
+    $("auditPrev").disabled = r.page <= 1;
+    $("auditNext").disabled = r.page >= r.pages;
+    const show = v => v === undefined ? "—" : JSON.stringify(v);
+    $("auditTable").innerHTML = r.items.map(e=>`
+      <tr>
+        <td>${e.seq}</td>
+        <td>${e.at}</td>
+        <td>${e.actorEmail || "anonymous"}</td>
+        <td>${e.ip}</td>
+        <td>${e.action}</td>
+        <td>${e.entity} ${e.entityId}</td>
+        <td class="small">${Object.entries(e.changes||{}).map(([k,c])=>`${k}: ${show(c.before)} → ${show(c.after)}`).join("<br>")}</td>
+      </tr>
+    `).join("");
   }
+  $("auditSearch").onclick = ()=>{ auditPage = 1; loadAudit().catch(e=>$("amsg").textContent = e.message); };
+  $("auditPrev").onclick = ()=>{ auditPage--; loadAudit().catch(e=>$("amsg").textContent = e.message); };
+  $("auditNext").onclick = ()=>{ auditPage++; loadAudit().catch(e=>$("amsg").textContent = e.message); };
+  $("auditVerify").onclick = async ()=>{
+    try{
+      const r = await api("/api/audit/verify");
+      $("auditReport").textContent = r.ok ? `Chain intact (${r.entries} entries)` : `Chain broken at entry ${r.brokenAt}: ${r.reason}`;
+    }catch(e){ $("amsg").textContent = e.message; }
+  };
 
   function fillSelect(id, items){
     const s = $(id);
     s.innerHTML = items.map(x=>`<option value="${x.id}">${x.label}</option>`).join("");
   }
 
+  const loadBooks = bookPager("book", renderBooks);
+
+  let shownBooks = {};
+
   function renderBooks(books){
+    shownBooks = Object.fromEntries(books.map(b=>[b.id,b]));
     $("booksTable").innerHTML = books.map(b=>`
       <tr>
         <td>${b.bookCode}</td>
-        <td>${b.title}</td>
+        <td>${b.title}${b.year ? ` (${b.year})` : ``}</td>
         <td>${b.author}</td>
+        <td>${b.category||"standard"}</td>
         <td>${b.price}</td>
         <td>${b.availableQty} / ${b.totalQty}</td>
         <td>
-          <button class="secondary" onclick="editBook('${b.id}','${escapeStr(b.title)}','${escapeStr(b.author)}',${b.price},${b.totalQty})">Edit</button>
-          <button class="secondary" onclick="delBook('${b.id}')">Delete</button>
+          <button class="secondary" onclick="editBook('${b.id}')">Edit</button>
+          <button class="secondary" onclick="showCopies('${b.id}','${escapeStr(b.bookCode)}')">Copies</button>
+          ${b.archivedAt ? `
+            <span class="badge" title="${escapeStr(b.archiveReason)}">archived ${b.archivedAt.slice(0,10)}</span>
+            <button class="secondary" onclick="restoreRecord('books','${b.id}')">Restore</button>
+            <button class="secondary" onclick="purgeRecord('books','${b.id}')">Purge</button>
+          ` : `<button class="secondary" onclick="delBook('${b.id}')">Archive</button>`}
         </td>
       </tr>
     `).join("");
@@ -148,6 +292,14 @@ async function initAdmin(){
         <td>${r.email}</td>
         <td><span class="badge">${r.role}</span></td>
         <td>${r.createdAt||""}</td>
+        <td>
+          <button class="secondary" onclick="takePayment('${r.id}')">Fines</button>
+          ${r.archivedAt ? `
+            <span class="badge" title="${escapeStr(r.archiveReason)}">archived ${r.archivedAt.slice(0,10)}</span>
+            <button class="secondary" onclick="restoreRecord('users','${r.id}')">Restore</button>
+            <button class="secondary" onclick="purgeRecord('users','${r.id}')">Purge</button>
+          ` : `<button class="secondary" onclick="archiveReader('${r.id}')">Archive</button>`}
+        </td>
       </tr>
     `).join("");
   }
@@ -158,14 +310,16 @@ async function initAdmin(){
         <td>${l.id}</td>
         <td>${l.readerName||""}</td>
         <td>${l.bookCode||""} — ${l.bookTitle||""}</td>
+        <td>${l.barcode||""}</td>
         <td><span class="badge">${l.status}</span></td>
         <td>${l.loanDate||""}</td>
         <td>${l.dueDate||""}</td>
         <td>${l.returnDate||""}</td>
         <td>${l.fineAmount||0}</td>
         <td>
-          ${l.status==="borrowed" ? `
+          ${l.status==="borrowed"||l.status==="overdue" ? `
             <button class="secondary" onclick="returnLoan('${l.id}')">Return</button>
+            <button class="secondary" onclick="renewLoan('${l.id}')">Renew</button>
             <button class="secondary" onclick="lostLoan('${l.id}')">Lost</button>
           ` : ``}
         </td>
@@ -173,23 +327,66 @@ async function initAdmin(){
     `).join("");
   }
 
+  function renderHolds(holds){
+    $("holdsTable").innerHTML = holds.map(h=>`
+      <tr>
+        <td>${h.readerName||""}</td>
+        <td>${h.book?.bookCode||""} — ${h.book?.title||""}</td>
+        <td><span class="badge">${h.status}</span>${h.position ? " #"+h.position : ""}</td>
+        <td>${h.barcode||""}</td>
+        <td>${h.pickupBy||""}</td>
+        <td>${(h.placedAt||"").slice(0,10)}</td>
+      </tr>
+    `).join("");
+  }
+
   function escapeStr(s){ return (s||"").replaceAll("'","&#39;").replaceAll('"',"&quot;"); }
 
  
   window.delBook = async (id)=>{
-    try{ await api("/api/books/"+id,"DELETE"); refresh(); }
+    const reason = prompt("Archive this book? Reason (optional):");
+    if (reason === null) return;
+    try{ await api("/api/books/"+id,"DELETE",{reason}); refresh(); }
+    catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  window.archiveReader = async (id)=>{
+    const reason = prompt("Archive this reader? They will be signed out. Reason (optional):");
+    if (reason === null) return;
+    try{ await api("/api/users/"+id,"DELETE",{reason}); refresh(); }
+    catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  window.restoreRecord = async (kind, id)=>{
+    try{ await api(`/api/${kind}/${id}/restore`,"POST"); refresh(); }
+    catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  window.purgeRecord = async (kind, id)=>{
+    if (!confirm("Delete this record for good? This cannot be undone.")) return;
+    try{ await api(`/api/${kind}/${id}/purge`,"POST"); refresh(); }
     catch(e){ $("amsg").textContent = e.message; }
   };
 
-  window.editBook = (id,title,author,price,totalQty)=>{
+  $("readerArchived").onchange = ()=>refresh().catch(e=>$("amsg").textContent = e.message);
+
+  window.editBook = (id)=>{
+    const b = shownBooks[id];
     $("eb_id").value=id;
-    $("eb_title").value=unescapeHtml(title);
-    $("eb_author").value=unescapeHtml(author);
-    $("eb_price").value=price;
-    $("eb_total").value=totalQty;
+    $("eb_title").value=b.title;
+    $("eb_author").value=b.author;
+    $("eb_isbn").value=b.isbn||"";
+    $("eb_publisher").value=b.publisher||"";
+    $("eb_year").value=b.year||"";
+    $("eb_subjects").value=(b.subjects||[]).join(", ");
+    $("eb_price").value=b.price;
     show($("editBox"), true);
   };
 
+  function subjectList(s){
+    return s.split(",").map(x=>x.trim()).filter(Boolean);
+  }
+
   function unescapeHtml(s){
     return s.replaceAll("&#39;","'").replaceAll("&quot;",'"');
   }
@@ -199,26 +396,113 @@ async function initAdmin(){
   $("saveEdit").onclick = async ()=>{
     try{
       const id = $("eb_id").value;
-      const title = $("eb_title").value.trim();
+      const body = {
+        title: $("eb_title").value.trim(),
+        isbn: $("eb_isbn").value.trim(),
+        publisher: $("eb_publisher").value.trim(),
+        year: Number($("eb_year").value||0),
+        subjects: subjectList($("eb_subjects").value),
+        price: Number($("eb_price").value||0),
+      };
+      // Only a changed byline is sent: it replaces all contributors.
       const author = $("eb_author").value.trim();
-      const price = Number($("eb_price").value||0);
-      const totalQty = Number($("eb_total").value||0);
-      await api("/api/books/"+id,"PATCH",{title,author,price,totalQty});
+      if (author !== shownBooks[id].author) body.author = author;
+      await api("/api/books/"+id,"PATCH",body);
       show($("editBox"), false);
       refresh();
     }catch(e){ $("amsg").textContent = e.message; }
   };
 
+  async function loadCopies(){
+    const id = $("cp_book").value;
+    const copies = await api("/api/books/"+id+"/copies");
+    $("copiesTable").innerHTML = copies.map(c=>`
+      <tr>
+        <td>${c.barcode}</td>
+        <td><span class="badge">${c.status}</span></td>
+        <td>${c.condition}</td>
+        <td>${c.location||""}</td>
+        <td>${c.acquiredAt||""}</td>
+        <td>
+          ${c.status==="available" ? `<button class="secondary" onclick="withdrawCopy('${c.id}')">Withdraw</button>` : ``}
+        </td>
+      </tr>
+    `).join("");
+  }
+
+  window.showCopies = async (id, code)=>{
+    $("cp_book").value = id;
+    $("copiesTitle").textContent = "Copies of " + unescapeHtml(code);
+    show($("copiesBox"), true);
+    try{ await loadCopies(); }
+    catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  window.withdrawCopy = async (id)=>{
+    const reason = prompt("Withdraw reason:");
+    if (reason === null) return;
+    try{ await api("/api/copies/"+id+"/withdraw","POST",{reason}); await loadCopies(); refresh(); }
+    catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  $("closeCopies").onclick = ()=>show($("copiesBox"), false);
+
+  $("addCopyBtn").onclick = async ()=>{
+    try{
+      const barcode = $("cp_barcode").value.trim();
+      const location = $("cp_location").value.trim();
+      await api("/api/books/"+$("cp_book").value+"/copies","POST",{barcode,location});
+      $("cp_barcode").value="";
+      await loadCopies();
+      refresh();
+    }catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  $("marcImportBtn").onclick = async ()=>{
+    const f = $("marcFile").files[0];
+    if (!f) return;
+    $("amsg").textContent = "";
+    try{
+      if (f.name.toLowerCase().endsWith(".csv")) {
+        // CSV rows only add books; dry run and duplicate handling are MARC options.
+        const r = await api("/api/csv/books?mode=best-effort","POST",f);
+        const failed = r.errors.map(x=>`line ${x.line} ${x.error}`);
+        $("marcReport").textContent = `${r.imported} of ${r.rows} imported` + (failed.length ? ` — ${failed.join("; ")}` : ``);
+        $("marcFile").value = "";
+        refresh();
+        return;
+      }
+      const dryRun = $("marcDryRun").checked;
+      const onDuplicate = $("marcUpdate").checked ? "update" : "skip";
+      const r = await api(`/api/books/import?dryRun=${dryRun}&onDuplicate=${onDuplicate}`,"POST",f);
+      const skipped = r.records.filter(x=>x.status==="skipped").map(x=>`#${x.record} ${x.reason}`);
+      $("marcReport").textContent = (dryRun ? "Dry run: " : "") +
+        `${r.created} created, ${r.updated} updated, ${r.skipped} skipped` + (skipped.length ? ` — ${skipped.join("; ")}` : ``);
+      if (!dryRun) { $("marcFile").value = ""; refresh(); }
+    }catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  $("marcExportXml").onclick = ()=>download("/api/books/export?format=marcxml","catalog.xml").catch(e=>$("amsg").textContent = e.message);
+  $("marcExportMrc").onclick = ()=>download("/api/books/export?format=iso2709","catalog.mrc").catch(e=>$("amsg").textContent = e.message);
+  $("csvExportBooks").onclick = ()=>download("/api/csv/books","books.csv").catch(e=>$("amsg").textContent = e.message);
+  $("csvExportUsers").onclick = ()=>download("/api/csv/users","users.csv").catch(e=>$("amsg").textContent = e.message);
+  $("csvExportLoans").onclick = ()=>download("/api/csv/loans","loans.csv").catch(e=>$("amsg").textContent = e.message);
+
   $("addBookBtn").onclick = async ()=>{
     $("amsg").textContent = "";
     try{
       const bookCode = $("b_code").value.trim();
       const title = $("b_title").value.trim();
       const author = $("b_author").value.trim();
+      const isbn = $("b_isbn").value.trim();
+      const publisher = $("b_publisher").value.trim();
+      const year = Number($("b_year").value||0);
+      const subjects = subjectList($("b_subjects").value);
       const price = Number($("b_price").value||0);
       const totalQty = Number($("b_total").value||1);
-      await api("/api/books","POST",{bookCode,title,author,price,totalQty});
-      $("b_code").value=""; $("b_title").value=""; $("b_author").value=""; $("b_price").value=""; $("b_total").value="";
+      const category = $("b_category").value;
+      await api("/api/books","POST",{bookCode,title,author,isbn,publisher,year,subjects,price,totalQty,category});
+      for (const f of ["b_code","b_title","b_author","b_isbn","b_publisher","b_year","b_subjects","b_price","b_total"]) $(f).value="";
       refresh();
     }catch(e){ $("amsg").textContent = e.message; }
   };
@@ -228,8 +512,10 @@ async function initAdmin(){
     try{
       const readerId = $("borrowReader").value;
       const bookId = $("borrowBook").value;
+      const barcode = $("borrowBarcode").value.trim();
       const dueDate = $("borrowDue").value.trim();
-      await api("/api/loans/borrow","POST",{readerId,bookId,dueDate});
+      await api("/api/loans/borrow","POST",barcode ? {readerId,barcode,dueDate} : {readerId,bookId,dueDate});
+      $("borrowBarcode").value="";
       refresh();
     }catch(e){ $("amsg").textContent = e.message; }
   };
@@ -239,6 +525,45 @@ async function initAdmin(){
     catch(e){ $("amsg").textContent = e.message; }
   };
 
+  window.renewLoan = async (loanId)=>{
+    try{ await api("/api/loans/renew","POST",{loanId}); refresh(); }
+    catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  $("closeDayBtn").onclick = async ()=>{
+    try{
+      await api("/api/calendar/closed","POST",{date:$("cd_date").value.trim(), reason:$("cd_reason").value.trim()});
+      $("cd_date").value=""; $("cd_reason").value="";
+      refresh();
+    }catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  $("icsBtn").onclick = async ()=>{
+    const f = $("icsFile").files[0];
+    if (!f) return;
+    try{
+      const r = await api("/api/calendar/import","POST",await f.text());
+      $("icsFile").value = "";
+      await refresh();
+      $("amsg").textContent = `Imported ${r.added} closed days` + (r.skipped.length ? `; skipped: ${r.skipped.join("; ")}` : ``);
+    }catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  window.reopenDay = async (date)=>{
+    try{ await api("/api/calendar/closed/"+date,"DELETE"); refresh(); }
+    catch(e){ $("amsg").textContent = e.message; }
+  };
+
+  window.takePayment = async (userId)=>{
+    try{
+      const acct = await api("/api/users/"+userId+"/fines");
+      const amount = prompt(`Balance: ${acct.balance}. Payment amount (KZT):`);
+      if (!amount || amount.trim() === "") return;
+      await api("/api/users/"+userId+"/fines/payments","POST",{amount:Number(amount)});
+      refresh();
+    }catch(e){ $("amsg").textContent = e.message; }
+  };
+
   window.lostLoan = async (loanId)=>{
     const fine = prompt("Fine amount (KZT). Бос қалдырса — кітап бағасы:");
     try{
@@ -258,17 +583,32 @@ async function initReader(){
   if (!u || u.role !== "reader") { location.href="/"; return; }
   initTopbar();
 
-  async function refresh(){
-    $("rmsg").textContent = "";
-    try{
-      const books = await api("/api/books");
-      $("rBooks").innerHTML = books.map(b=>`
+  const loadBooks = bookPager("rBook", books=>{
+    $("rBooks").innerHTML = books.map(b=>`
         <tr>
           <td>${b.bookCode}</td>
           <td>${b.title}</td>
           <td>${b.author}</td>
           <td>${b.price}</td>
           <td>${b.availableQty}/${b.totalQty}</td>
+          <td>${b.availableQty===0 && b.totalQty>0 ? `<button class="secondary" onclick="placeHold('${b.id}')">Hold</button>` : ``}</td>
+        </tr>
+      `).join("");
+  });
+
+  async function refresh(){
+    $("rmsg").textContent = "";
+    try{
+      await loadBooks();
+
+      const holds = await api("/api/holds/mine");
+      $("myHolds").innerHTML = holds.map(h=>`
+        <tr>
+          <td>${h.book?.bookCode||""} — ${h.book?.title||""}</td>
+          <td><span class="badge">${h.status}</span></td>
+          <td>${h.position||""}</td>
+          <td>${h.pickupBy||""}</td>
+          <td>${h.status==="waiting"||h.status==="ready" ? `<button class="secondary" onclick="cancelHold('${h.id}')">Cancel</button>` : ``}</td>
         </tr>
       `).join("");
 
@@ -282,11 +622,39 @@ async function initReader(){
           <td>${x.dueDate||""}</td>
           <td>${x.returnDate||""}</td>
           <td>${x.fineAmount||0}</td>
+          <td>${x.status==="borrowed"||x.status==="overdue" ? `<button class="secondary" onclick="renewLoan('${x.id}')">Renew</button>` : ``}</td>
+        </tr>
+      `).join("");
+
+      const fines = await api("/api/myfines");
+      $("myBalance").textContent = `Balance: ${fines.balance}` + (fines.accruing > 0 ? ` (plus ${fines.accruing} accruing on overdue loans)` : ``);
+      $("myFines").innerHTML = fines.transactions.map(t=>`
+        <tr>
+          <td>${(t.createdAt||"").slice(0,10)}</td>
+          <td>${t.loanId||""}</td>
+          <td><span class="badge">${t.kind}</span></td>
+          <td>${t.amount}</td>
+          <td>${t.reason||""}</td>
         </tr>
       `).join("");
     }catch(e){ $("rmsg").textContent = e.message; }
   }
 
+  window.renewLoan = async (loanId)=>{
+    try{ await api("/api/loans/renew","POST",{loanId}); refresh(); }
+    catch(e){ $("rmsg").textContent = e.message; }
+  };
+
+  window.placeHold = async (bookId)=>{
+    try{ await api("/api/holds","POST",{bookId}); refresh(); }
+    catch(e){ $("rmsg").textContent = e.message; }
+  };
+
+  window.cancelHold = async (id)=>{
+    try{ await api("/api/holds/"+id+"/cancel","POST"); refresh(); }
+    catch(e){ $("rmsg").textContent = e.message; }
+  };
+
   refresh();
 }
 
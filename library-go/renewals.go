@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Renewal policy: each renewal pushes the due date by the loan period of the
+// loan's lending rule, at most renewMax times per loan (RENEW_MAX) unless the
+// rule sets its own limit. A loan more than
+// renewGraceDays overdue (RENEW_GRACE_DAYS) has to come back to the desk.
+var (
+	renewMax       = 2
+	renewGraceDays = 3
+)
+
+func loadRenewalConfig() {
+	if n, err := strconv.Atoi(os.Getenv("RENEW_MAX")); err == nil && n >= 0 {
+		renewMax = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("RENEW_GRACE_DAYS")); err == nil && n >= 0 {
+		renewGraceDays = n
+	}
+}
+
+// apiRenew extends an active loan. Readers may renew their own loans; staff
+// with loans:issue may renew anyone's.
+func apiRenew(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		LoanID string `json:"loanId"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Bad JSON"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := authUser(r)
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+	loan, err := store.Loans().ByID(req.LoanID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if loan == nil || (loan.ReaderID != u.ID && !hasPermission(u, permLoansIssue)) {
+		jsonWrite(w, 404, map[string]any{"error": "Loan not found"})
+		return
+	}
+	if !loan.active() {
+		jsonWrite(w, 400, map[string]any{"error": "Loan is not active"})
+		return
+	}
+	book, err := store.Books().ByID(loan.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	terms, err := termsForLoan(*loan, book)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if terms.LoanDays == 0 {
+		policyError(w, 400, codeNotLoanable, "Books in category "+bookCategoryOf(book)+" are not lent out")
+		return
+	}
+	if loan.Renewals >= terms.MaxRenewals {
+		policyError(w, 400, codeRenewalLimit, fmt.Sprintf("Renewal limit reached (%d)", terms.MaxRenewals))
+		return
+	}
+
+	due, err := parseDate(loan.DueDate)
+	if err != nil {
+		jsonWrite(w, 400, map[string]any{"error": "Loan has no valid due date; renew it at the desk"})
+		return
+	}
+	cal, err := loadCalendar()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	day := today()
+	late := cal.daysLate(*loan, day)
+	if late > renewGraceDays {
+		policyError(w, 400, codeTooOverdue, "Loan is too far overdue to renew; please return it")
+		return
+	}
+
+	if err := expireHolds(); err != nil {
+		storeError(w, err)
+		return
+	}
+	holds, err := store.Holds().ByBook(loan.BookID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	for _, h := range holds {
+		if h.Status == holdWaiting {
+			policyError(w, 400, codeHoldQueue, "Another reader is waiting for this book")
+			return
+		}
+	}
+
+	var price Money
+	if book != nil {
+		price = book.Price
+	}
+
+	before := *loan
+	// Renewing an overdue loan counts from today, not from the missed date,
+	// and keeps the fine it has run up so far.
+	if day.After(due) {
+		loan.CarriedFine = overdueFine(*loan, late, terms.FinePerDay, price)
+		due = day
+	}
+	loan.DueDate = cal.dueDate(due, terms.LoanDays)
+	loan.Renewals++
+	loan.Status = loanBorrowed
+	loan.FineAmount = loan.CarriedFine
+	err = store.Atomic(func() error {
+		if err := store.Loans().Update(*loan); err != nil {
+			return err
+		}
+		return recordAudit(r, "loan.renew", "loan", loan.ID, before, loan)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, loan)
+}
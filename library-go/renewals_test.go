@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// March 2026 starts on a Sunday; 2026-03-02 is a Monday.
+func TestRenewFollowsLendingRule(t *testing.T) {
+	days := func(n int) *int { return &n }
+	tests := []struct {
+		name     string
+		loanDays *int
+		wantCode int
+		wantDue  string
+	}{
+		{name: "rule's loan period", loanDays: days(3), wantCode: 200, wantDue: "2026-03-05"},
+		{name: "library use only", loanDays: days(0), wantCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestStore(t)
+			setClock(t, "2026-03-02")
+			rule := LendingRule{ID: ruleID(readerStudent, bookStandard), ReaderCategory: readerStudent,
+				BookCategory: bookStandard, LoanDays: tt.loanDays, MaxRenewals: days(2)}
+			if err := store.LendingRules().Put(rule); err != nil {
+				t.Fatal(err)
+			}
+			id := seedFineLoan(t, "2026-03-02", 0, loanBorrowed, 0)
+			reader := &User{ID: "U1", Role: "reader"}
+
+			w := call(apiRenew, authRequest(t, reader, "POST", "/api/loans/renew", `{"loanId":"`+id+`"}`))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != 200 {
+				var body map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["code"] != codeNotLoanable {
+					t.Errorf("code %q, want %q", body["code"], codeNotLoanable)
+				}
+				return
+			}
+			l, _ := store.Loans().ByID(id)
+			if l.DueDate != tt.wantDue || l.Renewals != 1 {
+				t.Errorf("after renewal: due %s, renewals %d; want %s, 1", l.DueDate, l.Renewals, tt.wantDue)
+			}
+		})
+	}
+}
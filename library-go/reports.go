@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A report is a table: a row of named columns per item, plus totals for the
+// whole period in summary. JSON carries both; CSV carries the rows only.
+type report struct {
+	columns []string
+	rows    [][]any
+	summary map[string]any
+}
+
+// reportParams are the query parameters every report reads. from and to
+// bound the period by date, both inclusive; they default to the last 30
+// days.
+type reportParams struct {
+	from, to string
+	limit    int
+	qs       url.Values
+}
+
+func (p reportParams) inPeriod(date string) bool {
+	return date != "" && date >= p.from && date <= p.to
+}
+
+// reportData is the part of the loan history a report looks at, joined once
+// so a report is a single pass over it with map lookups instead of a store
+// read per loan: the loans issued in the period, the ones returned or lost
+// in it, and the books, readers and copies they name. Nothing outside the
+// period is read.
+type reportData struct {
+	issued []Loan
+	closed []Loan
+	books  map[string]Book
+	users  map[string]User
+	copies map[string]Copy
+}
+
+func loadReportData(p reportParams) (*reportData, error) {
+	issued, err := store.Loans().ByLoanDate(p.from, p.to)
+	if err != nil {
+		return nil, err
+	}
+	closed, err := store.Loans().ByReturnDate(p.from, p.to)
+	if err != nil {
+		return nil, err
+	}
+	d := &reportData{issued: issued, closed: closed, books: map[string]Book{}, users: map[string]User{}, copies: map[string]Copy{}}
+	for _, loans := range [][]Loan{issued, closed} {
+		for _, l := range loans {
+			if err := reportLoad(d.books, l.BookID, store.Books().ByID); err != nil {
+				return nil, err
+			}
+			if err := reportLoad(d.users, l.ReaderID, store.Users().ByID); err != nil {
+				return nil, err
+			}
+			if err := reportLoad(d.copies, l.CopyID, store.Copies().ByID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// reportLoad reads record id into m unless it is there already. A record
+// that is gone is kept as the zero value, so it is only looked for once.
+func reportLoad[T any](m map[string]T, id string, byID func(string) (*T, error)) error {
+	if _, ok := m[id]; ok || id == "" {
+		return nil
+	}
+	v, err := byID(id)
+	if err != nil {
+		return err
+	}
+	var zero T
+	if v == nil {
+		v = &zero
+	}
+	m[id] = *v
+	return nil
+}
+
+type counted struct {
+	id    string
+	n     int
+	books map[string]bool
+}
+
+// topCounts orders counts by n, then id, and keeps the first limit.
+func topCounts(m map[string]*counted, limit int) []*counted {
+	out := make([]*counted, 0, len(m))
+	for _, c := range m {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].n != out[j].n {
+			return out[i].n > out[j].n
+		}
+		return out[i].id < out[j].id
+	})
+	return out[:min(limit, len(out))]
+}
+
+// reportTopBooks ranks titles by loans issued in the period.
+func reportTopBooks(d *reportData, p reportParams) (*report, error) {
+	byBook := map[string]*counted{}
+	total := 0
+	for _, l := range d.issued {
+		total++
+		if byBook[l.BookID] == nil {
+			byBook[l.BookID] = &counted{id: l.BookID}
+		}
+		byBook[l.BookID].n++
+	}
+	rep := &report{
+		columns: []string{"bookId", "bookCode", "title", "author", "loans"},
+		summary: map[string]any{"loans": total, "titles": len(byBook)},
+	}
+	for _, c := range topCounts(byBook, p.limit) {
+		b := d.books[c.id]
+		rep.rows = append(rep.rows, []any{c.id, b.BookCode, b.Title, b.Author, c.n})
+	}
+	return rep, nil
+}
+
+// reportTopAuthors ranks authors by loans of the books they wrote; a loan
+// of a co-written book counts for each author.
+func reportTopAuthors(d *reportData, p reportParams) (*report, error) {
+	byAuthor := map[string]*counted{}
+	names := map[string]string{}
+	for _, l := range d.issued {
+		for _, c := range d.books[l.BookID].Contributors {
+			if c.Role != roleAuthor {
+				continue
+			}
+			if byAuthor[c.AuthorID] == nil {
+				byAuthor[c.AuthorID] = &counted{id: c.AuthorID, books: map[string]bool{}}
+				names[c.AuthorID] = c.Name
+			}
+			byAuthor[c.AuthorID].n++
+			byAuthor[c.AuthorID].books[l.BookID] = true
+		}
+	}
+	rep := &report{
+		columns: []string{"authorId", "name", "loans", "titles"},
+		summary: map[string]any{"authors": len(byAuthor)},
+	}
+	for _, c := range topCounts(byAuthor, p.limit) {
+		rep.rows = append(rep.rows, []any{c.id, names[c.id], c.n, len(c.books)})
+	}
+	return rep, nil
+}
+
+// reportCirculation counts loans issued, returned and lost per day or, with
+// ?interval=month, per month. Every bucket in the period is listed, quiet
+// ones with zeros.
+func reportCirculation(d *reportData, p reportParams) (*report, error) {
+	interval := p.qs.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if interval != "day" && interval != "month" {
+		return nil, reportError("interval must be day or month")
+	}
+	bucket := func(date string) string {
+		if interval == "month" && len(date) >= 7 {
+			return date[:7]
+		}
+		return date
+	}
+	type counts struct{ issued, returned, lost int }
+	by := map[string]*counts{}
+	var keys []string
+	from, _ := parseDate(p.from)
+	to, _ := parseDate(p.to)
+	for t := from; !t.After(to); t = t.AddDate(0, 0, 1) {
+		k := bucket(t.Format(dateLayout))
+		if by[k] == nil {
+			by[k] = &counts{}
+			keys = append(keys, k)
+		}
+	}
+	var total counts
+	for _, l := range d.issued {
+		if c := by[bucket(l.LoanDate)]; c != nil {
+			c.issued++
+			total.issued++
+		}
+	}
+	for _, l := range d.closed {
+		if c := by[bucket(l.ReturnDate)]; c != nil {
+			switch l.Status {
+			case loanReturned:
+				c.returned++
+				total.returned++
+			case loanLost:
+				c.lost++
+				total.lost++
+			}
+		}
+	}
+	rep := &report{
+		columns: []string{interval, "issued", "returned", "lost"},
+		summary: map[string]any{"issued": total.issued, "returned": total.returned, "lost": total.lost},
+	}
+	for _, k := range keys {
+		c := by[k]
+		rep.rows = append(rep.rows, []any{k, c.issued, c.returned, c.lost})
+	}
+	return rep, nil
+}
+
+// reportOverdue looks at the loans issued in the period: how many came back
+// after their due date, how many are out past it now, and the share of all
+// of them that went overdue. The breakdown is per reader category.
+func reportOverdue(d *reportData, p reportParams) (*report, error) {
+	type counts struct{ loans, returnedLate, overdueNow int }
+	by := map[string]*counts{}
+	var total counts
+	now := nowDate()
+	for _, l := range d.issued {
+		u := d.users[l.ReaderID]
+		cat := readerCategoryOf(&u)
+		if by[cat] == nil {
+			by[cat] = &counts{}
+		}
+		c := by[cat]
+		c.loans++
+		total.loans++
+		switch {
+		case l.active() && l.DueDate != "" && l.DueDate < now:
+			c.overdueNow++
+			total.overdueNow++
+		case l.Status == loanReturned && l.DueDate != "" && l.ReturnDate > l.DueDate:
+			c.returnedLate++
+			total.returnedLate++
+		}
+	}
+	rate := func(c counts) float64 {
+		if c.loans == 0 {
+			return 0
+		}
+		return float64(c.returnedLate+c.overdueNow) / float64(c.loans)
+	}
+	rep := &report{
+		columns: []string{"readerCategory", "loans", "returnedLate", "overdueNow", "overdueRate"},
+		summary: map[string]any{"loans": total.loans, "returnedLate": total.returnedLate, "overdueNow": total.overdueNow, "overdueRate": rate(total)},
+	}
+	for _, cat := range readerCategories {
+		if c := by[cat]; c != nil {
+			rep.rows = append(rep.rows, []any{cat, c.loans, c.returnedLate, c.overdueNow, rate(*c)})
+		}
+	}
+	return rep, nil
+}
+
+// reportFines lists readers who owe money now, largest balance first, with
+// what the ledger took in over the period in the summary. Accruing is the
+// running fine on loans still out, not yet on the ledger.
+func reportFines(d *reportData, p reportParams) (*report, error) {
+	txs, err := store.Fines().All()
+	if err != nil {
+		return nil, err
+	}
+	balance := map[string]Money{}
+	period := map[string]Money{}
+	for _, tx := range txs {
+		sign := Money(1)
+		if tx.Kind == finePayment || tx.Kind == fineWaiver {
+			sign = -1
+		}
+		balance[tx.UserID] += sign * tx.Amount
+		if len(tx.CreatedAt) >= 10 && p.inPeriod(tx.CreatedAt[:10]) {
+			period[tx.Kind] += tx.Amount
+		}
+	}
+	accruing := map[string]Money{}
+	var totalAccruing Money
+	for _, status := range []string{loanBorrowed, loanOverdue} {
+		open, err := store.Loans().ByStatus(status)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range open {
+			if l.FineAmount > 0 {
+				accruing[l.ReaderID] += l.FineAmount
+				totalAccruing += l.FineAmount
+			}
+		}
+	}
+
+	var owing []string
+	var outstanding, credit Money
+	for id, b := range balance {
+		switch {
+		case b > 0:
+			owing = append(owing, id)
+			outstanding += b
+		case b < 0:
+			credit -= b
+		}
+	}
+	sort.Slice(owing, func(i, j int) bool {
+		if balance[owing[i]] != balance[owing[j]] {
+			return balance[owing[i]] > balance[owing[j]]
+		}
+		return owing[i] < owing[j]
+	})
+	rep := &report{
+		columns: []string{"readerId", "fullName", "email", "balance", "accruing"},
+		summary: map[string]any{
+			"outstanding":  outstanding,
+			"readersOwing": len(owing),
+			"credit":       credit,
+			"accruing":     totalAccruing,
+			"assessed":     period[fineAssessed],
+			"paid":         period[finePayment],
+			"waived":       period[fineWaiver],
+			"refunded":     period[fineRefund],
+		},
+	}
+	for _, id := range owing {
+		if err := reportLoad(d.users, id, store.Users().ByID); err != nil {
+			return nil, err
+		}
+		u := d.users[id]
+		rep.rows = append(rep.rows, []any{id, u.FullName, u.Email, balance[id], accruing[id]})
+	}
+	return rep, nil
+}
+
+// reportInactiveReaders lists readers who have not borrowed since ?since
+// (default 180 days ago), longest idle first; those who never borrowed come
+// first of all. It ignores from and to.
+func reportInactiveReaders(d *reportData, p reportParams) (*report, error) {
+	since := p.qs.Get("since")
+	if since == "" {
+		since = today().AddDate(0, 0, -180).Format(dateLayout)
+	} else if _, err := parseDate(since); err != nil {
+		return nil, reportError("since must be YYYY-MM-DD")
+	}
+	// Readers who borrowed since are found from the loans issued since; only
+	// the idle ones need their own history read, for their last loan date.
+	recent, err := store.Loans().ByLoanDate(since, nowDate())
+	if err != nil {
+		return nil, err
+	}
+	active := map[string]bool{}
+	for _, l := range recent {
+		active[l.ReaderID] = true
+	}
+	users, err := store.Users().All()
+	if err != nil {
+		return nil, err
+	}
+	last := map[string]string{}
+	var idle []User
+	readers := 0
+	for _, u := range users {
+		if u.Role != "reader" || u.archived() {
+			continue
+		}
+		readers++
+		if active[u.ID] {
+			continue
+		}
+		loans, err := store.Loans().ByReader(u.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range loans {
+			if l.LoanDate > last[u.ID] {
+				last[u.ID] = l.LoanDate
+			}
+		}
+		if last[u.ID] < since {
+			idle = append(idle, u)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		a, b := last[idle[i].ID], last[idle[j].ID]
+		if a != b {
+			return a < b
+		}
+		return idle[i].ID < idle[j].ID
+	})
+	rep := &report{
+		columns: []string{"readerId", "fullName", "email", "phone", "category", "createdAt", "lastLoanDate"},
+		summary: map[string]any{"since": since, "readers": readers, "inactive": len(idle)},
+	}
+	for _, u := range idle {
+		rep.rows = append(rep.rows, []any{u.ID, u.FullName, u.Email, u.Phone, readerCategoryOf(&u), u.CreatedAt, last[u.ID]})
+	}
+	return rep, nil
+}
+
+// reportLosses lists the copies marked lost in the period, with the fine
+// charged and the book's list price as the value lost.
+func reportLosses(d *reportData, p reportParams) (*report, error) {
+	var lost []Loan
+	for _, l := range d.closed {
+		if l.Status == loanLost {
+			lost = append(lost, l)
+		}
+	}
+	sort.SliceStable(lost, func(i, j int) bool { return lost[i].ReturnDate < lost[j].ReturnDate })
+	var charged, value Money
+	rep := &report{columns: []string{"date", "loanId", "bookId", "bookCode", "title", "barcode", "readerId", "readerName", "fineCharged", "price"}}
+	for _, l := range lost {
+		b, u := d.books[l.BookID], d.users[l.ReaderID]
+		charged += l.FineAmount
+		value += b.Price
+		rep.rows = append(rep.rows, []any{l.ReturnDate, l.ID, l.BookID, b.BookCode, b.Title, d.copies[l.CopyID].Barcode, l.ReaderID, u.FullName, l.FineAmount, b.Price})
+	}
+	rep.summary = map[string]any{"copiesLost": len(lost), "fineCharged": charged, "value": value}
+	return rep, nil
+}
+
+var reports = map[string]func(*reportData, reportParams) (*report, error){
+	"top-books":        reportTopBooks,
+	"top-authors":      reportTopAuthors,
+	"circulation":      reportCirculation,
+	"overdue":          reportOverdue,
+	"fines":            reportFines,
+	"inactive-readers": reportInactiveReaders,
+	"losses":           reportLosses,
+}
+
+// reportError is a bad report parameter, answered with 400.
+type reportError string
+
+func (e reportError) Error() string { return string(e) }
+
+// reportCell formats a value for CSV the way it reads in JSON.
+func reportCell(v any) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case int:
+		return strconv.Itoa(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', 4, 64)
+	case Money:
+		return x.String()
+	}
+	return ""
+}
+
+// apiReport serves GET /api/reports/{name}?from=&to=&limit=&format=json|csv.
+func apiReport(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/reports/")
+	build, ok := reports[name]
+	if !ok {
+		names := make([]string, 0, len(reports))
+		for n := range reports {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		jsonWrite(w, 404, map[string]any{"error": "Unknown report", "reports": names})
+		return
+	}
+	qs := r.URL.Query()
+	format := qs.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		jsonWrite(w, 400, map[string]any{"error": "format must be json or csv"})
+		return
+	}
+	p := reportParams{from: qs.Get("from"), to: qs.Get("to"), limit: 10, qs: qs}
+	if p.to == "" {
+		p.to = nowDate()
+	}
+	if p.from == "" {
+		to, err := parseDate(p.to)
+		if err == nil {
+			p.from = to.AddDate(0, 0, -29).Format(dateLayout)
+		}
+	}
+	from, err1 := parseDate(p.from)
+	to, err2 := parseDate(p.to)
+	if err1 != nil || err2 != nil || to.Before(from) {
+		jsonWrite(w, 400, map[string]any{"error": "from and to must be YYYY-MM-DD with from not after to"})
+		return
+	}
+	if to.Sub(from) > 10*366*24*time.Hour {
+		jsonWrite(w, 400, map[string]any{"error": "The period may be at most ten years"})
+		return
+	}
+	if v := qs.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			jsonWrite(w, 400, map[string]any{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+			return
+		}
+		p.limit = n
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	d, err := loadReportData(p)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	rep, err := build(d, p)
+	if msg, ok := err.(reportError); ok {
+		jsonWrite(w, 400, map[string]any{"error": string(msg)})
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+"-"+p.from+"-"+p.to+`.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write(rep.columns)
+		rec := make([]string, len(rep.columns))
+		for _, row := range rep.rows {
+			for i, v := range row {
+				rec[i] = reportCell(v)
+			}
+			_ = cw.Write(rec)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("report %s: %v", name, err)
+		}
+		return
+	}
+	items := make([]map[string]any, 0, len(rep.rows))
+	for _, row := range rep.rows {
+		item := make(map[string]any, len(row))
+		for i, v := range row {
+			item[rep.columns[i]] = v
+		}
+		items = append(items, item)
+	}
+	jsonWrite(w, 200, map[string]any{
+		"report":  name,
+		"from":    p.from,
+		"to":      p.to,
+		"columns": rep.columns,
+		"summary": rep.summary,
+		"items":   items,
+	})
+}
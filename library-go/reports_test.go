@@ -0,0 +1,111 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// seedReportLoans stores one reader, one book and loans spread around
+// March 2026.
+func seedReportLoans(t *testing.T) {
+	t.Helper()
+	if err := store.Users().Create(User{ID: "U1", Email: "r@x.kz", Role: "reader", Category: readerStudent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Books().Create(Book{ID: "B1", BookCode: "C1", Title: "Abai Joly", Category: bookStandard, Price: 5000}); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []Loan{
+		{ID: "L1", LoanDate: "2026-02-20", ReturnDate: "2026-03-02", Status: loanReturned},
+		{ID: "L2", LoanDate: "2026-03-01", ReturnDate: "2026-03-10", Status: loanReturned},
+		{ID: "L3", LoanDate: "2026-03-05", ReturnDate: "2026-04-02", Status: loanLost, FineAmount: 5000},
+		{ID: "L4", LoanDate: "2026-03-31", DueDate: "2026-04-07", Status: loanBorrowed},
+		{ID: "L5", LoanDate: "2026-04-01", DueDate: "2026-04-08", Status: loanOverdue, FineAmount: 1000},
+	} {
+		l.ReaderID, l.BookID = "U1", "B1"
+		if err := store.Loans().Create(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func loanIDs(loans []Loan) []string {
+	ids := []string{}
+	for _, l := range loans {
+		ids = append(ids, l.ID)
+	}
+	return ids
+}
+
+func TestLoansByDate(t *testing.T) {
+	stores := map[string]func(t *testing.T){
+		"json": func(t *testing.T) { openTestStore(t) },
+		"sqlite": func(t *testing.T) {
+			s, err := openSQLiteStore(t.TempDir()+"/library.db", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := store
+			store = s
+			t.Cleanup(func() {
+				store = old
+				s.Close()
+			})
+		},
+	}
+	tests := []struct {
+		name     string
+		query    func(from, to string) ([]Loan, error)
+		from, to string
+		want     []string
+	}{
+		{"issued in March", func(f, t string) ([]Loan, error) { return store.Loans().ByLoanDate(f, t) }, "2026-03-01", "2026-03-31", []string{"L2", "L3", "L4"}},
+		{"issued on one day", func(f, t string) ([]Loan, error) { return store.Loans().ByLoanDate(f, t) }, "2026-04-01", "2026-04-01", []string{"L5"}},
+		{"closed in March", func(f, t string) ([]Loan, error) { return store.Loans().ByReturnDate(f, t) }, "2026-03-01", "2026-03-31", []string{"L1", "L2"}},
+		{"empty period", func(f, t string) ([]Loan, error) { return store.Loans().ByLoanDate(f, t) }, "2025-01-01", "2025-12-31", []string{}},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			open(t)
+			seedReportLoans(t)
+			for _, tt := range tests {
+				loans, err := tt.query(tt.from, tt.to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := loanIDs(loans); !slices.Equal(got, tt.want) {
+					t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReportsReadOnlyThePeriod(t *testing.T) {
+	openTestStore(t)
+	setClock(t, "2026-04-03")
+	seedReportLoans(t)
+	p := reportParams{from: "2026-03-01", to: "2026-03-31", limit: 10}
+	d, err := loadReportData(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loanIDs(d.issued); !slices.Equal(got, []string{"L2", "L3", "L4"}) {
+		t.Errorf("issued = %v", got)
+	}
+
+	circ, err := reportCirculation(d, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := circ.summary; s["issued"] != 3 || s["returned"] != 2 || s["lost"] != 0 {
+		t.Errorf("circulation summary = %v, want 3 issued, 2 returned, 0 lost", s)
+	}
+	fines, err := reportFines(d, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fines.summary["accruing"]; got != Money(1000) {
+		t.Errorf("accruing = %v, want 1000 from the loan issued after the period", got)
+	}
+}
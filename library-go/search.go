@@ -0,0 +1,372 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// foldRunes maps letters to the plain Latin the search index is kept in:
+// Kazakh and Russian Cyrillic are transliterated (Kazakh Latin spelling, so
+// "Абай жолы" and "Abai Joly" meet) and accented Latin loses its marks.
+var foldRunes = map[rune]string{
+	'а': "a", 'ә': "a", 'б': "b", 'в': "v", 'г': "g", 'ғ': "g", 'д': "d", 'е': "e", 'ё': "io",
+	'ж': "j", 'з': "z", 'и': "i", 'й': "i", 'і': "i", 'к': "k", 'қ': "k", 'л': "l", 'м': "m",
+	'н': "n", 'ң': "n", 'о': "o", 'ө': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ұ': "u", 'ү': "u", 'ф': "f", 'х': "h", 'һ': "h", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "sh",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "iu", 'я': "ia",
+
+	'á': "a", 'à': "a", 'â': "a", 'ä': "a", 'ã': "a", 'å': "a", 'ā': "a", 'ç': "c", 'č': "c",
+	'é': "e", 'è': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ğ': "g", 'í': "i", 'ì': "i", 'î': "i",
+	'ï': "i", 'ı': "i", 'ñ': "n", 'ń': "n", 'ó': "o", 'ò': "o", 'ô': "o", 'ö': "o", 'õ': "o",
+	'ō': "o", 'ş': "s", 'ś': "s", 'š': "s", 'ú': "u", 'ù': "u", 'û': "u", 'ü': "u", 'ū': "u",
+	'ý': "y", 'ÿ': "y", 'ž': "z", 'ß': "ss",
+}
+
+// foldText lower-cases s and folds it as foldRunes says. Combining marks
+// (from decomposed input) are dropped.
+func foldText(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if f, ok := foldRunes[r]; ok {
+			b.WriteString(f)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// tokenize splits text into folded words.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r)
+	})
+	out := make([]string, 0, len(words))
+	for _, w := range words {
+		if t := foldText(w); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// catalogIndex is an inverted index over book titles, contributors, codes,
+// ISBNs and subjects. It lives in memory, is built at startup and is kept
+// current by the book handlers. Callers must hold mu.
+type catalogIndex struct {
+	postings map[string]map[string]bool // token -> book IDs
+	terms    map[string][]string        // book ID -> its tokens, for removal
+	// sorted holds the tokens of postings in order, so a word's exact and
+	// prefix matches are one binary search away. It is re-sorted on the
+	// first search after a token was added or dropped, which lets an import
+	// index thousands of books without paying for each.
+	sorted []string
+	stale  bool
+}
+
+var catalog = newCatalogIndex()
+
+func newCatalogIndex() *catalogIndex {
+	return &catalogIndex{postings: map[string]map[string]bool{}, terms: map[string][]string{}}
+}
+
+// rebuildCatalog indexes every stored book from scratch.
+func rebuildCatalog() error {
+	books, err := store.Books().All()
+	if err != nil {
+		return err
+	}
+	catalog = newCatalogIndex()
+	for _, b := range books {
+		catalog.put(b)
+	}
+	return nil
+}
+
+// put (re)indexes b.
+func (ix *catalogIndex) put(b Book) {
+	ix.remove(b.ID)
+	text := []string{b.Title, b.Author, b.BookCode, b.ISBN}
+	for _, c := range b.Contributors {
+		text = append(text, c.Name)
+	}
+	text = append(text, b.Subjects...)
+	terms := tokenize(strings.Join(text, " "))
+	for _, t := range terms {
+		if ix.postings[t] == nil {
+			ix.postings[t] = map[string]bool{}
+			ix.stale = true
+		}
+		ix.postings[t][b.ID] = true
+	}
+	ix.terms[b.ID] = terms
+}
+
+func (ix *catalogIndex) remove(id string) {
+	for _, t := range ix.terms[id] {
+		delete(ix.postings[t], id)
+		if len(ix.postings[t]) == 0 {
+			delete(ix.postings, t)
+			ix.stale = true
+		}
+	}
+	delete(ix.terms, id)
+}
+
+// search returns the books matching every query word, scored 2 for each
+// word matched exactly and 1 for a prefix match ("aba" finds "Abai").
+func (ix *catalogIndex) search(q string) map[string]int {
+	words := tokenize(q)
+	if len(words) == 0 {
+		return nil
+	}
+	if ix.stale {
+		ix.sorted = ix.sorted[:0]
+		for t := range ix.postings {
+			ix.sorted = append(ix.sorted, t)
+		}
+		slices.Sort(ix.sorted)
+		ix.stale = false
+	}
+	var scores map[string]int
+	for _, w := range words {
+		hit := map[string]int{}
+		// Every token with w as a prefix sorts at or right after w itself.
+		i, _ := slices.BinarySearch(ix.sorted, w)
+		for ; i < len(ix.sorted) && strings.HasPrefix(ix.sorted[i], w); i++ {
+			term, score := ix.sorted[i], 1
+			if term == w {
+				score = 2
+			}
+			for id := range ix.postings[term] {
+				hit[id] = max(hit[id], score)
+			}
+		}
+		if scores == nil {
+			scores = hit
+			continue
+		}
+		for id := range scores {
+			if s, ok := hit[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+func credits(b Book, authorID string) bool {
+	for _, c := range b.Contributors {
+		if c.AuthorID == authorID {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSubject matches a lower-cased heading against the book's subjects.
+func hasSubject(b Book, subject string) bool {
+	for _, s := range b.Subjects {
+		if strings.ToLower(s) == subject {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageParams reads ?page and ?pageSize, returning a message for the client
+// when either is out of range.
+func pageParams(qs url.Values) (page, pageSize int, msg string) {
+	page, pageSize = 1, defaultPageSize
+	if v := qs.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, "page must be a positive number"
+		}
+		page = n
+	}
+	if v := qs.Get("pageSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, 0, "pageSize must be between 1 and " + strconv.Itoa(maxPageSize)
+		}
+		pageSize = n
+	}
+	return page, pageSize, ""
+}
+
+// pageBounds returns the slice of total results that page covers, empty when
+// the page lies past the end. (page-1)*pageSize is never computed for such a
+// page, as a huge ?page would overflow it.
+func pageBounds(page, pageSize, total int) (start, end int) {
+	if page-1 > total/pageSize {
+		return total, total
+	}
+	start = min((page-1)*pageSize, total)
+	return start, min(start+pageSize, total)
+}
+
+// sortBook is a book with the sort keys that need folding worked out once,
+// rather than on every comparison.
+type sortBook struct {
+	Book
+	title, author string
+}
+
+// bookSorts are the orders GET /api/books accepts; prefix "-" to reverse.
+var bookSorts = map[string]func(a, b sortBook) int{
+	"title":     func(a, b sortBook) int { return strings.Compare(a.title, b.title) },
+	"author":    func(a, b sortBook) int { return strings.Compare(a.author, b.author) },
+	"bookCode":  func(a, b sortBook) int { return strings.Compare(a.BookCode, b.BookCode) },
+	"createdAt": func(a, b sortBook) int { return strings.Compare(a.CreatedAt, b.CreatedAt) },
+	"price":     func(a, b sortBook) int { return cmp.Compare(a.Price, b.Price) },
+	"year":      func(a, b sortBook) int { return cmp.Compare(a.Year, b.Year) },
+}
+
+// apiGetBooks serves the catalog:
+//
+//	GET /api/books?q=&author=&authorId=&subject=&language=&category=
+//		&available=true&archived=include|only&sort=title&page=1&pageSize=20
+//
+// q matches words in the title, contributors, code, ISBN and subjects; a q
+// that is an ISBN in any form finds that book. The other filters narrow the
+// result; archived books are left out unless asked for. Without sort,
+// matches come best first, or in catalog order when there is no q.
+func apiGetBooks(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	page, pageSize, msg := pageParams(qs)
+	if msg != "" {
+		jsonWrite(w, 400, map[string]any{"error": msg})
+		return
+	}
+	sortKey := qs.Get("sort")
+	desc := strings.HasPrefix(sortKey, "-")
+	sortKey = strings.TrimPrefix(sortKey, "-")
+	if _, ok := bookSorts[sortKey]; sortKey != "" && sortKey != "relevance" && !ok {
+		jsonWrite(w, 400, map[string]any{"error": "Unknown sort " + sortKey})
+		return
+	}
+	keepArchived, msg := archivedFilter(qs)
+	if msg != "" {
+		jsonWrite(w, 400, map[string]any{"error": msg})
+		return
+	}
+	onlyAvailable := qs.Get("available") == "true"
+	category := qs.Get("category")
+	author := foldText(strings.TrimSpace(qs.Get("author")))
+	authorID := qs.Get("authorId")
+	subject := strings.ToLower(strings.TrimSpace(qs.Get("subject")))
+	language := strings.ToLower(strings.TrimSpace(qs.Get("language")))
+	q := qs.Get("q")
+	if isbn, err := normalizeISBN(q); err == nil {
+		q = isbn
+	}
+	if len(tokenize(q)) == 0 {
+		q = ""
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var books []Book
+	var scores map[string]int
+	if q != "" {
+		scores = catalog.search(q)
+		for id := range scores {
+			b, err := store.Books().ByID(id)
+			if err != nil {
+				storeError(w, err)
+				return
+			}
+			if b != nil {
+				books = append(books, *b)
+			}
+		}
+		if sortKey == "" {
+			sortKey = "relevance"
+		}
+	} else {
+		var err error
+		if books, err = store.Books().All(); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+
+	items := []Book{}
+	for _, b := range books {
+		if !keepArchived(b.archived()) {
+			continue
+		}
+		if onlyAvailable && b.AvailableQty == 0 {
+			continue
+		}
+		if category != "" && bookCategoryOf(&b) != category {
+			continue
+		}
+		if author != "" && !strings.Contains(foldText(b.Author), author) {
+			continue
+		}
+		if authorID != "" && !credits(b, authorID) {
+			continue
+		}
+		if subject != "" && !hasSubject(b, subject) {
+			continue
+		}
+		if language != "" && strings.ToLower(b.Language) != language {
+			continue
+		}
+		items = append(items, b)
+	}
+
+	order := bookSorts[sortKey]
+	if sortKey == "relevance" {
+		order = func(a, b sortBook) int {
+			if d := scores[b.ID] - scores[a.ID]; d != 0 {
+				return d
+			}
+			return bookSorts["title"](a, b)
+		}
+	}
+	if order != nil {
+		keyed := make([]sortBook, len(items))
+		for i, b := range items {
+			keyed[i] = sortBook{Book: b, title: foldText(b.Title), author: foldText(b.Author)}
+		}
+		sort.SliceStable(keyed, func(i, j int) bool {
+			if desc {
+				return order(keyed[j], keyed[i]) < 0
+			}
+			return order(keyed[i], keyed[j]) < 0
+		})
+		for i, k := range keyed {
+			items[i] = k.Book
+		}
+	}
+
+	total := len(items)
+	start, end := pageBounds(page, pageSize, total)
+	jsonWrite(w, 200, map[string]any{
+		"items":    items[start:end],
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+		"pages":    (total + pageSize - 1) / pageSize,
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestCatalogSearch(t *testing.T) {
+	ix := newCatalogIndex()
+	ix.put(Book{ID: "B1", Title: "Абай жолы", Author: "Мұхтар Әуезов"})
+	ix.put(Book{ID: "B2", Title: "Abaidyn qara sozderi", Author: "Abai Qunanbaiuly"})
+	ix.put(Book{ID: "B3", Title: "Kan", Author: "Other"})
+	ix.put(Book{ID: "B4", Title: "Gone", Author: "Removed"})
+	ix.remove("B4")
+
+	tests := []struct {
+		q    string
+		want map[string]int
+	}{
+		{"abai", map[string]int{"B1": 2, "B2": 2}},
+		{"aba", map[string]int{"B1": 1, "B2": 1}},
+		{"abaidyn", map[string]int{"B2": 2}},
+		{"abai joly", map[string]int{"B1": 4}},
+		{"auezov", map[string]int{"B1": 2}},
+		{"ka", map[string]int{"B3": 1}},
+		{"kan", map[string]int{"B3": 2}},
+		{"gone", map[string]int{}},
+		{"zzz", map[string]int{}},
+	}
+	for _, tt := range tests {
+		if got := ix.search(tt.q); !maps.Equal(got, tt.want) {
+			t.Errorf("search(%q) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+
+	// A book indexed after a search shows up in the next one.
+	ix.put(Book{ID: "B5", Title: "Abaiga"})
+	if got := ix.search("abaig"); !maps.Equal(got, map[string]int{"B5": 1}) {
+		t.Errorf("search after put = %v", got)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Session is one refresh token. Every refresh retires the presented token
+// (UsedAt) and issues a new one in the same Family; presenting a retired
+// token again means it was copied, so the whole family is revoked. Only the
+// SHA-256 of the token is stored, so a leaked data file does not hand out
+// working tokens.
+type Session struct {
+	ID        string `json:"id"`
+	UserID    string `json:"userId"`
+	Family    string `json:"family"`
+	CreatedAt string `json:"createdAt"` // when the family logged in
+	ExpiresAt string `json:"expiresAt"`
+	UsedAt    string `json:"usedAt,omitempty"`
+	UserAgent string `json:"userAgent"`
+	// Gen is the user's TokenGeneration when the token was issued; refresh
+	// refuses it once the generation has moved on.
+	Gen int `json:"gen,omitempty"`
+}
+
+var (
+	// sessionTTL is the idle timeout; every refresh pushes the family's
+	// expiry out again (SESSION_TTL).
+	sessionTTL = 12 * time.Hour
+	// sessionMaxAge caps how long refreshing can keep a family alive after
+	// login (SESSION_MAX_AGE).
+	sessionMaxAge = 30 * 24 * time.Hour
+)
+
+func loadSessionConfig() {
+	if d, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && d > 0 {
+		sessionTTL = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("SESSION_MAX_AGE")); err == nil && d > 0 {
+		sessionMaxAge = d
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// sessionExpiry is the next expiry for a family that logged in at created
+// and refreshed at now: one TTL ahead, but never past the max age.
+func sessionExpiry(created, now time.Time) time.Time {
+	exp := now.Add(sessionTTL)
+	if limit := created.Add(sessionMaxAge); exp.After(limit) {
+		exp = limit
+	}
+	return exp
+}
+
+type tokenPair struct {
+	AccessToken      string `json:"accessToken"`
+	AccessExpiresAt  string `json:"accessExpiresAt"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresAt string `json:"refreshExpiresAt"`
+}
+
+// issueTokens stores a new refresh token for u in family (a fresh family when
+// empty) and signs an access token to go with it. Callers must hold mu.
+func issueTokens(u *User, r *http.Request, family string, created time.Time) (*tokenPair, error) {
+	refresh := genToken()
+	now := time.Now().UTC()
+	if family == "" {
+		family = genToken()[:32]
+		created = now
+	}
+	sess := Session{
+		ID:        hashToken(refresh),
+		UserID:    u.ID,
+		Family:    family,
+		CreatedAt: created.Format(time.RFC3339),
+		ExpiresAt: sessionExpiry(created, now).Format(time.RFC3339),
+		UserAgent: r.UserAgent(),
+		Gen:       u.TokenGeneration,
+	}
+	access, accessExp, err := issueAccessToken(u, family)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Sessions().Create(sess); err != nil {
+		return nil, err
+	}
+	return &tokenPair{
+		AccessToken:      access,
+		AccessExpiresAt:  accessExp.Format(time.RFC3339),
+		RefreshToken:     refresh,
+		RefreshExpiresAt: sess.ExpiresAt,
+	}, nil
+}
+
+// revokeSessions deletes the refresh tokens of userID picked by match.
+// Callers must hold mu.
+func revokeSessions(userID string, match func(Session) bool) (int, error) {
+	sessions, err := store.Sessions().ByUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = store.Atomic(func() error {
+		for _, s := range sessions {
+			if !match(s) {
+				continue
+			}
+			if err := store.Sessions().Delete(s.ID); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// revokeUserSessions logs userID out everywhere: it drops every refresh token
+// and bumps the user's TokenGeneration, so nothing issued before can be
+// refreshed and outstanding access tokens run out within accessTTL. Callers
+// must hold mu.
+func revokeUserSessions(userID string) (int, error) {
+	n := 0
+	err := store.Atomic(func() error {
+		u, err := store.Users().ByID(userID)
+		if err != nil {
+			return err
+		}
+		if u != nil {
+			u.TokenGeneration++
+			if err := store.Users().Update(*u); err != nil {
+				return err
+			}
+		}
+		n, err = revokeSessions(userID, func(Session) bool { return true })
+		return err
+	})
+	return n, err
+}
+
+func revokeFamily(userID, family string) (int, error) {
+	return revokeSessions(userID, func(s Session) bool { return s.Family == family })
+}
+
+// purgeExpiredSessions drops refresh tokens nobody can use any more. Callers
+// must hold mu.
+func purgeExpiredSessions(now time.Time) error {
+	sessions, err := store.Sessions().All()
+	if err != nil {
+		return err
+	}
+	return store.Atomic(func() error {
+		for _, s := range sessions {
+			if now.Before(parseTime(s.ExpiresAt)) {
+				continue
+			}
+			if err := store.Sessions().Delete(s.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func apiRefresh(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	var req Req
+	if err := jsonRead(r, &req); err != nil || req.RefreshToken == "" {
+		jsonWrite(w, 400, map[string]any{"error": "Missing refreshToken"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	sess, err := store.Sessions().ByID(hashToken(req.RefreshToken))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if sess == nil {
+		jsonWrite(w, 401, map[string]any{"error": "Invalid refresh token"})
+		return
+	}
+	if sess.UsedAt != "" {
+		n, err := revokeFamily(sess.UserID, sess.Family)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		log.Printf("refresh token reuse for user %s; revoked %d tokens of family %s", sess.UserID, n, sess.Family)
+		jsonWrite(w, 401, map[string]any{"error": "Refresh token reused; please log in again"})
+		return
+	}
+	now := time.Now().UTC()
+	if !now.Before(parseTime(sess.ExpiresAt)) {
+		if err := store.Sessions().Delete(sess.ID); err != nil {
+			storeError(w, err)
+			return
+		}
+		jsonWrite(w, 401, map[string]any{"error": "Refresh token expired"})
+		return
+	}
+	u, err := store.Users().ByID(sess.UserID)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 401, map[string]any{"error": "User not found"})
+		return
+	}
+	// Access tokens are not checked against the store (authUser), so this is
+	// where a logout-all, password change or archive catches up with them.
+	if u.archived() || sess.Gen != u.TokenGeneration {
+		if _, err := revokeFamily(sess.UserID, sess.Family); err != nil {
+			storeError(w, err)
+			return
+		}
+		jsonWrite(w, 401, map[string]any{"error": "Session revoked; please log in again"})
+		return
+	}
+
+	var pair *tokenPair
+	err = store.Atomic(func() error {
+		sess.UsedAt = now.Format(time.RFC3339)
+		if err := store.Sessions().Update(*sess); err != nil {
+			return err
+		}
+		var err error
+		pair, err = issueTokens(u, r, sess.Family, parseTime(sess.CreatedAt))
+		return err
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{
+		"ok":               true,
+		"token":            pair.AccessToken,
+		"accessToken":      pair.AccessToken,
+		"accessExpiresAt":  pair.AccessExpiresAt,
+		"refreshToken":     pair.RefreshToken,
+		"refreshExpiresAt": pair.RefreshExpiresAt,
+	})
+}
+
+func apiLogout(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseAccessToken(bearerToken(r))
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := revokeFamily(claims.Subject, claims.SID); err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true})
+}
+
+func apiLogoutAll(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseAccessToken(bearerToken(r))
+	if err != nil {
+		jsonWrite(w, 401, map[string]any{"error": "Unauthorized"})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	n, err := revokeUserSessions(claims.Subject)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true, "revoked": n})
+}
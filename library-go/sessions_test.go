@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthUserReadsNoStore(t *testing.T) {
+	openTestStore(t)
+	u := &User{ID: "U1", Role: "librarian", TokenGeneration: 2}
+	// U1 is not in the store: the token alone must identify the caller.
+	got, err := authUser(authRequest(t, u, "GET", "/api/me", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID || got.Role != u.Role || got.TokenGeneration != u.TokenGeneration {
+		t.Errorf("authUser = %+v, want the token's claims", got)
+	}
+}
+
+func TestRefreshRefusesRevokedSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(u *User) error
+		want   int
+	}{
+		{"unchanged", func(*User) error { return nil }, 200},
+		{"generation moved on", func(u *User) error {
+			u.TokenGeneration++
+			return store.Users().Update(*u)
+		}, 401},
+		{"archived", func(u *User) error {
+			u.ArchivedAt = "2026-03-02T10:00:00Z"
+			return store.Users().Update(*u)
+		}, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestStore(t)
+			if jwtKey == nil {
+				jwtKey = []byte("test key")
+			}
+			u := &User{ID: "U1", Email: "r@x.kz", Role: "reader"}
+			if err := store.Users().Create(*u); err != nil {
+				t.Fatal(err)
+			}
+			pair, err := issueTokens(u, httptest.NewRequest("POST", "/api/auth/login", nil), "", time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.change(u); err != nil {
+				t.Fatal(err)
+			}
+			body := `{"refreshToken":"` + pair.RefreshToken + `"}`
+			w := call(apiRefresh, httptest.NewRequest("POST", "/api/auth/refresh", strings.NewReader(body)))
+			if w.Code != tt.want {
+				t.Errorf("refresh: status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Handlers never touch the persisted records directly; they go through the
+// repositories below. Lookups return (nil, nil) when nothing matches so the
+// handlers can keep answering 404 themselves, and any non-nil error is a
+// storage failure.
+
+type UserRepo interface {
+	All() ([]User, error)
+	ByID(id string) (*User, error)
+	ByEmail(email string) (*User, error)
+	Count() (int, error)
+	Create(u User) error
+	Update(u User) error
+	Delete(id string) error
+}
+
+type BookRepo interface {
+	All() ([]Book, error)
+	ByID(id string) (*Book, error)
+	ByCode(code string) (*Book, error)
+	ByISBN(isbn string) (*Book, error)
+	Count() (int, error)
+	Create(b Book) error
+	Update(b Book) error
+	Delete(id string) error
+}
+
+// AuthorRepo looks names up by authorKey, so spellings that differ only in
+// case or spacing find the same author.
+type AuthorRepo interface {
+	All() ([]Author, error)
+	ByID(id string) (*Author, error)
+	ByName(name string) (*Author, error)
+	Count() (int, error)
+	Create(a Author) error
+	Update(a Author) error
+}
+
+type LoanRepo interface {
+	All() ([]Loan, error)
+	ByID(id string) (*Loan, error)
+	ByReader(readerID string) ([]Loan, error)
+	ByBook(bookID string) ([]Loan, error)
+	ByCopy(copyID string) ([]Loan, error)
+	ByStatus(status string) ([]Loan, error)
+	// ByLoanDate and ByReturnDate list the loans issued, or returned or
+	// lost, from from to to ("2006-01-02" dates, both inclusive).
+	ByLoanDate(from, to string) ([]Loan, error)
+	ByReturnDate(from, to string) ([]Loan, error)
+	Count() (int, error)
+	Create(l Loan) error
+	Update(l Loan) error
+}
+
+type CopyRepo interface {
+	All() ([]Copy, error)
+	ByID(id string) (*Copy, error)
+	ByBarcode(barcode string) (*Copy, error)
+	ByBook(bookID string) ([]Copy, error)
+	Count() (int, error)
+	Create(c Copy) error
+	Update(c Copy) error
+	Delete(id string) error
+}
+
+type HoldRepo interface {
+	All() ([]Hold, error)
+	ByID(id string) (*Hold, error)
+	ByBook(bookID string) ([]Hold, error)
+	ByReader(readerID string) ([]Hold, error)
+	ByStatus(status string) ([]Hold, error)
+	Count() (int, error)
+	Create(h Hold) error
+	Update(h Hold) error
+}
+
+// FineRepo is append-only: ledger lines are never changed or removed.
+type FineRepo interface {
+	All() ([]FineTx, error)
+	ByUser(userID string) ([]FineTx, error)
+	ByLoan(loanID string) ([]FineTx, error)
+	Count() (int, error)
+	Create(f FineTx) error
+}
+
+// AuditRepo is append-only and keeps entries in Seq order.
+type AuditRepo interface {
+	All() ([]AuditEntry, error)
+	Last() (*AuditEntry, error)
+	Append(e AuditEntry) error
+}
+
+// LendingRuleRepo is keyed by "<readerCategory>:<bookCategory>", so Put both
+// adds and replaces a rule.
+type LendingRuleRepo interface {
+	All() ([]LendingRule, error)
+	ByID(id string) (*LendingRule, error)
+	Put(r LendingRule) error
+	Delete(id string) error
+}
+
+// OpeningHoursRepo holds at most one record per weekday; weekdays without
+// one use the default schedule.
+type OpeningHoursRepo interface {
+	All() ([]OpeningHours, error)
+	Put(h OpeningHours) error
+}
+
+// ClosedDayRepo is keyed by date.
+type ClosedDayRepo interface {
+	All() ([]ClosedDay, error)
+	ByID(date string) (*ClosedDay, error)
+	Put(d ClosedDay) error
+	Delete(date string) error
+}
+
+type SessionRepo interface {
+	All() ([]Session, error)
+	ByID(id string) (*Session, error)
+	ByUser(userID string) ([]Session, error)
+	Create(s Session) error
+	Update(s Session) error
+	Delete(id string) error
+}
+
+type LoginAttemptRepo interface {
+	All() ([]LoginAttempts, error)
+	ByID(id string) (*LoginAttempts, error)
+	Put(a LoginAttempts) error
+	Delete(id string) error
+}
+
+// SequenceRepo hands out the numbers behind record IDs; see newID.
+type SequenceRepo interface {
+	Next(kind string) (int, error)
+	Put(s Sequence) error
+}
+
+type Store interface {
+	Users() UserRepo
+	Books() BookRepo
+	Authors() AuthorRepo
+	Copies() CopyRepo
+	Loans() LoanRepo
+	Holds() HoldRepo
+	Fines() FineRepo
+	Audit() AuditRepo
+	LendingRules() LendingRuleRepo
+	OpeningHours() OpeningHoursRepo
+	ClosedDays() ClosedDayRepo
+	Sessions() SessionRepo
+	LoginAttempts() LoginAttemptRepo
+	Sequences() SequenceRepo
+
+	// Atomic runs fn so that every write it makes through the repositories
+	// is persisted together, or not at all when fn returns an error.
+	// Callers must hold mu.
+	Atomic(fn func() error) error
+
+	Close() error
+}
+
+var store Store
+
+// openStore picks the backend from STORAGE ("json" by default, or "sqlite").
+// A SQLite file that does not exist yet starts with a copy of data.json.
+func openStore() (Store, error) {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE"))) {
+	case "", "json":
+		return openJSONStore(dbFile)
+	case "sqlite":
+		path := os.Getenv("SQLITE_FILE")
+		if path == "" {
+			path = "library.db"
+		}
+		return openSQLiteStore(path, dbFile)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE %q (want json or sqlite)", os.Getenv("STORAGE"))
+	}
+}
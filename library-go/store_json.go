@@ -0,0 +1,657 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Database struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	JournalSeq    int64        `json:"journalSeq,omitempty"`
+	Users         []User       `json:"users"`
+	Books         []Book       `json:"books"`
+	Authors       []Author     `json:"authors"`
+	Copies        []Copy       `json:"copies"`
+	Loans         []Loan       `json:"loans"`
+	Holds         []Hold       `json:"holds"`
+	Fines         []FineTx     `json:"fines"`
+	Audit         []AuditEntry `json:"audit"`
+
+	LendingRules []LendingRule  `json:"lendingRules"`
+	OpeningHours []OpeningHours `json:"openingHours"`
+	ClosedDays   []ClosedDay    `json:"closedDays"`
+
+	Sessions      []Session       `json:"sessions"`
+	LoginAttempts []LoginAttempts `json:"loginAttempts"`
+
+	Sequences []Sequence `json:"sequences"`
+}
+
+var dbFile = "data.json"
+
+// compactEvery is how many journal entries may pile up before they are folded
+// into a fresh data.json snapshot (JOURNAL_COMPACT_EVERY).
+var compactEvery = 200
+
+// jsonStore keeps the whole library in memory. Writes go to the journal
+// first; data.json is rewritten only on compaction.
+type jsonStore struct {
+	path    string
+	db      Database
+	tables  map[string]*jsonTable // by op kind
+	journal *journal
+	pending []journalOp
+	undo    []func()
+	inTx    bool
+}
+
+func openJSONStore(path string) (*jsonStore, error) {
+	if v := os.Getenv("JOURNAL_COMPACT_EVERY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			compactEvery = n
+		}
+	}
+	s := &jsonStore{path: path}
+	migrated, err := s.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if migrated || s.journal.n > 0 {
+		if err := s.compact(); err != nil {
+			s.journal.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// loadDB reads the snapshot, replays the journal on top of it, runs any
+// pending schema migrations and repairs duplicate IDs. It reports whether
+// either changed the data so the caller can write the new snapshot out.
+func (s *jsonStore) loadDB() (bool, error) {
+	doc := map[string]any{"schemaVersion": schemaVersion}
+	f, err := os.Open(s.path)
+	if err == nil {
+		doc, err = decodeDoc(f)
+		f.Close()
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", s.path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	j, err := openJournal(s.path+".journal", doc)
+	if err != nil {
+		return false, err
+	}
+
+	from, err := migrateDoc(doc)
+	if err == nil && from < schemaVersion {
+		err = backupFile(s.path, fmt.Sprintf(".v%d.bak", from))
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	var repaired []string
+	if err == nil {
+		if repaired = repairIDs(doc); len(repaired) > 0 {
+			for _, line := range repaired {
+				log.Printf("repaired duplicate ID: %s", line)
+			}
+			err = backupFile(s.path, ".ids.bak")
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+	}
+	if err == nil {
+		var raw []byte
+		raw, err = json.Marshal(doc)
+		if err == nil {
+			err = json.Unmarshal(raw, &s.db)
+		}
+	}
+	if err != nil {
+		j.Close()
+		return false, fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.db.SchemaVersion = schemaVersion
+	s.tables = map[string]*jsonTable{}
+	for kind, l := range jsonLists {
+		s.tables[kind] = l.index(&s.db)
+	}
+	s.journal = j
+	return from < schemaVersion || len(repaired) > 0, nil
+}
+
+// saveDB writes a full snapshot next to data.json, fsyncs it and only then
+// renames it into place, so a crash leaves either the old or the new file.
+func (s *jsonStore) saveDB() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(s.db)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// compact folds the journal into data.json. The snapshot remembers the last
+// sequence it contains, so a crash between the rename and the truncate only
+// makes the next start skip entries it already has.
+func (s *jsonStore) compact() error {
+	s.db.JournalSeq = s.journal.seq
+	if err := s.saveDB(); err != nil {
+		return err
+	}
+	return s.journal.reset()
+}
+
+func (s *jsonStore) Atomic(fn func() error) error {
+	if s.inTx {
+		return fn()
+	}
+	s.inTx = true
+	s.pending, s.undo = nil, nil
+	err := fn()
+	s.inTx = false
+	if err == nil && len(s.pending) > 0 {
+		err = s.journal.append(s.pending)
+	}
+	if err != nil {
+		for i := len(s.undo) - 1; i >= 0; i-- {
+			s.undo[i]()
+		}
+	}
+	s.pending, s.undo = nil, nil
+	if err != nil {
+		return err
+	}
+	if s.journal.n >= compactEvery {
+		if err := s.compact(); err != nil {
+			// The entry is already durable in the journal; compaction
+			// will be retried after the next write.
+			log.Printf("journal compaction failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// exec applies op to the in-memory state and its indexes, and queues it for
+// the journal along with the step that takes it back.
+func (s *jsonStore) exec(op journalOp) error {
+	return s.Atomic(func() error {
+		l, ok := jsonLists[op.Kind]
+		if !ok {
+			return fmt.Errorf("journal: unknown kind %q", op.Kind)
+		}
+		undo, err := l.apply(&s.db, s.tables[op.Kind], op)
+		if err != nil {
+			return err
+		}
+		if undo != nil {
+			s.undo = append(s.undo, undo)
+		}
+		s.pending = append(s.pending, op)
+		return nil
+	})
+}
+
+func (s *jsonStore) put(kind, id string, v any) error {
+	op, err := putOp(kind, id, v)
+	if err != nil {
+		return err
+	}
+	return s.exec(op)
+}
+
+func (s *jsonStore) Close() error {
+	err := s.compact()
+	if cerr := s.journal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *jsonStore) Users() UserRepo                 { return jsonUsers{s} }
+func (s *jsonStore) Books() BookRepo                 { return jsonBooks{s} }
+func (s *jsonStore) Authors() AuthorRepo             { return jsonAuthors{s} }
+func (s *jsonStore) Copies() CopyRepo                { return jsonCopies{s} }
+func (s *jsonStore) Loans() LoanRepo                 { return jsonLoans{s} }
+func (s *jsonStore) Holds() HoldRepo                 { return jsonHolds{s} }
+func (s *jsonStore) Fines() FineRepo                 { return jsonFines{s} }
+func (s *jsonStore) Audit() AuditRepo                { return jsonAudit{s} }
+func (s *jsonStore) LendingRules() LendingRuleRepo   { return jsonLendingRules{s} }
+func (s *jsonStore) OpeningHours() OpeningHoursRepo  { return jsonOpeningHours{s} }
+func (s *jsonStore) ClosedDays() ClosedDayRepo       { return jsonClosedDays{s} }
+func (s *jsonStore) Sessions() SessionRepo           { return jsonSessions{s} }
+func (s *jsonStore) LoginAttempts() LoginAttemptRepo { return jsonLoginAttempts{s} }
+func (s *jsonStore) Sequences() SequenceRepo         { return jsonSequences{s} }
+
+type jsonUsers struct{ s *jsonStore }
+
+func (r jsonUsers) All() ([]User, error) {
+	return append([]User(nil), r.s.db.Users...), nil
+}
+
+func (r jsonUsers) ByID(id string) (*User, error) {
+	return userList.get(r.s, id), nil
+}
+
+func (r jsonUsers) ByEmail(email string) (*User, error) {
+	return userList.first(r.s, "email", strings.ToLower(email)), nil
+}
+
+func (r jsonUsers) Count() (int, error) { return len(r.s.db.Users), nil }
+
+func (r jsonUsers) Create(u User) error {
+	if old, _ := r.ByID(u.ID); old != nil {
+		return errors.New("user already exists: " + u.ID)
+	}
+	return r.s.put("user", u.ID, u)
+}
+
+func (r jsonUsers) Update(u User) error {
+	if old, _ := r.ByID(u.ID); old == nil {
+		return errors.New("user not found: " + u.ID)
+	}
+	return r.s.put("user", u.ID, u)
+}
+
+func (r jsonUsers) Delete(id string) error {
+	if old, _ := r.ByID(id); old == nil {
+		return errors.New("user not found: " + id)
+	}
+	return r.s.exec(deleteOp("user", id))
+}
+
+type jsonBooks struct{ s *jsonStore }
+
+func (r jsonBooks) All() ([]Book, error) {
+	return append([]Book(nil), r.s.db.Books...), nil
+}
+
+func (r jsonBooks) ByID(id string) (*Book, error) {
+	return bookList.get(r.s, id), nil
+}
+
+func (r jsonBooks) ByCode(code string) (*Book, error) {
+	return bookList.first(r.s, "code", strings.ToLower(code)), nil
+}
+
+func (r jsonBooks) ByISBN(isbn string) (*Book, error) {
+	return bookList.first(r.s, "isbn", isbn), nil
+}
+
+func (r jsonBooks) Count() (int, error) { return len(r.s.db.Books), nil }
+
+func (r jsonBooks) Create(b Book) error {
+	if old, _ := r.ByID(b.ID); old != nil {
+		return errors.New("book already exists: " + b.ID)
+	}
+	return r.s.put("book", b.ID, b)
+}
+
+func (r jsonBooks) Update(b Book) error {
+	if old, _ := r.ByID(b.ID); old == nil {
+		return errors.New("book not found: " + b.ID)
+	}
+	return r.s.put("book", b.ID, b)
+}
+
+func (r jsonBooks) Delete(id string) error {
+	if old, _ := r.ByID(id); old == nil {
+		return errors.New("book not found: " + id)
+	}
+	return r.s.exec(deleteOp("book", id))
+}
+
+type jsonAuthors struct{ s *jsonStore }
+
+func (r jsonAuthors) All() ([]Author, error) {
+	return append([]Author(nil), r.s.db.Authors...), nil
+}
+
+func (r jsonAuthors) ByID(id string) (*Author, error) {
+	return authorList.get(r.s, id), nil
+}
+
+func (r jsonAuthors) ByName(name string) (*Author, error) {
+	return authorList.first(r.s, "name", authorKey(name)), nil
+}
+
+func (r jsonAuthors) Count() (int, error) { return len(r.s.db.Authors), nil }
+
+func (r jsonAuthors) Create(a Author) error {
+	if old, _ := r.ByID(a.ID); old != nil {
+		return errors.New("author already exists: " + a.ID)
+	}
+	return r.s.put("author", a.ID, a)
+}
+
+func (r jsonAuthors) Update(a Author) error {
+	if old, _ := r.ByID(a.ID); old == nil {
+		return errors.New("author not found: " + a.ID)
+	}
+	return r.s.put("author", a.ID, a)
+}
+
+type jsonCopies struct{ s *jsonStore }
+
+func (r jsonCopies) All() ([]Copy, error) {
+	return append([]Copy(nil), r.s.db.Copies...), nil
+}
+
+func (r jsonCopies) ByID(id string) (*Copy, error) {
+	return copyList.get(r.s, id), nil
+}
+
+func (r jsonCopies) ByBarcode(barcode string) (*Copy, error) {
+	return copyList.first(r.s, "barcode", strings.ToLower(barcode)), nil
+}
+
+func (r jsonCopies) ByBook(bookID string) ([]Copy, error) {
+	return copyList.find(r.s, "book", bookID), nil
+}
+
+func (r jsonCopies) Count() (int, error) { return len(r.s.db.Copies), nil }
+
+func (r jsonCopies) Create(c Copy) error {
+	if old, _ := r.ByID(c.ID); old != nil {
+		return errors.New("copy already exists: " + c.ID)
+	}
+	return r.s.put("copy", c.ID, c)
+}
+
+func (r jsonCopies) Update(c Copy) error {
+	if old, _ := r.ByID(c.ID); old == nil {
+		return errors.New("copy not found: " + c.ID)
+	}
+	return r.s.put("copy", c.ID, c)
+}
+
+func (r jsonCopies) Delete(id string) error {
+	if old, _ := r.ByID(id); old == nil {
+		return errors.New("copy not found: " + id)
+	}
+	return r.s.exec(deleteOp("copy", id))
+}
+
+type jsonLoans struct{ s *jsonStore }
+
+func (r jsonLoans) All() ([]Loan, error) {
+	return append([]Loan(nil), r.s.db.Loans...), nil
+}
+
+func (r jsonLoans) ByID(id string) (*Loan, error) {
+	return loanList.get(r.s, id), nil
+}
+
+func (r jsonLoans) ByReader(readerID string) ([]Loan, error) {
+	return loanList.find(r.s, "reader", readerID), nil
+}
+
+func (r jsonLoans) ByBook(bookID string) ([]Loan, error) {
+	return loanList.find(r.s, "book", bookID), nil
+}
+
+func (r jsonLoans) ByCopy(copyID string) ([]Loan, error) {
+	return loanList.find(r.s, "copy", copyID), nil
+}
+
+func (r jsonLoans) ByStatus(status string) ([]Loan, error) {
+	return loanList.find(r.s, "status", status), nil
+}
+
+func (r jsonLoans) ByLoanDate(from, to string) ([]Loan, error) {
+	return loanList.findDays(r.s, "loanDate", from, to), nil
+}
+
+func (r jsonLoans) ByReturnDate(from, to string) ([]Loan, error) {
+	return loanList.findDays(r.s, "returnDate", from, to), nil
+}
+
+func (r jsonLoans) Count() (int, error) { return len(r.s.db.Loans), nil }
+
+func (r jsonLoans) Create(l Loan) error {
+	if old, _ := r.ByID(l.ID); old != nil {
+		return errors.New("loan already exists: " + l.ID)
+	}
+	return r.s.put("loan", l.ID, l)
+}
+
+func (r jsonLoans) Update(l Loan) error {
+	if old, _ := r.ByID(l.ID); old == nil {
+		return errors.New("loan not found: " + l.ID)
+	}
+	return r.s.put("loan", l.ID, l)
+}
+
+type jsonHolds struct{ s *jsonStore }
+
+func (r jsonHolds) All() ([]Hold, error) {
+	return append([]Hold(nil), r.s.db.Holds...), nil
+}
+
+func (r jsonHolds) ByID(id string) (*Hold, error) {
+	return holdList.get(r.s, id), nil
+}
+
+func (r jsonHolds) ByBook(bookID string) ([]Hold, error) {
+	return holdList.find(r.s, "book", bookID), nil
+}
+
+func (r jsonHolds) ByReader(readerID string) ([]Hold, error) {
+	return holdList.find(r.s, "reader", readerID), nil
+}
+
+func (r jsonHolds) ByStatus(status string) ([]Hold, error) {
+	return holdList.find(r.s, "status", status), nil
+}
+
+func (r jsonHolds) Count() (int, error) { return len(r.s.db.Holds), nil }
+
+func (r jsonHolds) Create(h Hold) error {
+	if old, _ := r.ByID(h.ID); old != nil {
+		return errors.New("hold already exists: " + h.ID)
+	}
+	return r.s.put("hold", h.ID, h)
+}
+
+func (r jsonHolds) Update(h Hold) error {
+	if old, _ := r.ByID(h.ID); old == nil {
+		return errors.New("hold not found: " + h.ID)
+	}
+	return r.s.put("hold", h.ID, h)
+}
+
+type jsonFines struct{ s *jsonStore }
+
+func (r jsonFines) All() ([]FineTx, error) {
+	return append([]FineTx(nil), r.s.db.Fines...), nil
+}
+
+func (r jsonFines) ByUser(userID string) ([]FineTx, error) {
+	return fineList.find(r.s, "user", userID), nil
+}
+
+func (r jsonFines) ByLoan(loanID string) ([]FineTx, error) {
+	return fineList.find(r.s, "loan", loanID), nil
+}
+
+func (r jsonFines) Count() (int, error) { return len(r.s.db.Fines), nil }
+
+func (r jsonFines) Create(f FineTx) error {
+	if fineList.get(r.s, f.ID) != nil {
+		return errors.New("fine transaction already exists: " + f.ID)
+	}
+	return r.s.put("fine", f.ID, f)
+}
+
+type jsonAudit struct{ s *jsonStore }
+
+func (r jsonAudit) All() ([]AuditEntry, error) {
+	return append([]AuditEntry(nil), r.s.db.Audit...), nil
+}
+
+func (r jsonAudit) Last() (*AuditEntry, error) {
+	if n := len(r.s.db.Audit); n > 0 {
+		e := r.s.db.Audit[n-1]
+		return &e, nil
+	}
+	return nil, nil
+}
+
+func (r jsonAudit) Append(e AuditEntry) error {
+	if n := len(r.s.db.Audit); n > 0 && r.s.db.Audit[n-1].Seq >= e.Seq {
+		return fmt.Errorf("audit entry %d is out of order", e.Seq)
+	}
+	return r.s.put("audit", e.ID, e)
+}
+
+type jsonLendingRules struct{ s *jsonStore }
+
+func (r jsonLendingRules) All() ([]LendingRule, error) {
+	return append([]LendingRule(nil), r.s.db.LendingRules...), nil
+}
+
+func (r jsonLendingRules) ByID(id string) (*LendingRule, error) {
+	return ruleList.get(r.s, id), nil
+}
+
+func (r jsonLendingRules) Put(l LendingRule) error {
+	return r.s.put("rule", l.ID, l)
+}
+
+func (r jsonLendingRules) Delete(id string) error {
+	if old, _ := r.ByID(id); old == nil {
+		return errors.New("lending rule not found: " + id)
+	}
+	return r.s.exec(deleteOp("rule", id))
+}
+
+type jsonOpeningHours struct{ s *jsonStore }
+
+func (r jsonOpeningHours) All() ([]OpeningHours, error) {
+	return append([]OpeningHours(nil), r.s.db.OpeningHours...), nil
+}
+
+func (r jsonOpeningHours) Put(h OpeningHours) error {
+	return r.s.put("hours", h.ID, h)
+}
+
+type jsonClosedDays struct{ s *jsonStore }
+
+func (r jsonClosedDays) All() ([]ClosedDay, error) {
+	return append([]ClosedDay(nil), r.s.db.ClosedDays...), nil
+}
+
+func (r jsonClosedDays) ByID(date string) (*ClosedDay, error) {
+	return closedList.get(r.s, date), nil
+}
+
+func (r jsonClosedDays) Put(d ClosedDay) error {
+	return r.s.put("closed", d.ID, d)
+}
+
+func (r jsonClosedDays) Delete(date string) error {
+	if old, _ := r.ByID(date); old == nil {
+		return errors.New("closed day not found: " + date)
+	}
+	return r.s.exec(deleteOp("closed", date))
+}
+
+type jsonSessions struct{ s *jsonStore }
+
+func (r jsonSessions) All() ([]Session, error) {
+	return append([]Session(nil), r.s.db.Sessions...), nil
+}
+
+func (r jsonSessions) ByID(id string) (*Session, error) {
+	return sessionList.get(r.s, id), nil
+}
+
+func (r jsonSessions) ByUser(userID string) ([]Session, error) {
+	return sessionList.find(r.s, "user", userID), nil
+}
+
+func (r jsonSessions) Create(s Session) error {
+	if old, _ := r.ByID(s.ID); old != nil {
+		return errors.New("session already exists")
+	}
+	return r.s.put("session", s.ID, s)
+}
+
+func (r jsonSessions) Update(s Session) error {
+	if old, _ := r.ByID(s.ID); old == nil {
+		return errors.New("session not found")
+	}
+	return r.s.put("session", s.ID, s)
+}
+
+func (r jsonSessions) Delete(id string) error {
+	if old, _ := r.ByID(id); old == nil {
+		return errors.New("session not found")
+	}
+	return r.s.exec(deleteOp("session", id))
+}
+
+type jsonLoginAttempts struct{ s *jsonStore }
+
+func (r jsonLoginAttempts) All() ([]LoginAttempts, error) {
+	return append([]LoginAttempts(nil), r.s.db.LoginAttempts...), nil
+}
+
+func (r jsonLoginAttempts) ByID(id string) (*LoginAttempts, error) {
+	return attemptList.get(r.s, id), nil
+}
+
+func (r jsonLoginAttempts) Put(a LoginAttempts) error {
+	return r.s.put("attempt", a.ID, a)
+}
+
+func (r jsonLoginAttempts) Delete(id string) error {
+	if old, _ := r.ByID(id); old == nil {
+		return errors.New("login attempts not found: " + id)
+	}
+	return r.s.exec(deleteOp("attempt", id))
+}
+
+type jsonSequences struct{ s *jsonStore }
+
+func (r jsonSequences) Next(kind string) (int, error) {
+	seq := Sequence{ID: kind}
+	if cur := sequenceList.get(r.s, kind); cur != nil {
+		seq = *cur
+	}
+	seq.Last++
+	return seq.Last, r.Put(seq)
+}
+
+func (r jsonSequences) Put(seq Sequence) error {
+	return r.s.put("seq", seq.ID, seq)
+}
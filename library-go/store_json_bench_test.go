@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The JSON store is meant to stay usable at 100k books and 1M loans. These
+// benchmarks seed a store of that size and time the requests that touch the
+// most of it: listing every loan, and issuing one.
+//
+//	go test -run '^$' -bench . -benchtime 3x
+
+const (
+	benchBooks   = 100_000
+	benchLoans   = 1_000_000
+	benchReaders = 1_000
+)
+
+// seedBenchStore opens a JSON store in a temporary directory, fills it with
+// one copy per book and returned loans spread over the readers.
+func seedBenchStore(b *testing.B) *jsonStore {
+	b.Helper()
+	s := openTestStore(b)
+	for i := 1; i <= benchReaders; i++ {
+		s.db.Users = append(s.db.Users, User{
+			ID: genID("U", i), FullName: fmt.Sprint("Reader ", i), Email: fmt.Sprintf("r%d@example.kz", i),
+			Role: "reader", Category: readerStudent,
+		})
+	}
+	for i := 1; i <= benchBooks; i++ {
+		s.db.Books = append(s.db.Books, Book{
+			ID: genID("B", i), BookCode: fmt.Sprint("BC", i), Title: fmt.Sprint("Title ", i),
+			Author: "Author", Category: bookStandard, TotalQty: 1, AvailableQty: 1,
+		})
+		s.db.Copies = append(s.db.Copies, Copy{
+			ID: genID("C", i), BookID: genID("B", i), Barcode: fmt.Sprint("BC", i, "-1"), Status: copyAvailable,
+		})
+	}
+	for i := 1; i <= benchLoans; i++ {
+		s.db.Loans = append(s.db.Loans, Loan{
+			ID: genID("L", i), ReaderID: genID("U", i%benchReaders+1), BookID: genID("B", i%benchBooks+1),
+			CopyID: genID("C", i%benchBooks+1), LoanDate: "2025-01-01", DueDate: "2025-01-15",
+			ReturnDate: "2025-01-10", Status: loanReturned,
+		})
+	}
+	s.db.Sequences = []Sequence{
+		{ID: "user", Last: benchReaders}, {ID: "book", Last: benchBooks},
+		{ID: "copy", Last: benchBooks}, {ID: "loan", Last: benchLoans},
+	}
+	for kind, l := range jsonLists {
+		s.tables[kind] = l.index(&s.db)
+	}
+	// Keep compaction, which rewrites all of data.json, out of the timings.
+	old := compactEvery
+	compactEvery = 1 << 30
+	b.Cleanup(func() { compactEvery = old })
+	return s
+}
+
+func BenchmarkLoanViews(b *testing.B) {
+	seedBenchStore(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v, err := loanViews()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(v) != benchLoans {
+			b.Fatalf("got %d loans, want %d", len(v), benchLoans)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchLoans), "ns/loan")
+}
+
+func BenchmarkListLoans(b *testing.B) {
+	seedBenchStore(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		apiListLoans(w, httptest.NewRequest("GET", "/api/loans", nil))
+		if w.Code != 200 {
+			b.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchLoans), "ns/loan")
+}
+
+func BenchmarkBorrow(b *testing.B) {
+	seedBenchStore(b)
+	if b.N > benchBooks {
+		b.Skipf("only %d copies to lend", benchBooks)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		body := fmt.Sprintf(`{"readerId":%q,"barcode":"BC%d-1"}`, genID("U", i%benchReaders+1), i+1)
+		w := httptest.NewRecorder()
+		apiBorrow(w, httptest.NewRequest("POST", "/api/loans/borrow", strings.NewReader(body)))
+		if w.Code != 200 {
+			b.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+}
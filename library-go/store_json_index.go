@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The JSON store answers lookups from in-memory indexes rather than scanning
+// its lists. Each list of the Database has a jsonTable: pos finds a record's
+// place in the list by ID, and every secondary index maps a key (an email, a
+// reader ID, ...) to the IDs of the records that have it. The tables are
+// built on load and kept current by every put and delete, and each change
+// returns an undo step so a failed Atomic block can be rolled back without
+// copying the whole database first.
+
+type jsonTable struct {
+	pos  map[string]int
+	keys map[string]map[string][]string // index -> key -> IDs
+}
+
+// jsonList describes one list of the Database: where it lives, how to read a
+// record's ID and which secondary keys to index. A key function returning ""
+// leaves the record out of that index.
+type jsonList[T any] struct {
+	kind string
+	rows func(d *Database) *[]T
+	id   func(v T) string
+	keys map[string]func(v T) string
+}
+
+// jsonIndexer is the untyped face of a jsonList, for the code that only
+// knows an op's kind.
+type jsonIndexer interface {
+	index(d *Database) *jsonTable
+	apply(d *Database, t *jsonTable, op journalOp) (undo func(), err error)
+}
+
+var (
+	userList = jsonList[User]{
+		kind: "user",
+		rows: func(d *Database) *[]User { return &d.Users },
+		id:   func(u User) string { return u.ID },
+		keys: map[string]func(User) string{
+			"email": func(u User) string { return strings.ToLower(u.Email) },
+		},
+	}
+	bookList = jsonList[Book]{
+		kind: "book",
+		rows: func(d *Database) *[]Book { return &d.Books },
+		id:   func(b Book) string { return b.ID },
+		keys: map[string]func(Book) string{
+			"code": func(b Book) string { return strings.ToLower(b.BookCode) },
+			"isbn": func(b Book) string { return b.ISBN },
+		},
+	}
+	authorList = jsonList[Author]{
+		kind: "author",
+		rows: func(d *Database) *[]Author { return &d.Authors },
+		id:   func(a Author) string { return a.ID },
+		keys: map[string]func(Author) string{
+			"name": func(a Author) string { return authorKey(a.Name) },
+		},
+	}
+	copyList = jsonList[Copy]{
+		kind: "copy",
+		rows: func(d *Database) *[]Copy { return &d.Copies },
+		id:   func(c Copy) string { return c.ID },
+		keys: map[string]func(Copy) string{
+			"barcode": func(c Copy) string { return strings.ToLower(c.Barcode) },
+			"book":    func(c Copy) string { return c.BookID },
+		},
+	}
+	loanList = jsonList[Loan]{
+		kind: "loan",
+		rows: func(d *Database) *[]Loan { return &d.Loans },
+		id:   func(l Loan) string { return l.ID },
+		keys: map[string]func(Loan) string{
+			"reader":     func(l Loan) string { return l.ReaderID },
+			"book":       func(l Loan) string { return l.BookID },
+			"copy":       func(l Loan) string { return l.CopyID },
+			"status":     func(l Loan) string { return l.Status },
+			"loanDate":   func(l Loan) string { return l.LoanDate },
+			"returnDate": func(l Loan) string { return l.ReturnDate },
+		},
+	}
+	holdList = jsonList[Hold]{
+		kind: "hold",
+		rows: func(d *Database) *[]Hold { return &d.Holds },
+		id:   func(h Hold) string { return h.ID },
+		keys: map[string]func(Hold) string{
+			"reader": func(h Hold) string { return h.ReaderID },
+			"book":   func(h Hold) string { return h.BookID },
+			"status": func(h Hold) string { return h.Status },
+		},
+	}
+	fineList = jsonList[FineTx]{
+		kind: "fine",
+		rows: func(d *Database) *[]FineTx { return &d.Fines },
+		id:   func(f FineTx) string { return f.ID },
+		keys: map[string]func(FineTx) string{
+			"user": func(f FineTx) string { return f.UserID },
+			"loan": func(f FineTx) string { return f.LoanID },
+		},
+	}
+	auditList = jsonList[AuditEntry]{
+		kind: "audit",
+		rows: func(d *Database) *[]AuditEntry { return &d.Audit },
+		id:   func(e AuditEntry) string { return e.ID },
+	}
+	ruleList = jsonList[LendingRule]{
+		kind: "rule",
+		rows: func(d *Database) *[]LendingRule { return &d.LendingRules },
+		id:   func(r LendingRule) string { return r.ID },
+	}
+	hoursList = jsonList[OpeningHours]{
+		kind: "hours",
+		rows: func(d *Database) *[]OpeningHours { return &d.OpeningHours },
+		id:   func(h OpeningHours) string { return h.ID },
+	}
+	closedList = jsonList[ClosedDay]{
+		kind: "closed",
+		rows: func(d *Database) *[]ClosedDay { return &d.ClosedDays },
+		id:   func(c ClosedDay) string { return c.ID },
+	}
+	sessionList = jsonList[Session]{
+		kind: "session",
+		rows: func(d *Database) *[]Session { return &d.Sessions },
+		id:   func(s Session) string { return s.ID },
+		keys: map[string]func(Session) string{
+			"user": func(s Session) string { return s.UserID },
+		},
+	}
+	attemptList = jsonList[LoginAttempts]{
+		kind: "attempt",
+		rows: func(d *Database) *[]LoginAttempts { return &d.LoginAttempts },
+		id:   func(a LoginAttempts) string { return a.ID },
+	}
+	sequenceList = jsonList[Sequence]{
+		kind: "seq",
+		rows: func(d *Database) *[]Sequence { return &d.Sequences },
+		id:   func(s Sequence) string { return s.ID },
+	}
+)
+
+// jsonLists finds a list by op kind; journalCollections says where each kind
+// lives on disk.
+var jsonLists = map[string]jsonIndexer{
+	"user":    userList,
+	"book":    bookList,
+	"author":  authorList,
+	"copy":    copyList,
+	"loan":    loanList,
+	"hold":    holdList,
+	"fine":    fineList,
+	"audit":   auditList,
+	"rule":    ruleList,
+	"hours":   hoursList,
+	"closed":  closedList,
+	"session": sessionList,
+	"attempt": attemptList,
+	"seq":     sequenceList,
+}
+
+func (l jsonList[T]) index(d *Database) *jsonTable {
+	t := &jsonTable{pos: map[string]int{}, keys: map[string]map[string][]string{}}
+	for name := range l.keys {
+		t.keys[name] = map[string][]string{}
+	}
+	for i, v := range *l.rows(d) {
+		t.pos[l.id(v)] = i
+		l.addKeys(t, v)
+	}
+	return t
+}
+
+func (l jsonList[T]) addKeys(t *jsonTable, v T) {
+	id := l.id(v)
+	for name, key := range l.keys {
+		if k := key(v); k != "" {
+			t.keys[name][k] = append(t.keys[name][k], id)
+		}
+	}
+}
+
+func (l jsonList[T]) dropKeys(t *jsonTable, v T) {
+	id := l.id(v)
+	for name, key := range l.keys {
+		k := key(v)
+		if k == "" {
+			continue
+		}
+		ids := slices.DeleteFunc(t.keys[name][k], func(x string) bool { return x == id })
+		if len(ids) == 0 {
+			delete(t.keys[name], k)
+		} else {
+			t.keys[name][k] = ids
+		}
+	}
+}
+
+// renumber refreshes pos for every record from i on, after the list has
+// shifted there.
+func (l jsonList[T]) renumber(rows []T, t *jsonTable, i int) {
+	for ; i < len(rows); i++ {
+		t.pos[l.id(rows[i])] = i
+	}
+}
+
+// apply performs op on the list and its table. The undo step it returns is
+// only valid while every later change has already been undone.
+func (l jsonList[T]) apply(d *Database, t *jsonTable, op journalOp) (func(), error) {
+	rows := l.rows(d)
+	i, found := t.pos[op.ID]
+	switch op.Op {
+	case "put":
+		var v T
+		if err := json.Unmarshal(op.Data, &v); err != nil {
+			return nil, err
+		}
+		if found {
+			old := (*rows)[i]
+			l.dropKeys(t, old)
+			(*rows)[i] = v
+			l.addKeys(t, v)
+			return func() {
+				l.dropKeys(t, v)
+				(*rows)[i] = old
+				l.addKeys(t, old)
+			}, nil
+		}
+		*rows = append(*rows, v)
+		t.pos[op.ID] = len(*rows) - 1
+		l.addKeys(t, v)
+		return func() {
+			l.dropKeys(t, v)
+			*rows = (*rows)[:len(*rows)-1]
+			delete(t.pos, op.ID)
+		}, nil
+	case "delete":
+		if !found {
+			return nil, nil
+		}
+		old := (*rows)[i]
+		l.dropKeys(t, old)
+		*rows = slices.Delete(*rows, i, i+1)
+		delete(t.pos, op.ID)
+		l.renumber(*rows, t, i)
+		return func() {
+			*rows = slices.Insert(*rows, i, old)
+			l.renumber(*rows, t, i)
+			l.addKeys(t, old)
+		}, nil
+	default:
+		return nil, fmt.Errorf("journal: unknown op %q", op.Op)
+	}
+}
+
+// get returns a copy of the record with the given ID.
+func (l jsonList[T]) get(s *jsonStore, id string) *T {
+	i, ok := s.tables[l.kind].pos[id]
+	if !ok {
+		return nil
+	}
+	v := (*l.rows(&s.db))[i]
+	return &v
+}
+
+// find returns the records whose key under index is k, in list order.
+func (l jsonList[T]) find(s *jsonStore, index, k string) []T {
+	t := s.tables[l.kind]
+	ids := t.keys[index][k]
+	pos := make([]int, 0, len(ids))
+	for _, id := range ids {
+		pos = append(pos, t.pos[id])
+	}
+	return l.at(s, pos)
+}
+
+// findDays is find for an index keyed by "2006-01-02" dates: the records
+// with any date from from to to, both inclusive, in list order.
+func (l jsonList[T]) findDays(s *jsonStore, index, from, to string) []T {
+	start, err := parseDate(from)
+	if err != nil {
+		return nil
+	}
+	end, err := parseDate(to)
+	if err != nil {
+		return nil
+	}
+	t := s.tables[l.kind]
+	var pos []int
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		for _, id := range t.keys[index][d.Format(dateLayout)] {
+			pos = append(pos, t.pos[id])
+		}
+	}
+	return l.at(s, pos)
+}
+
+// at returns the records at pos, in list order.
+func (l jsonList[T]) at(s *jsonStore, pos []int) []T {
+	slices.Sort(pos)
+	rows := *l.rows(&s.db)
+	out := make([]T, 0, len(pos))
+	for _, i := range pos {
+		out = append(out, rows[i])
+	}
+	return out
+}
+
+// first is find for unique keys: the earliest record with k, or nil.
+func (l jsonList[T]) first(s *jsonStore, index, k string) *T {
+	t := s.tables[l.kind]
+	best := -1
+	for _, id := range t.keys[index][k] {
+		if i := t.pos[id]; best == -1 || i < best {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	v := (*l.rows(&s.db))[best]
+	return &v
+}
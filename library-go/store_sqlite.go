@@ -0,0 +1,878 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Each row keeps the full record as JSON in data; the columns we look up or
+// enforce uniqueness on are pulled out next to it.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id    TEXT PRIMARY KEY,
+	email TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	data  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS books (
+	id        TEXT PRIMARY KEY,
+	book_code TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	data      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS books_isbn ON books(json_extract(data, '$.isbn'));
+CREATE TABLE IF NOT EXISTS authors (
+	id       TEXT PRIMARY KEY,
+	name_key TEXT NOT NULL UNIQUE,
+	data     TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS copies (
+	id      TEXT PRIMARY KEY,
+	book_id TEXT NOT NULL,
+	barcode TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	data    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS copies_book ON copies(book_id);
+CREATE TABLE IF NOT EXISTS loans (
+	id        TEXT PRIMARY KEY,
+	reader_id TEXT NOT NULL,
+	book_id   TEXT NOT NULL,
+	data      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS loans_reader ON loans(reader_id);
+CREATE INDEX IF NOT EXISTS loans_book ON loans(book_id);
+CREATE INDEX IF NOT EXISTS loans_copy ON loans(json_extract(data, '$.copyId'));
+CREATE INDEX IF NOT EXISTS loans_status ON loans(json_extract(data, '$.status'));
+CREATE INDEX IF NOT EXISTS loans_loan_date ON loans(json_extract(data, '$.loanDate'));
+CREATE INDEX IF NOT EXISTS loans_return_date ON loans(json_extract(data, '$.returnDate'));
+CREATE TABLE IF NOT EXISTS holds (
+	id        TEXT PRIMARY KEY,
+	book_id   TEXT NOT NULL,
+	reader_id TEXT NOT NULL,
+	data      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS holds_book ON holds(book_id);
+CREATE INDEX IF NOT EXISTS holds_reader ON holds(reader_id);
+CREATE INDEX IF NOT EXISTS holds_status ON holds(json_extract(data, '$.status'));
+CREATE TABLE IF NOT EXISTS fines (
+	id      TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	loan_id TEXT NOT NULL,
+	data    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS fines_user ON fines(user_id);
+CREATE INDEX IF NOT EXISTS fines_loan ON fines(loan_id);
+CREATE TABLE IF NOT EXISTS audit (
+	seq       INTEGER PRIMARY KEY,
+	id        TEXT NOT NULL UNIQUE,
+	actor_id  TEXT NOT NULL,
+	entity    TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	data      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_actor ON audit(actor_id);
+CREATE INDEX IF NOT EXISTS audit_entity ON audit(entity, entity_id);
+CREATE TABLE IF NOT EXISTS lending_rules (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS opening_hours (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS closed_days (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	id      TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	data    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_user ON sessions(user_id);
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS sequences (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+`
+
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type sqliteStore struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+// openSQLiteStore opens the database at path. A new, empty database is filled
+// once from the JSON store at importFrom if there is one, so that switching
+// STORAGE to sqlite keeps the library rather than starting without it.
+func openSQLiteStore(path, importFrom string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)")
+	if err != nil {
+		return nil, err
+	}
+	// All access is already serialized by mu; one connection keeps
+	// transactions and plain queries from racing each other.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite schema: %w", err)
+	}
+	s := &sqliteStore{db: db}
+	if err := s.migrate(importFrom); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite migrate: %w", err)
+	}
+	return s, nil
+}
+
+// sqliteTables maps each document key migrations see to its table.
+var sqliteTables = []struct{ doc, table string }{
+	{"users", "users"},
+	{"books", "books"},
+	{"authors", "authors"},
+	{"copies", "copies"},
+	{"loans", "loans"},
+	{"holds", "holds"},
+	{"fines", "fines"},
+	{"audit", "audit"},
+	{"lendingRules", "lending_rules"},
+	{"openingHours", "opening_hours"},
+	{"closedDays", "closed_days"},
+	{"sessions", "sessions"},
+	{"loginAttempts", "login_attempts"},
+	{"sequences", "sequences"},
+}
+
+// migrate keeps the schema version in PRAGMA user_version. Stored rows are
+// upgraded by running the same document migrations as the JSON backend over
+// every table and writing the result back in one transaction.
+func (s *sqliteStore) migrate(importFrom string) error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version == schemaVersion {
+		return nil
+	}
+
+	doc := map[string]any{"schemaVersion": version}
+	rows := 0
+	for _, t := range sqliteTables {
+		list, err := sqliteRawList(s.db, t.table)
+		if err != nil {
+			return err
+		}
+		doc[t.doc] = list
+		rows += len(list)
+	}
+	if version == 0 && rows == 0 {
+		// Fresh file: nothing to upgrade.
+		return s.importJSON(importFrom)
+	}
+	if _, err := migrateDoc(doc); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var d Database
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return err
+	}
+	return s.Atomic(func() error {
+		for _, t := range sqliteTables {
+			if _, err := s.q().Exec("DELETE FROM " + t.table); err != nil {
+				return err
+			}
+		}
+		if err := s.importDatabase(d); err != nil {
+			return err
+		}
+		_, err := s.q().Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+		return err
+	})
+}
+
+// importJSON copies the JSON store at path, journal and migrations applied,
+// into a fresh database and stamps it with the schema version, which is what
+// keeps the import from running again. path itself is left as it was.
+func (s *sqliteStore) importJSON(path string) error {
+	var js *jsonStore
+	if _, err := os.Stat(path); err == nil {
+		js = &jsonStore{path: path}
+		if _, err := js.loadDB(); err != nil {
+			return fmt.Errorf("import %w", err)
+		}
+		js.journal.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err := s.Atomic(func() error {
+		if js != nil {
+			if err := s.importDatabase(js.db); err != nil {
+				return err
+			}
+		}
+		_, err := s.q().Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+		return err
+	})
+	if err == nil && js != nil {
+		log.Printf("imported %s into the new SQLite database: %d users, %d books, %d loans", path, len(js.db.Users), len(js.db.Books), len(js.db.Loans))
+	}
+	return err
+}
+
+func (s *sqliteStore) importDatabase(d Database) error {
+	for _, u := range d.Users {
+		if err := s.Users().Create(u); err != nil {
+			return err
+		}
+	}
+	for _, b := range d.Books {
+		if err := s.Books().Create(b); err != nil {
+			return err
+		}
+	}
+	for _, a := range d.Authors {
+		if err := s.Authors().Create(a); err != nil {
+			return err
+		}
+	}
+	for _, c := range d.Copies {
+		if err := s.Copies().Create(c); err != nil {
+			return err
+		}
+	}
+	for _, l := range d.Loans {
+		if err := s.Loans().Create(l); err != nil {
+			return err
+		}
+	}
+	for _, h := range d.Holds {
+		if err := s.Holds().Create(h); err != nil {
+			return err
+		}
+	}
+	for _, f := range d.Fines {
+		if err := s.Fines().Create(f); err != nil {
+			return err
+		}
+	}
+	for _, e := range d.Audit {
+		if err := s.Audit().Append(e); err != nil {
+			return err
+		}
+	}
+	for _, l := range d.LendingRules {
+		if err := s.LendingRules().Put(l); err != nil {
+			return err
+		}
+	}
+	for _, h := range d.OpeningHours {
+		if err := s.OpeningHours().Put(h); err != nil {
+			return err
+		}
+	}
+	for _, c := range d.ClosedDays {
+		if err := s.ClosedDays().Put(c); err != nil {
+			return err
+		}
+	}
+	for _, sess := range d.Sessions {
+		if err := s.Sessions().Create(sess); err != nil {
+			return err
+		}
+	}
+	for _, a := range d.LoginAttempts {
+		if err := s.LoginAttempts().Put(a); err != nil {
+			return err
+		}
+	}
+	for _, seq := range d.Sequences {
+		if err := s.Sequences().Put(seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqliteRawList(q querier, table string) ([]any, error) {
+	rows, err := q.Query("SELECT data FROM " + table + " ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []any{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		rec, err := decodeDoc(strings.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) q() querier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *sqliteStore) Atomic(fn func() error) error {
+	if s.tx != nil {
+		return fn()
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	s.tx = tx
+	err = fn()
+	s.tx = nil
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
+
+func (s *sqliteStore) Users() UserRepo                 { return sqliteUsers{s} }
+func (s *sqliteStore) Books() BookRepo                 { return sqliteBooks{s} }
+func (s *sqliteStore) Authors() AuthorRepo             { return sqliteAuthors{s} }
+func (s *sqliteStore) Copies() CopyRepo                { return sqliteCopies{s} }
+func (s *sqliteStore) Loans() LoanRepo                 { return sqliteLoans{s} }
+func (s *sqliteStore) Holds() HoldRepo                 { return sqliteHolds{s} }
+func (s *sqliteStore) Fines() FineRepo                 { return sqliteFines{s} }
+func (s *sqliteStore) Audit() AuditRepo                { return sqliteAudit{s} }
+func (s *sqliteStore) LendingRules() LendingRuleRepo   { return sqliteLendingRules{s} }
+func (s *sqliteStore) OpeningHours() OpeningHoursRepo  { return sqliteOpeningHours{s} }
+func (s *sqliteStore) ClosedDays() ClosedDayRepo       { return sqliteClosedDays{s} }
+func (s *sqliteStore) Sessions() SessionRepo           { return sqliteSessions{s} }
+func (s *sqliteStore) LoginAttempts() LoginAttemptRepo { return sqliteLoginAttempts{s} }
+func (s *sqliteStore) Sequences() SequenceRepo         { return sqliteSequences{s} }
+
+func sqliteGet[T any](q querier, query string, args ...any) (*T, error) {
+	var data string
+	err := q.QueryRow(query, args...).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v T
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func sqliteList[T any](q querier, query string, args ...any) ([]T, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []T{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var v T
+		if err := json.Unmarshal([]byte(data), &v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+func sqliteCount(q querier, table string) (int, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+	return n, err
+}
+
+// sqliteExec runs a write and fails when it touched no row, so updates of
+// missing records do not pass silently.
+func sqliteExec(q querier, query string, args ...any) error {
+	res, err := q.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("record not found")
+	}
+	return nil
+}
+
+type sqliteUsers struct{ s *sqliteStore }
+
+func (r sqliteUsers) All() ([]User, error) {
+	return sqliteList[User](r.s.q(), "SELECT data FROM users ORDER BY rowid")
+}
+
+func (r sqliteUsers) ByID(id string) (*User, error) {
+	return sqliteGet[User](r.s.q(), "SELECT data FROM users WHERE id = ?", id)
+}
+
+func (r sqliteUsers) ByEmail(email string) (*User, error) {
+	return sqliteGet[User](r.s.q(), "SELECT data FROM users WHERE email = ?", email)
+}
+
+func (r sqliteUsers) Count() (int, error) { return sqliteCount(r.s.q(), "users") }
+
+func (r sqliteUsers) Create(u User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO users (id, email, data) VALUES (?, ?, ?)", u.ID, u.Email, string(data))
+	return err
+}
+
+func (r sqliteUsers) Update(u User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return sqliteExec(r.s.q(), "UPDATE users SET email = ?, data = ? WHERE id = ?", u.Email, string(data), u.ID)
+}
+
+func (r sqliteUsers) Delete(id string) error {
+	return sqliteExec(r.s.q(), "DELETE FROM users WHERE id = ?", id)
+}
+
+type sqliteBooks struct{ s *sqliteStore }
+
+func (r sqliteBooks) All() ([]Book, error) {
+	return sqliteList[Book](r.s.q(), "SELECT data FROM books ORDER BY rowid")
+}
+
+func (r sqliteBooks) ByID(id string) (*Book, error) {
+	return sqliteGet[Book](r.s.q(), "SELECT data FROM books WHERE id = ?", id)
+}
+
+func (r sqliteBooks) ByCode(code string) (*Book, error) {
+	return sqliteGet[Book](r.s.q(), "SELECT data FROM books WHERE book_code = ?", code)
+}
+
+func (r sqliteBooks) ByISBN(isbn string) (*Book, error) {
+	return sqliteGet[Book](r.s.q(), "SELECT data FROM books WHERE json_extract(data, '$.isbn') = ?", isbn)
+}
+
+func (r sqliteBooks) Count() (int, error) { return sqliteCount(r.s.q(), "books") }
+
+func (r sqliteBooks) Create(b Book) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO books (id, book_code, data) VALUES (?, ?, ?)", b.ID, b.BookCode, string(data))
+	return err
+}
+
+func (r sqliteBooks) Update(b Book) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return sqliteExec(r.s.q(), "UPDATE books SET book_code = ?, data = ? WHERE id = ?", b.BookCode, string(data), b.ID)
+}
+
+func (r sqliteBooks) Delete(id string) error {
+	return sqliteExec(r.s.q(), "DELETE FROM books WHERE id = ?", id)
+}
+
+type sqliteAuthors struct{ s *sqliteStore }
+
+func (r sqliteAuthors) All() ([]Author, error) {
+	return sqliteList[Author](r.s.q(), "SELECT data FROM authors ORDER BY rowid")
+}
+
+func (r sqliteAuthors) ByID(id string) (*Author, error) {
+	return sqliteGet[Author](r.s.q(), "SELECT data FROM authors WHERE id = ?", id)
+}
+
+func (r sqliteAuthors) ByName(name string) (*Author, error) {
+	return sqliteGet[Author](r.s.q(), "SELECT data FROM authors WHERE name_key = ?", authorKey(name))
+}
+
+func (r sqliteAuthors) Count() (int, error) { return sqliteCount(r.s.q(), "authors") }
+
+func (r sqliteAuthors) Create(a Author) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO authors (id, name_key, data) VALUES (?, ?, ?)", a.ID, authorKey(a.Name), string(data))
+	return err
+}
+
+func (r sqliteAuthors) Update(a Author) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return sqliteExec(r.s.q(), "UPDATE authors SET name_key = ?, data = ? WHERE id = ?", authorKey(a.Name), string(data), a.ID)
+}
+
+type sqliteCopies struct{ s *sqliteStore }
+
+func (r sqliteCopies) All() ([]Copy, error) {
+	return sqliteList[Copy](r.s.q(), "SELECT data FROM copies ORDER BY rowid")
+}
+
+func (r sqliteCopies) ByID(id string) (*Copy, error) {
+	return sqliteGet[Copy](r.s.q(), "SELECT data FROM copies WHERE id = ?", id)
+}
+
+func (r sqliteCopies) ByBarcode(barcode string) (*Copy, error) {
+	return sqliteGet[Copy](r.s.q(), "SELECT data FROM copies WHERE barcode = ?", barcode)
+}
+
+func (r sqliteCopies) ByBook(bookID string) ([]Copy, error) {
+	return sqliteList[Copy](r.s.q(), "SELECT data FROM copies WHERE book_id = ? ORDER BY rowid", bookID)
+}
+
+func (r sqliteCopies) Count() (int, error) { return sqliteCount(r.s.q(), "copies") }
+
+func (r sqliteCopies) Create(c Copy) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO copies (id, book_id, barcode, data) VALUES (?, ?, ?, ?)", c.ID, c.BookID, c.Barcode, string(data))
+	return err
+}
+
+func (r sqliteCopies) Update(c Copy) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return sqliteExec(r.s.q(), "UPDATE copies SET book_id = ?, barcode = ?, data = ? WHERE id = ?", c.BookID, c.Barcode, string(data), c.ID)
+}
+
+func (r sqliteCopies) Delete(id string) error {
+	return sqliteExec(r.s.q(), "DELETE FROM copies WHERE id = ?", id)
+}
+
+type sqliteLoans struct{ s *sqliteStore }
+
+func (r sqliteLoans) All() ([]Loan, error) {
+	return sqliteList[Loan](r.s.q(), "SELECT data FROM loans ORDER BY rowid")
+}
+
+func (r sqliteLoans) ByID(id string) (*Loan, error) {
+	return sqliteGet[Loan](r.s.q(), "SELECT data FROM loans WHERE id = ?", id)
+}
+
+func (r sqliteLoans) ByReader(readerID string) ([]Loan, error) {
+	return sqliteList[Loan](r.s.q(), "SELECT data FROM loans WHERE reader_id = ? ORDER BY rowid", readerID)
+}
+
+func (r sqliteLoans) ByBook(bookID string) ([]Loan, error) {
+	return sqliteList[Loan](r.s.q(), "SELECT data FROM loans WHERE book_id = ? ORDER BY rowid", bookID)
+}
+
+func (r sqliteLoans) ByCopy(copyID string) ([]Loan, error) {
+	return sqliteList[Loan](r.s.q(), "SELECT data FROM loans WHERE json_extract(data, '$.copyId') = ? ORDER BY rowid", copyID)
+}
+
+func (r sqliteLoans) ByStatus(status string) ([]Loan, error) {
+	return sqliteList[Loan](r.s.q(), "SELECT data FROM loans WHERE json_extract(data, '$.status') = ? ORDER BY rowid", status)
+}
+
+func (r sqliteLoans) ByLoanDate(from, to string) ([]Loan, error) {
+	return sqliteList[Loan](r.s.q(),
+		"SELECT data FROM loans WHERE json_extract(data, '$.loanDate') BETWEEN ? AND ? ORDER BY rowid", from, to)
+}
+
+func (r sqliteLoans) ByReturnDate(from, to string) ([]Loan, error) {
+	return sqliteList[Loan](r.s.q(),
+		"SELECT data FROM loans WHERE json_extract(data, '$.returnDate') BETWEEN ? AND ? ORDER BY rowid", from, to)
+}
+
+func (r sqliteLoans) Count() (int, error) { return sqliteCount(r.s.q(), "loans") }
+
+func (r sqliteLoans) Create(l Loan) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO loans (id, reader_id, book_id, data) VALUES (?, ?, ?, ?)", l.ID, l.ReaderID, l.BookID, string(data))
+	return err
+}
+
+func (r sqliteLoans) Update(l Loan) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return sqliteExec(r.s.q(), "UPDATE loans SET reader_id = ?, book_id = ?, data = ? WHERE id = ?", l.ReaderID, l.BookID, string(data), l.ID)
+}
+
+type sqliteHolds struct{ s *sqliteStore }
+
+func (r sqliteHolds) All() ([]Hold, error) {
+	return sqliteList[Hold](r.s.q(), "SELECT data FROM holds ORDER BY rowid")
+}
+
+func (r sqliteHolds) ByID(id string) (*Hold, error) {
+	return sqliteGet[Hold](r.s.q(), "SELECT data FROM holds WHERE id = ?", id)
+}
+
+func (r sqliteHolds) ByBook(bookID string) ([]Hold, error) {
+	return sqliteList[Hold](r.s.q(), "SELECT data FROM holds WHERE book_id = ? ORDER BY rowid", bookID)
+}
+
+func (r sqliteHolds) ByReader(readerID string) ([]Hold, error) {
+	return sqliteList[Hold](r.s.q(), "SELECT data FROM holds WHERE reader_id = ? ORDER BY rowid", readerID)
+}
+
+func (r sqliteHolds) ByStatus(status string) ([]Hold, error) {
+	return sqliteList[Hold](r.s.q(), "SELECT data FROM holds WHERE json_extract(data, '$.status') = ? ORDER BY rowid", status)
+}
+
+func (r sqliteHolds) Count() (int, error) { return sqliteCount(r.s.q(), "holds") }
+
+func (r sqliteHolds) Create(h Hold) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO holds (id, book_id, reader_id, data) VALUES (?, ?, ?, ?)", h.ID, h.BookID, h.ReaderID, string(data))
+	return err
+}
+
+func (r sqliteHolds) Update(h Hold) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return sqliteExec(r.s.q(), "UPDATE holds SET book_id = ?, reader_id = ?, data = ? WHERE id = ?", h.BookID, h.ReaderID, string(data), h.ID)
+}
+
+type sqliteFines struct{ s *sqliteStore }
+
+func (r sqliteFines) All() ([]FineTx, error) {
+	return sqliteList[FineTx](r.s.q(), "SELECT data FROM fines ORDER BY rowid")
+}
+
+func (r sqliteFines) ByUser(userID string) ([]FineTx, error) {
+	return sqliteList[FineTx](r.s.q(), "SELECT data FROM fines WHERE user_id = ? ORDER BY rowid", userID)
+}
+
+func (r sqliteFines) ByLoan(loanID string) ([]FineTx, error) {
+	return sqliteList[FineTx](r.s.q(), "SELECT data FROM fines WHERE loan_id = ? ORDER BY rowid", loanID)
+}
+
+func (r sqliteFines) Count() (int, error) { return sqliteCount(r.s.q(), "fines") }
+
+func (r sqliteFines) Create(f FineTx) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO fines (id, user_id, loan_id, data) VALUES (?, ?, ?, ?)", f.ID, f.UserID, f.LoanID, string(data))
+	return err
+}
+
+type sqliteAudit struct{ s *sqliteStore }
+
+func (r sqliteAudit) All() ([]AuditEntry, error) {
+	return sqliteList[AuditEntry](r.s.q(), "SELECT data FROM audit ORDER BY seq")
+}
+
+func (r sqliteAudit) Last() (*AuditEntry, error) {
+	return sqliteGet[AuditEntry](r.s.q(), "SELECT data FROM audit ORDER BY seq DESC LIMIT 1")
+}
+
+// Append relies on seq being the primary key: an entry that reuses a
+// sequence number is refused.
+func (r sqliteAudit) Append(e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO audit (seq, id, actor_id, entity, entity_id, data) VALUES (?, ?, ?, ?, ?, ?)",
+		e.Seq, e.ID, e.ActorID, e.Entity, e.EntityID, string(data))
+	return err
+}
+
+type sqliteSessions struct{ s *sqliteStore }
+
+func (r sqliteSessions) All() ([]Session, error) {
+	return sqliteList[Session](r.s.q(), "SELECT data FROM sessions ORDER BY rowid")
+}
+
+func (r sqliteSessions) ByID(id string) (*Session, error) {
+	return sqliteGet[Session](r.s.q(), "SELECT data FROM sessions WHERE id = ?", id)
+}
+
+func (r sqliteSessions) ByUser(userID string) ([]Session, error) {
+	return sqliteList[Session](r.s.q(), "SELECT data FROM sessions WHERE user_id = ? ORDER BY rowid", userID)
+}
+
+func (r sqliteSessions) Create(s Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO sessions (id, user_id, data) VALUES (?, ?, ?)", s.ID, s.UserID, string(data))
+	return err
+}
+
+func (r sqliteSessions) Update(s Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return sqliteExec(r.s.q(), "UPDATE sessions SET user_id = ?, data = ? WHERE id = ?", s.UserID, string(data), s.ID)
+}
+
+func (r sqliteSessions) Delete(id string) error {
+	return sqliteExec(r.s.q(), "DELETE FROM sessions WHERE id = ?", id)
+}
+
+type sqliteLendingRules struct{ s *sqliteStore }
+
+func (r sqliteLendingRules) All() ([]LendingRule, error) {
+	return sqliteList[LendingRule](r.s.q(), "SELECT data FROM lending_rules ORDER BY rowid")
+}
+
+func (r sqliteLendingRules) ByID(id string) (*LendingRule, error) {
+	return sqliteGet[LendingRule](r.s.q(), "SELECT data FROM lending_rules WHERE id = ?", id)
+}
+
+func (r sqliteLendingRules) Put(l LendingRule) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO lending_rules (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data", l.ID, string(data))
+	return err
+}
+
+func (r sqliteLendingRules) Delete(id string) error {
+	return sqliteExec(r.s.q(), "DELETE FROM lending_rules WHERE id = ?", id)
+}
+
+type sqliteOpeningHours struct{ s *sqliteStore }
+
+func (r sqliteOpeningHours) All() ([]OpeningHours, error) {
+	return sqliteList[OpeningHours](r.s.q(), "SELECT data FROM opening_hours ORDER BY rowid")
+}
+
+func (r sqliteOpeningHours) Put(h OpeningHours) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO opening_hours (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data", h.ID, string(data))
+	return err
+}
+
+type sqliteClosedDays struct{ s *sqliteStore }
+
+func (r sqliteClosedDays) All() ([]ClosedDay, error) {
+	return sqliteList[ClosedDay](r.s.q(), "SELECT data FROM closed_days ORDER BY id")
+}
+
+func (r sqliteClosedDays) ByID(date string) (*ClosedDay, error) {
+	return sqliteGet[ClosedDay](r.s.q(), "SELECT data FROM closed_days WHERE id = ?", date)
+}
+
+func (r sqliteClosedDays) Put(d ClosedDay) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO closed_days (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data", d.ID, string(data))
+	return err
+}
+
+func (r sqliteClosedDays) Delete(date string) error {
+	return sqliteExec(r.s.q(), "DELETE FROM closed_days WHERE id = ?", date)
+}
+
+type sqliteLoginAttempts struct{ s *sqliteStore }
+
+func (r sqliteLoginAttempts) All() ([]LoginAttempts, error) {
+	return sqliteList[LoginAttempts](r.s.q(), "SELECT data FROM login_attempts ORDER BY rowid")
+}
+
+func (r sqliteLoginAttempts) ByID(id string) (*LoginAttempts, error) {
+	return sqliteGet[LoginAttempts](r.s.q(), "SELECT data FROM login_attempts WHERE id = ?", id)
+}
+
+func (r sqliteLoginAttempts) Put(a LoginAttempts) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO login_attempts (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data", a.ID, string(data))
+	return err
+}
+
+func (r sqliteLoginAttempts) Delete(id string) error {
+	return sqliteExec(r.s.q(), "DELETE FROM login_attempts WHERE id = ?", id)
+}
+
+type sqliteSequences struct{ s *sqliteStore }
+
+func (r sqliteSequences) Next(kind string) (int, error) {
+	var n int
+	err := r.s.Atomic(func() error {
+		seq, err := sqliteGet[Sequence](r.s.q(), "SELECT data FROM sequences WHERE id = ?", kind)
+		if err != nil {
+			return err
+		}
+		if seq == nil {
+			seq = &Sequence{ID: kind}
+		}
+		seq.Last++
+		n = seq.Last
+		return r.Put(*seq)
+	})
+	return n, err
+}
+
+func (r sqliteSequences) Put(seq Sequence) error {
+	data, err := json.Marshal(seq)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.q().Exec("INSERT INTO sequences (id, data) VALUES (?, ?) ON CONFLICT(id) DO UPDATE SET data = excluded.data", seq.ID, string(data))
+	return err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LoginAttempts counts recent failed logins for one account (by email, known
+// or not) or one client IP.
+type LoginAttempts struct {
+	ID          string `json:"id"` // "account:<email>" or "ip:<addr>"
+	Failures    int    `json:"failures"`
+	LastFailure string `json:"lastFailure"`
+	LockedUntil string `json:"lockedUntil"`
+	// IPs are the addresses an account's failures came from, latest last,
+	// so that unlocking the account frees them as well.
+	IPs []string `json:"ips,omitempty"`
+}
+
+// maxAttemptIPs bounds LoginAttempts.IPs.
+const maxAttemptIPs = 10
+
+var (
+	// Every failure on an account doubles the wait before its next try,
+	// starting at loginBackoff; at the max failure count the key is locked
+	// for loginLockout. IP keys only lock at their max. Counters older than
+	// loginLockout are forgotten.
+	loginBackoff       = time.Second
+	loginLockout       = 15 * time.Minute // LOGIN_LOCKOUT
+	accountMaxFailures = 5                // LOGIN_MAX_FAILURES
+	ipMaxFailures      = 20               // LOGIN_IP_MAX_FAILURES
+	trustForwardedFor  = false            // TRUST_PROXY
+	dummyPasswordHash  []byte
+)
+
+func loadThrottleConfig() {
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES")); err == nil && n > 0 {
+		accountMaxFailures = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_IP_MAX_FAILURES")); err == nil && n > 0 {
+		ipMaxFailures = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT")); err == nil && d > 0 {
+		loginLockout = d
+	}
+	trustForwardedFor = os.Getenv("TRUST_PROXY") == "1"
+	// Compared against when the email is unknown, so a miss costs the same
+	// bcrypt work as a wrong password.
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte(genToken()), bcryptCost)
+}
+
+// clientIP is the caller's address; X-Forwarded-For is only believed when
+// TRUST_PROXY=1 says a proxy we run sets it.
+func clientIP(r *http.Request) string {
+	if trustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func accountKey(email string) string { return "account:" + email }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// loginBlockedFor reports how long the key must still wait. Callers must
+// hold mu.
+func loginBlockedFor(key string, now time.Time) (time.Duration, error) {
+	a, err := store.LoginAttempts().ByID(key)
+	if err != nil || a == nil {
+		return 0, err
+	}
+	if until := parseTime(a.LockedUntil); now.Before(until) {
+		return until.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// loginWait is how long key, with the given failure count, waits before its
+// next try. IP keys get no backoff below their max: many readers can share
+// one address, and one of them mistyping should not hold up the others.
+func loginWait(key string, failures, maxFailures int) time.Duration {
+	if failures >= maxFailures {
+		return loginLockout
+	}
+	if failures <= 0 || strings.HasPrefix(key, "ip:") {
+		return 0
+	}
+	backoff := float64(loginBackoff) * math.Pow(2, float64(failures-1))
+	if backoff >= float64(loginLockout) {
+		return loginLockout
+	}
+	return time.Duration(backoff)
+}
+
+// reserveLoginAttempt counts an attempt against key before its password is
+// checked, so that requests racing in while bcrypt runs find the count taken
+// and at most maxFailures guesses are ever in flight. Reaching maxFailures
+// locks the key at once; the backoff for a lower count is set by
+// failLoginAttempt once the guess is known to be wrong. ip, when given, is
+// remembered on the counter for apiUnlockUser. Callers must hold mu.
+func reserveLoginAttempt(key string, maxFailures int, now time.Time, ip string) error {
+	a, err := store.LoginAttempts().ByID(key)
+	if err != nil {
+		return err
+	}
+	if a == nil || now.Sub(parseTime(a.LastFailure)) > loginLockout {
+		a = &LoginAttempts{ID: key}
+	}
+	a.Failures++
+	a.LastFailure = now.Format(time.RFC3339)
+	if a.Failures >= maxFailures {
+		a.LockedUntil = now.Add(loginLockout).Format(time.RFC3339Nano)
+	}
+	if ip != "" {
+		a.IPs = append(slices.DeleteFunc(a.IPs, func(s string) bool { return s == ip }), ip)
+		if len(a.IPs) > maxAttemptIPs {
+			a.IPs = a.IPs[len(a.IPs)-maxAttemptIPs:]
+		}
+	}
+	return store.LoginAttempts().Put(*a)
+}
+
+// failLoginAttempt turns a reserved attempt into a failure by setting the
+// key's backoff. A counter cleared in the meantime (by an unlock) stays
+// cleared. Callers must hold mu.
+func failLoginAttempt(key string, maxFailures int, now time.Time) error {
+	a, err := store.LoginAttempts().ByID(key)
+	if err != nil || a == nil {
+		return err
+	}
+	wait := loginWait(key, a.Failures, maxFailures)
+	if until := now.Add(wait); wait > 0 && until.After(parseTime(a.LockedUntil)) {
+		a.LockedUntil = until.Format(time.RFC3339Nano)
+	}
+	return store.LoginAttempts().Put(*a)
+}
+
+// releaseLoginAttempt hands back a reserved attempt that turned out to be a
+// good password, and recomputes the key's lock from the count left, so that
+// a reservation which reached maxFailures does not leave it locked. Callers
+// must hold mu.
+func releaseLoginAttempt(key string, maxFailures int) error {
+	a, err := store.LoginAttempts().ByID(key)
+	if err != nil || a == nil {
+		return err
+	}
+	if a.Failures--; a.Failures <= 0 {
+		return store.LoginAttempts().Delete(key)
+	}
+	a.LockedUntil = ""
+	if wait := loginWait(key, a.Failures, maxFailures); wait > 0 {
+		a.LockedUntil = parseTime(a.LastFailure).Add(wait).Format(time.RFC3339Nano)
+	}
+	return store.LoginAttempts().Put(*a)
+}
+
+// purgeLoginAttempts drops counters that have run out: no longer locked and
+// with no failure within loginLockout, so they would be reset on next use
+// anyway. Callers must hold mu.
+func purgeLoginAttempts(now time.Time) error {
+	attempts, err := store.LoginAttempts().All()
+	if err != nil {
+		return err
+	}
+	return store.Atomic(func() error {
+		for _, a := range attempts {
+			if now.Sub(parseTime(a.LastFailure)) <= loginLockout || now.Before(parseTime(a.LockedUntil)) {
+				continue
+			}
+			if err := store.LoginAttempts().Delete(a.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// clearLoginFailures forgets the counter for key. Callers must hold mu.
+func clearLoginFailures(key string) error {
+	a, err := store.LoginAttempts().ByID(key)
+	if err != nil || a == nil {
+		return err
+	}
+	return store.LoginAttempts().Delete(key)
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	jsonWrite(w, 429, map[string]any{
+		"error":      fmt.Sprintf("Too many failed logins, try again in %d s", secs),
+		"retryAfter": secs,
+	})
+}
+
+func apiUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/unlock")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u, err := store.Users().ByID(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if u == nil {
+		jsonWrite(w, 404, map[string]any{"error": "User not found"})
+		return
+	}
+	attempts, err := store.LoginAttempts().ByID(accountKey(u.Email))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	err = store.Atomic(func() error {
+		if err := clearLoginFailures(accountKey(u.Email)); err != nil {
+			return err
+		}
+		// The addresses the failures came from are likely locked too, and
+		// would keep the reader out.
+		if attempts != nil {
+			for _, ip := range attempts.IPs {
+				if err := clearLoginFailures(ipKey(ip)); err != nil {
+					return err
+				}
+			}
+		}
+		return recordAudit(r, "user.unlock", "user", u.ID, nil, nil)
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jsonWrite(w, 200, map[string]any{"ok": true})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func loginRequest(email, password string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	body := `{"email":"` + email + `","password":"` + password + `"}`
+	apiLogin(w, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(body)))
+	return w
+}
+
+func TestLoginParallelGuessesAreCounted(t *testing.T) {
+	openTestStore(t)
+	oldMax, oldIPMax := accountMaxFailures, ipMaxFailures
+	accountMaxFailures, ipMaxFailures = 3, 100
+	t.Cleanup(func() { accountMaxFailures, ipMaxFailures = oldMax, oldIPMax })
+	loadThrottleConfig()
+
+	hash, err := hashPassword("Str0ng!Passw0rd#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Users().Create(User{ID: "U1", Email: "r@x.kz", Role: "reader", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	const guesses = 20
+	codes := make(chan int, guesses)
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- loginRequest("r@x.kz", "wrong").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	checked := 0
+	for c := range codes {
+		if c == 401 {
+			checked++
+		} else if c != 429 {
+			t.Errorf("unexpected status %d", c)
+		}
+	}
+	if checked > accountMaxFailures {
+		t.Errorf("%d passwords were checked, want at most %d", checked, accountMaxFailures)
+	}
+	if c := loginRequest("r@x.kz", "Str0ng!Passw0rd#").Code; c != 429 {
+		t.Errorf("login after the burst: status %d, want 429", c)
+	}
+}
+
+func TestUnlockClearsAccountAndIPs(t *testing.T) {
+	openTestStore(t)
+	oldMax := accountMaxFailures
+	accountMaxFailures = 1
+	t.Cleanup(func() { accountMaxFailures = oldMax })
+	loadThrottleConfig()
+
+	if err := store.Users().Create(User{ID: "U1", Email: "r@x.kz", Role: "reader"}); err != nil {
+		t.Fatal(err)
+	}
+	if c := loginRequest("r@x.kz", "wrong").Code; c != 401 {
+		t.Fatalf("bad password: status %d, want 401", c)
+	}
+	ip := ipKey(clientIP(httptest.NewRequest("POST", "/", nil)))
+	if a, _ := store.LoginAttempts().ByID(ip); a == nil {
+		t.Fatal("no counter for the client IP")
+	}
+
+	w := httptest.NewRecorder()
+	apiUnlockUser(w, httptest.NewRequest("POST", "/api/users/U1/unlock", nil))
+	if w.Code != 200 {
+		t.Fatalf("unlock: status %d: %s", w.Code, w.Body)
+	}
+	for _, key := range []string{accountKey("r@x.kz"), ip} {
+		if a, _ := store.LoginAttempts().ByID(key); a != nil {
+			t.Errorf("%s still has a counter after unlock: %+v", key, a)
+		}
+	}
+}
+
+func TestPurgeLoginAttempts(t *testing.T) {
+	openTestStore(t)
+	now := time.Now().UTC()
+	stamp := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+	rows := []LoginAttempts{
+		{ID: "ip:stale", Failures: 2, LastFailure: stamp(-2 * loginLockout), LockedUntil: stamp(-2*loginLockout + time.Second)},
+		{ID: "ip:recent", Failures: 2, LastFailure: stamp(-time.Minute), LockedUntil: stamp(-time.Minute + time.Second)},
+		{ID: "ip:locked", Failures: 2, LastFailure: stamp(-2 * loginLockout), LockedUntil: stamp(time.Minute)},
+	}
+	for _, a := range rows {
+		if err := store.LoginAttempts().Put(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := purgeLoginAttempts(now); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range rows {
+		got, _ := store.LoginAttempts().ByID(a.ID)
+		if want := a.ID != "ip:stale"; (got != nil) != want {
+			t.Errorf("%s kept = %v, want %v", a.ID, got != nil, want)
+		}
+	}
+}
+
+func TestLoginWait(t *testing.T) {
+	tests := []struct {
+		key      string
+		failures int
+		want     time.Duration
+	}{
+		{"account:r@x.kz", 0, 0},
+		{"account:r@x.kz", 1, loginBackoff},
+		{"account:r@x.kz", 3, 4 * loginBackoff},
+		{"account:r@x.kz", 5, loginLockout},
+		{"ip:10.0.0.1", 1, 0},
+		{"ip:10.0.0.1", 4, 0},
+		{"ip:10.0.0.1", 5, loginLockout},
+	}
+	for _, tt := range tests {
+		if got := loginWait(tt.key, tt.failures, 5); got != tt.want {
+			t.Errorf("loginWait(%s, %d) = %v, want %v", tt.key, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestReleaseLoginAttemptUnlocks(t *testing.T) {
+	openTestStore(t)
+	now := time.Now().UTC()
+	for _, key := range []string{accountKey("r@x.kz"), ipKey("10.0.0.1")} {
+		t.Run(key, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				if err := reserveLoginAttempt(key, 3, now, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if wait, _ := loginBlockedFor(key, now); wait != loginLockout {
+				t.Fatalf("after reaching the max: blocked for %v, want %v", wait, loginLockout)
+			}
+			if err := releaseLoginAttempt(key, 3); err != nil {
+				t.Fatal(err)
+			}
+			a, _ := store.LoginAttempts().ByID(key)
+			if a == nil || a.Failures != 2 {
+				t.Fatalf("after release: %+v, want 2 failures", a)
+			}
+			if wait, _ := loginBlockedFor(key, now); wait > loginWait(key, 2, 3) {
+				t.Errorf("after release: blocked for %v, want at most %v", wait, loginWait(key, 2, 3))
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access tokens are short-lived HS256 JWTs. Any instance that shares
+// JWT_SECRET can verify them without looking anything up, which is what lets
+// several servers sit behind one load balancer. Long-lived state lives in
+// the refresh-token sessions (sessions.go).
+
+const jwtIssuer = "library-go"
+
+var (
+	jwtKey []byte
+	// accessTTL is how long an access token stays valid (ACCESS_TTL).
+	accessTTL = 15 * time.Minute
+)
+
+type accessClaims struct {
+	Role string `json:"role"`
+	// SID is the refresh-token family the token was issued from, so logout
+	// knows which family to revoke.
+	SID string `json:"sid"`
+	// Gen is the user's TokenGeneration at issue time.
+	Gen int `json:"gen,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func loadTokenConfig() {
+	if d, err := time.ParseDuration(os.Getenv("ACCESS_TTL")); err == nil && d > 0 {
+		accessTTL = d
+	}
+	if k := os.Getenv("JWT_SECRET"); k != "" {
+		jwtKey = []byte(k)
+		return
+	}
+	// Without a configured key tokens still work, but only on this
+	// instance and only until it restarts.
+	log.Printf("JWT_SECRET not set; using a random key for this process")
+	jwtKey = []byte(genToken())
+}
+
+func issueAccessToken(u *User, sid string) (string, time.Time, error) {
+	now := time.Now().UTC()
+	exp := now.Add(accessTTL)
+	claims := accessClaims{
+		Role: u.Role,
+		SID:  sid,
+		Gen:  u.TokenGeneration,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   u.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(exp),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+	return token, exp, err
+}
+
+func parseAccessToken(token string) (*accessClaims, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return jwtKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return &claims, nil
+}